@@ -7,9 +7,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
+
+	"powerkit/admission"
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermetrics"
+	"powerkit/powermw"
+	"powerkit/readiness"
 )
 
 type PowerStatus struct {
@@ -23,18 +29,18 @@ type PowerStatus struct {
 }
 
 var (
-	powerURL string
-	client   = &http.Client{Timeout: 800 * time.Millisecond}
+	// status serves the last simulator reading without waiting on the
+	// network; a circuit breaker stops hammering a dead simulator.
+	status *powerclient.Client[PowerStatus]
+	ttl    = 2 * time.Second
 
-	mu      sync.Mutex
-	cache   PowerStatus
-	cacheAt time.Time
-	ttl     = 2 * time.Second
+	// pol decides between "ok" and "low" (POWER_POLICY_*, see package policy).
+	pol *policy.Policy
 )
 
 func init() {
 	// Prefer explicit URL. Fallback to HOST_IP (simulator on :8080/status). Final fallback localhost.
-	powerURL = os.Getenv("POWER_STATUS_URL")
+	powerURL := os.Getenv("POWER_STATUS_URL")
 	if powerURL == "" {
 		if host := os.Getenv("HOST_IP"); host != "" {
 			powerURL = "http://" + host + ":8080/status"
@@ -43,56 +49,59 @@ func init() {
 	if powerURL == "" {
 		powerURL = "http://localhost:8080/status"
 	}
+	status = powerclient.New[PowerStatus](powerURL, 800*time.Millisecond, ttl)
 }
 
-func getStatus() (PowerStatus, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if time.Since(cacheAt) < ttl && cache.LastUpdated != "" {
-		return cache, nil
+func (ps PowerStatus) reading() policy.Reading {
+	return policy.Reading{
+		BatteryPercent: float64(ps.BatteryPercent),
+		IsCharging:     ps.IsCharging,
+		SolarAvailable: ps.SolarAvailable,
+		TimeOfDay:      ps.TimeOfDay,
 	}
+}
 
-	req, _ := http.NewRequest("GET", powerURL, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		cache = PowerStatus{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+// getStatus returns the cached reading; a fetch error is copied into
+// LastError next to the last good values.
+func getStatus() powerclient.Snapshot[PowerStatus] {
+	st := status.Get()
+	if st.Err != nil {
+		st.Value.LastError = st.Err.Error()
 	}
-	defer resp.Body.Close()
+	return st
+}
 
-	var ps PowerStatus
-	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
-		cache = PowerStatus{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+// decide evaluates the policy, or reports unknown when there is no
+// trustworthy reading (simulator down, or the last one is too old).
+func decide(st powerclient.Snapshot[PowerStatus]) policy.Decision {
+	if ok, why := st.Usable(3 * ttl); !ok {
+		return pol.Unknown(why)
 	}
-
-	cache, cacheAt = ps, time.Now()
-	return ps, nil
+	return pol.Evaluate(st.Value.reading())
 }
 
-// health/readiness
+// health; /readyz is served by the readiness gate
 func healthz(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
-func readyz(w http.ResponseWriter, _ *http.Request)  { w.WriteHeader(http.StatusOK) }
+
+func currentDecision() policy.Decision {
+	return decide(getStatus())
+}
 
 func handle(w http.ResponseWriter, r *http.Request) {
-	ps, _ := getStatus() // errors show up in ps.LastError
+	st := getStatus() // errors show up in st.Value.LastError
 
-	// Simple derived state: OK if battery >=30% OR charging OR solar is available.
-	powerState := "low"
-	if ps.BatteryPercent >= 30 || ps.IsCharging || ps.SolarAvailable {
-		powerState = "ok"
-	}
-	shouldRun := powerState == "ok"
+	// Default policy: "low" when battery <30% AND not charging AND no solar.
+	// "unknown" (no reading) only blocks work with POWER_POLICY_ON_UNKNOWN=closed.
+	d := decide(st)
+	shouldRun := !d.Degraded
 
 	out := map[string]any{
-		"source_url":  powerURL,
-		"power":       ps,         // raw simulator payload
-		"power_state": powerState, // "ok" | "low"
-		"should_run":  shouldRun,  // bool
-		"cached_at":   cacheAt,    // last fetch time
+		"source_url":  status.URL(),
+		"power":       st.Value,     // raw simulator payload
+		"power_state": d.State,      // "ok" | "unknown" | policy state (default "low")
+		"reasons":     d.Reasons,    // rules that matched
+		"should_run":  shouldRun,    // bool
+		"cached_at":   st.FetchedAt, // last good fetch time
 		"cache_ttl_s": int(ttl.Seconds()),
 		"server_time": time.Now().UTC(),
 	}
@@ -109,10 +118,49 @@ func main() {
 		port = "8080"
 	}
 
+	var err error
+	if pol, err = policy.Load(policy.Battery); err != nil {
+		log.Fatalf("power policy: %v", err)
+	}
+
+	// READYZ_POWER_AWARE=on fails /readyz while the battery is low (see package readiness)
+	gate, err := readiness.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// ADMISSION_MODE=on scales the admitted request rate with the battery
+	// instead of the binary should_run (see package admission)
+	adm, err := admission.FromEnv(os.Getenv)
+	if err != nil {
+		log.Fatalf("admission: %v", err)
+	}
+	metricsCfg := powermetrics.Config{
+		Policy:  pol,
+		Source:  powermw.PeekClient(status, PowerStatus.reading), // scrapes aren't cache lookups
+		Stats:   status.Stats,
+		Signals: []string{"battery_percent", "is_charging", "solar_available"},
+	}
+	var root http.Handler = http.HandlerFunc(handle)
+	if adm != nil {
+		ctl := admission.New(*adm, powermw.FromClient(status, PowerStatus.reading))
+		root = ctl.Middleware(root)
+		metricsCfg.Collectors = append(metricsCfg.Collectors, ctl.WriteMetrics)
+	}
+	metrics := powermetrics.New(metricsCfg)
+	status.OnFetch(metrics.ObserveFetch)
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", handle)
+	mux.Handle("/", root)
+	mux.Handle("/metrics", metrics.Handler())
 	mux.HandleFunc("/healthz", healthz)
-	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/readyz", gate.Handler(currentDecision))
+	// POLICY_EVAL_DEBUG=1 also lets clients test their own expressions
+	mux.HandleFunc("/policy/evaluate", policy.EvaluateHandler(pol, func() (policy.Reading, string) {
+		st := getStatus()
+		_, why := st.Usable(3 * ttl)
+		return st.Value.reading(), why
+	}, policy.EvalDebugFromEnv(os.Getenv)))
 
 	srv := &http.Server{
 		Addr:              ":" + port,
@@ -122,7 +170,7 @@ func main() {
 
 	// run server
 	go func() {
-		log.Printf("listening on :%s, fetching simulator at %s", port, powerURL)
+		log.Printf("listening on :%s, fetching simulator at %s", port, status.URL())
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powertest"
+	"powerkit/readiness"
+)
+
+// TestHandleScenarios plays battery-sim states through handle and the
+// power-aware /readyz.
+func TestHandleScenarios(t *testing.T) {
+	oldStatus, oldPol := status, pol
+	defer func() { status, pol = oldStatus, oldPol }()
+	p := policy.Battery
+	pol = &p
+
+	type step struct {
+		resp  powertest.Response
+		state string
+		ready bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"discharge and recharge", []step{
+			{powertest.JSON(powertest.Day(60)), policy.OK, true},
+			{powertest.JSON(powertest.Night(40)), policy.OK, true},
+			{powertest.JSON(powertest.Night(25)), "low", false},
+			{powertest.JSON(powertest.Day(25)), policy.OK, true},
+		}},
+		{"simulator down", []step{{powertest.Down(), policy.Unknown, true}}},
+		{"malformed JSON", []step{{powertest.Malformed(), policy.Unknown, true}}},
+		{"slow simulator", []step{{powertest.Slow(time.Second, powertest.Day(60)), policy.Unknown, true}}},
+		{"outage keeps the last reading", []step{
+			{powertest.JSON(powertest.Night(10)), "low", false},
+			{powertest.Status(http.StatusInternalServerError), "low", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := powertest.New(t)
+			status = powerclient.New[PowerStatus](srv.URL, 200*time.Millisecond, time.Minute)
+			gate := readiness.Gate{UnreadyAfter: 1, ReadyAfter: 1, MaxUnready: time.Hour}
+			readyz := gate.Handler(currentDecision)
+
+			for i, st := range tt.steps {
+				srv.Set(st.resp)
+				_ = status.Refresh(context.Background())
+
+				w := httptest.NewRecorder()
+				handle(w, httptest.NewRequest("GET", "/", nil))
+				var out struct {
+					State     string      `json:"power_state"`
+					ShouldRun bool        `json:"should_run"`
+					Power     PowerStatus `json:"power"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if out.State != st.state || out.ShouldRun != st.ready {
+					t.Fatalf("step %d: state %q should_run %v, want %q %v", i, out.State, out.ShouldRun, st.state, st.ready)
+				}
+				if st.state == policy.Unknown && out.Power.LastError == "" {
+					t.Fatalf("step %d: unknown state without last_error", i)
+				}
+
+				w = httptest.NewRecorder()
+				readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+				if (w.Code == http.StatusOK) != st.ready {
+					t.Fatalf("step %d: /readyz %d, want ready %v", i, w.Code, st.ready)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simulator is what the admin API drives: the battery model or a trace
+// replay.
+type simulator interface {
+	status(now time.Time) PowerStatus
+	pause(now time.Time)
+	resume(now time.Time)
+	reset(now time.Time)
+}
+
+// pin overrides one /status field, until Until or until unpinned.
+type pin struct {
+	Value any       `json:"value"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// pinnable fields and their validation.
+var pinFields = map[string]func(json.RawMessage) (any, error){
+	"battery_percent": func(raw json.RawMessage) (any, error) {
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil || v < 0 || v > 100 {
+			return nil, fmt.Errorf("want 0..100")
+		}
+		return v, nil
+	},
+	"is_charging":     pinBool,
+	"solar_available": pinBool,
+	"time_of_day": func(raw json.RawMessage) (any, error) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil || (v != "day" && v != "night") {
+			return nil, fmt.Errorf("want day or night")
+		}
+		return v, nil
+	},
+	"solar_w": func(raw json.RawMessage) (any, error) {
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil || v < 0 {
+			return nil, fmt.Errorf("want watts >= 0")
+		}
+		return v, nil
+	},
+}
+
+func pinBool(raw json.RawMessage) (any, error) {
+	var v bool
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("want true or false")
+	}
+	return v, nil
+}
+
+// controller layers pins over a simulator and serves the admin API.
+type controller struct {
+	sim     simulator
+	faults  *faultInjector // nil: no fault injection
+	thermal *thermal       // nil: no /power
+	token   string         // "" disables the admin API
+	now     func() time.Time
+
+	mu     sync.Mutex
+	pins   map[string]pin
+	paused bool
+}
+
+func newController(sim simulator, token string) *controller {
+	return &controller{sim: sim, token: token, now: time.Now, pins: map[string]pin{}}
+}
+
+// status is the simulator's status with the active pins applied.
+func (c *controller) status(now time.Time) PowerStatus {
+	st := c.sim.status(now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for field, p := range c.pins {
+		if !p.Until.IsZero() && !now.Before(p.Until) {
+			delete(c.pins, field) // timed override over: back to the model
+			continue
+		}
+		switch v := p.Value.(type) {
+		case float64:
+			if field == "battery_percent" {
+				st.BatteryPercent = int(math.Round(v))
+			} else {
+				st.SolarW = v
+			}
+		case bool:
+			if field == "is_charging" {
+				st.IsCharging = v
+			} else {
+				st.SolarAvailable = v
+			}
+		case string:
+			st.TimeOfDay = v
+		}
+		st.Pinned = append(st.Pinned, field)
+	}
+	sort.Strings(st.Pinned)
+	return st
+}
+
+// pin sets the fields in body, e.g. {"battery_percent": 10, "for": "5m"};
+// without "for" they stay pinned until unpinned.
+func (c *controller) pin(body map[string]json.RawMessage, now time.Time) error {
+	var until time.Time
+	if raw, ok := body["for"]; ok {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("for: want a duration like \"5m\"")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("for: want a positive duration like \"5m\"")
+		}
+		until = now.Add(d)
+	}
+	pins := map[string]pin{}
+	for field, raw := range body {
+		if field == "for" {
+			continue
+		}
+		parse, ok := pinFields[field]
+		if !ok {
+			return fmt.Errorf("%s: not pinnable (want one of %s)", field, strings.Join(pinFieldNames(), ", "))
+		}
+		v, err := parse(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		pins[field] = pin{Value: v, Until: until}
+	}
+	if len(pins) == 0 {
+		return fmt.Errorf("nothing to pin")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for field, p := range pins {
+		c.pins[field] = p
+	}
+	return nil
+}
+
+func pinFieldNames() []string {
+	names := make([]string, 0, len(pinFields))
+	for f := range pinFields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unpin removes the given pins, or all of them.
+func (c *controller) unpin(fields ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(fields) == 0 {
+		c.pins = map[string]pin{}
+	}
+	for _, f := range fields {
+		delete(c.pins, f)
+	}
+}
+
+func (c *controller) setPaused(paused bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if paused {
+		c.sim.pause(now)
+	} else {
+		c.sim.resume(now)
+	}
+	c.paused = paused
+}
+
+// reset restarts the simulator and drops all pins.
+func (c *controller) reset(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sim.reset(now)
+	c.pins = map[string]pin{}
+	c.paused = false
+}
+
+func (c *controller) state() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pins := make(map[string]pin, len(c.pins))
+	for f, p := range c.pins {
+		pins[f] = p
+	}
+	st := map[string]any{"paused": c.paused, "pins": pins}
+	if c.faults != nil {
+		st["faults"] = c.faults.state()
+	}
+	if c.thermal != nil {
+		st["thermal"] = c.thermal.state(c.now())
+	}
+	return st
+}
+
+// handler serves the admin API, all with "Authorization: Bearer <token>":
+//
+//	GET    /admin          pins and pause state
+//	POST   /admin/pin      {"battery_percent": 10, "is_charging": false, "for": "5m"}
+//	DELETE /admin/pin      ?field=battery_percent (repeatable; none: all pins)
+//	POST   /admin/pause    freeze the model
+//	POST   /admin/resume
+//	POST   /admin/reset    restart the model at its initial state, drop pins
+//	POST   /admin/faults   {"probabilities": "5xx=0.1", "schedule": "reset@10m/1m", "latency": "2s", "stale_by": "10m"}
+//	DELETE /admin/faults   stop injecting faults
+//	POST   /admin/undervoltage  {"for": "5m"} (default: until DELETE), --thermal only
+//	DELETE /admin/undervoltage
+//	POST   /admin/ambient  {"ambient_c": 35}, --thermal only
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	// every successful call answers with the resulting state
+	handle := func(pattern string, fn func(r *http.Request) error) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if err := fn(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(c.state())
+		})
+	}
+	handle("GET /admin", func(r *http.Request) error { return nil })
+	handle("POST /admin/pin", func(r *http.Request) error {
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return fmt.Errorf("bad pin: %w", err)
+		}
+		if err := c.pin(body, c.now()); err != nil {
+			return fmt.Errorf("bad pin: %w", err)
+		}
+		return nil
+	})
+	handle("DELETE /admin/pin", func(r *http.Request) error {
+		c.unpin(r.URL.Query()["field"]...)
+		return nil
+	})
+	handle("POST /admin/pause", func(r *http.Request) error { c.setPaused(true, c.now()); return nil })
+	handle("POST /admin/resume", func(r *http.Request) error { c.setPaused(false, c.now()); return nil })
+	handle("POST /admin/reset", func(r *http.Request) error { c.reset(c.now()); return nil })
+	handle("POST /admin/faults", func(r *http.Request) error {
+		var body struct {
+			Probabilities, Schedule, Latency string
+			StaleBy                          string `json:"stale_by"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return fmt.Errorf("bad faults: %w", err)
+		}
+		cfg, err := parseFaultConfig(body.Probabilities, body.Schedule, body.Latency, body.StaleBy)
+		if err != nil {
+			return fmt.Errorf("bad faults: %w", err)
+		}
+		if c.faults == nil {
+			return fmt.Errorf("fault injection not available")
+		}
+		c.faults.configure(cfg, c.now())
+		return nil
+	})
+	handle("POST /admin/undervoltage", func(r *http.Request) error {
+		var body struct{ For string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("bad undervoltage: %w", err)
+		}
+		if c.thermal == nil {
+			return fmt.Errorf("thermal model not enabled (--thermal)")
+		}
+		until := c.now().AddDate(100, 0, 0)
+		if body.For != "" {
+			d, err := time.ParseDuration(body.For)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("for: want a positive duration like \"5m\"")
+			}
+			until = c.now().Add(d)
+		}
+		c.thermal.injectUndervoltage(until)
+		return nil
+	})
+	handle("DELETE /admin/undervoltage", func(r *http.Request) error {
+		if c.thermal != nil {
+			c.thermal.injectUndervoltage(time.Time{})
+		}
+		return nil
+	})
+	handle("POST /admin/ambient", func(r *http.Request) error {
+		var body struct {
+			AmbientC *float64 `json:"ambient_c"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.AmbientC == nil {
+			return fmt.Errorf("bad ambient: want {\"ambient_c\": 35}")
+		}
+		if c.thermal == nil {
+			return fmt.Errorf("thermal model not enabled (--thermal)")
+		}
+		c.thermal.setAmbient(c.now(), *body.AmbientC)
+		return nil
+	})
+	handle("DELETE /admin/faults", func(r *http.Request) error {
+		if c.faults != nil {
+			cfg, _ := parseFaultConfig("", "", "", "")
+			c.faults.configure(cfg, c.now())
+		}
+		return nil
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.token == "" {
+			http.Error(w, "admin API disabled (set --admin-token)", http.StatusNotFound)
+			return
+		}
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(c.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlAPI(t *testing.T) {
+	start := time.Date(2025, 6, 1, 20, 0, 0, 0, time.Local)
+	now := start
+	bat := newBattery(testParams(), start, 1)
+	ctl := newController(bat, "s3cret")
+	ctl.now = func() time.Time { return now }
+	h := ctl.handler()
+
+	call := func(method, path, body, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call("GET", "/admin", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: %d", w.Code)
+	}
+	if w := call("GET", "/admin", "", "guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+
+	// drop to 10% for 5 minutes, pin charging until unpinned
+	w := call("POST", "/admin/pin", `{"battery_percent": 10, "for": "5m"}`, "s3cret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"battery_percent":{"value":10`) {
+		t.Fatalf("pin: %d %s", w.Code, w.Body)
+	}
+	call("POST", "/admin/pin", `{"is_charging": true}`, "s3cret")
+	st := ctl.status(now.Add(time.Minute))
+	if st.BatteryPercent != 10 || !st.IsCharging || strings.Join(st.Pinned, ",") != "battery_percent,is_charging" {
+		t.Fatalf("pinned: %+v", st)
+	}
+	st = ctl.status(now.Add(6 * time.Minute))
+	if st.BatteryPercent != 49 || !st.IsCharging || len(st.Pinned) != 1 {
+		t.Fatalf("after the timed override: %+v", st)
+	}
+	call("DELETE", "/admin/pin?field=is_charging", "", "s3cret")
+	if st := ctl.status(now.Add(6 * time.Minute)); st.IsCharging || st.Pinned != nil {
+		t.Fatalf("unpinned: %+v", st)
+	}
+
+	for _, bad := range []string{`{"battery_percent": 120}`, `{"node_name": "x"}`, `{"time_of_day": "noon"}`, `{"for": "5m"}`, `{"is_charging": true, "for": "soon"}`} {
+		if w := call("POST", "/admin/pin", bad, "s3cret"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", bad, w.Code)
+		}
+	}
+
+	// pause: charge and simulated time stand still
+	now = start.Add(time.Hour)
+	call("POST", "/admin/pause", "", "s3cret")
+	before := ctl.status(now)
+	now = now.Add(time.Hour)
+	if st := ctl.status(now); st.EnergyWh != before.EnergyWh || st.SimTime != before.SimTime {
+		t.Fatalf("paused: %+v -> %+v", before, st)
+	}
+	if w := call("POST", "/admin/resume", "", "s3cret"); !strings.Contains(w.Body.String(), `"paused":false`) {
+		t.Fatalf("resume: %s", w.Body)
+	}
+	if st := ctl.status(now.Add(time.Hour)); st.EnergyWh != before.EnergyWh-5 {
+		t.Fatalf("resumed: %g Wh, want %g", st.EnergyWh, before.EnergyWh-5)
+	}
+
+	// reset: initial charge, no pins
+	call("POST", "/admin/pin", `{"solar_available": true}`, "s3cret")
+	call("POST", "/admin/reset", "", "s3cret")
+	if st := ctl.status(now); st.BatteryPercent != 50 || st.Pinned != nil {
+		t.Fatalf("reset: %+v", st)
+	}
+
+	if w := call("PUT", "/admin/reset", "", "s3cret"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("PUT reset: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	newController(bat, "").handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("admin without a token configured: %d", w.Code)
+	}
+}
+
+func TestReplayPause(t *testing.T) {
+	tr, err := readTrace(strings.NewReader(testTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(0, 0)
+	r := newReplay(tr, start, 60, 0, true)
+	r.pause(start.Add(time.Minute)) // an hour in
+	if st := r.status(start.Add(time.Hour)); st.BatteryPercent != 40 {
+		t.Fatalf("paused: %+v", st)
+	}
+	r.resume(start.Add(time.Hour))
+	if st := r.status(start.Add(time.Hour + 30*time.Second)); st.BatteryPercent != 50 {
+		t.Fatalf("resumed: %+v", st)
+	}
+	r.reset(start.Add(2 * time.Hour))
+	if st := r.status(start.Add(2 * time.Hour)); st.BatteryPercent != 50 || st.SimTime != "2025-06-21T00:00:00Z" {
+		t.Fatalf("reset: %+v", st)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults a simulator response can suffer, to test how consumers degrade.
+const (
+	faultLatency   = "latency"   // delay the response by faultConfig.Latency
+	fault5xx       = "5xx"       // answer 500, 502 or 503
+	faultReset     = "reset"     // reset the connection without a response
+	faultMalformed = "malformed" // truncate the JSON body
+	faultStale     = "stale"     // move the timestamp StaleBy into the past
+	faultMissing   = "missing"   // drop one to three fields
+)
+
+var faultKinds = []string{faultLatency, fault5xx, faultReset, faultMalformed, faultStale, faultMissing}
+
+// faultWindow forces a fault for the first For of every Every since start,
+// e.g. "5xx@10m/1m".
+type faultWindow struct {
+	Fault      string
+	Every, For time.Duration
+}
+
+type faultConfig struct {
+	Probabilities map[string]float64
+	Schedule      []faultWindow
+	Latency       time.Duration // default 2s, beyond the consumers' 800ms timeout
+	StaleBy       time.Duration // default 10m
+}
+
+// parseFaultConfig parses the flag (and /admin/faults) syntax:
+// probabilities "latency=0.1,5xx=0.05", schedule "reset@1h/2m,stale@10m/1m"
+// and the latency and stale_by durations ("" for the defaults).
+func parseFaultConfig(probs, schedule, latency, staleBy string) (faultConfig, error) {
+	cfg := faultConfig{Probabilities: map[string]float64{}, Latency: 2 * time.Second, StaleBy: 10 * time.Minute}
+	for _, kv := range splitList(probs) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return cfg, fmt.Errorf("fault %q: want kind=probability", kv)
+		}
+		if !isFaultKind(k) {
+			return cfg, fmt.Errorf("fault %q: want one of %s", k, strings.Join(faultKinds, ", "))
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 1 {
+			return cfg, fmt.Errorf("fault %s: probability %q: want 0..1", k, v)
+		}
+		cfg.Probabilities[k] = p
+	}
+	for _, w := range splitList(schedule) {
+		k, period, ok := strings.Cut(w, "@")
+		every, dur, ok2 := strings.Cut(period, "/")
+		if !ok || !ok2 || !isFaultKind(k) {
+			return cfg, fmt.Errorf("fault window %q: want kind@every/for, e.g. 5xx@10m/1m", w)
+		}
+		fw := faultWindow{Fault: k}
+		var err error
+		if fw.Every, err = time.ParseDuration(every); err != nil || fw.Every <= 0 {
+			return cfg, fmt.Errorf("fault window %q: every %q", w, every)
+		}
+		if fw.For, err = time.ParseDuration(dur); err != nil || fw.For <= 0 || fw.For > fw.Every {
+			return cfg, fmt.Errorf("fault window %q: for %q: want 0 < for <= every", w, dur)
+		}
+		cfg.Schedule = append(cfg.Schedule, fw)
+	}
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{latency, &cfg.Latency}, {staleBy, &cfg.StaleBy}} {
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil || v < 0 {
+			return cfg, fmt.Errorf("fault duration %q", d.s)
+		}
+		*d.dst = v
+	}
+	return cfg, nil
+}
+
+func isFaultKind(k string) bool {
+	for _, f := range faultKinds {
+		if f == k {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// faultInjector decides per response which faults to inject.
+type faultInjector struct {
+	mu     sync.Mutex
+	cfg    faultConfig
+	rnd    *rand.Rand
+	start  time.Time
+	counts map[string]int
+}
+
+func newFaultInjector(cfg faultConfig, start time.Time, rnd *rand.Rand) *faultInjector {
+	return &faultInjector{cfg: cfg, rnd: rnd, start: start, counts: map[string]int{}}
+}
+
+func (f *faultInjector) configure(cfg faultConfig, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cfg, f.start = cfg, now // schedules restart with the new config
+}
+
+func (f *faultInjector) state() map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[string]int, len(f.counts))
+	for k, v := range f.counts {
+		counts[k] = v
+	}
+	schedule := make([]string, len(f.cfg.Schedule))
+	for i, w := range f.cfg.Schedule {
+		schedule[i] = fmt.Sprintf("%s@%s/%s", w.Fault, w.Every, w.For)
+	}
+	return map[string]any{
+		"probabilities": f.cfg.Probabilities,
+		"schedule":      schedule,
+		"latency":       f.cfg.Latency.String(),
+		"stale_by":      f.cfg.StaleBy.String(),
+		"injected":      counts,
+	}
+}
+
+// pick returns the faults for one response at now.
+func (f *faultInjector) pick(now time.Time) map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	faults := map[string]bool{}
+	for _, w := range f.cfg.Schedule {
+		if now.Sub(f.start)%w.Every < w.For {
+			faults[w.Fault] = true
+		}
+	}
+	for _, k := range faultKinds { // fixed order keeps seeded runs reproducible
+		if p := f.cfg.Probabilities[k]; p > 0 && f.rnd.Float64() < p {
+			faults[k] = true
+		}
+	}
+	for k := range faults {
+		f.counts[k]++
+	}
+	return faults
+}
+
+// serveJSON writes v as JSON, with faults injected. tsField names the
+// timestamp that stale moves back.
+func (f *faultInjector) serveJSON(w http.ResponseWriter, r *http.Request, v any, tsField string, now time.Time) {
+	faults := f.pick(now)
+	if len(faults) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	f.mu.Lock()
+	cfg := f.cfg
+	f.mu.Unlock()
+
+	if faults[faultReset] {
+		resetConn(w)
+		return
+	}
+	if faults[faultLatency] {
+		select {
+		case <-time.After(cfg.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	names := make([]string, 0, len(faults))
+	for k := range faults {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	w.Header().Set("X-Injected-Fault", strings.Join(names, ","))
+	if faults[fault5xx] {
+		f.mu.Lock()
+		code := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}[f.rnd.Intn(3)]
+		f.mu.Unlock()
+		http.Error(w, "injected fault", code)
+		return
+	}
+
+	b, _ := json.Marshal(v)
+	var m map[string]any
+	if (faults[faultStale] || faults[faultMissing]) && json.Unmarshal(b, &m) == nil {
+		if faults[faultStale] {
+			if ts, err := time.Parse(time.RFC3339, fmt.Sprint(m[tsField])); err == nil {
+				m[tsField] = ts.Add(-cfg.StaleBy).Format(time.RFC3339)
+			}
+		}
+		if faults[faultMissing] {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			f.mu.Lock()
+			f.rnd.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			n := 1 + f.rnd.Intn(3)
+			f.mu.Unlock()
+			for _, k := range keys[:min(n, len(keys))] {
+				delete(m, k)
+			}
+		}
+		b, _ = json.Marshal(m)
+	}
+	if faults[faultMalformed] {
+		b = b[:len(b)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// resetConn drops the connection without a response, with a TCP RST where
+// the connection allows it.
+func resetConn(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
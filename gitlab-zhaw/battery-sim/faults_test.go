@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerkit/powerclient"
+)
+
+func TestParseFaultConfig(t *testing.T) {
+	cfg, err := parseFaultConfig("latency=0.1, 5xx=0.05", "reset@10m/1m", "3s", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Probabilities[faultLatency] != 0.1 || cfg.Probabilities[fault5xx] != 0.05 ||
+		len(cfg.Schedule) != 1 || cfg.Schedule[0].Every != 10*time.Minute || cfg.Latency != 3*time.Second || cfg.StaleBy != 10*time.Minute {
+		t.Fatalf("%+v", cfg)
+	}
+	for _, bad := range [][4]string{
+		{"fire=0.1", "", "", ""},
+		{"5xx=2", "", "", ""},
+		{"5xx", "", "", ""},
+		{"", "reset@1m", "", ""},
+		{"", "reset@1m/2m", "", ""},
+		{"", "", "soon", ""},
+	} {
+		if _, err := parseFaultConfig(bad[0], bad[1], bad[2], bad[3]); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+// faultServer serves a fixed status through an injector with cfg.
+func faultServer(t *testing.T, cfg faultConfig) (*httptest.Server, *faultInjector) {
+	t.Helper()
+	f := newFaultInjector(cfg, time.Now(), rand.New(rand.NewSource(1)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		f.serveJSON(w, r, PowerStatus{BatteryPercent: 42, TimeOfDay: "day", LastUpdated: now.Format(time.RFC3339)}, "last_updated", now)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, f
+}
+
+func always(kind string) faultConfig {
+	cfg, _ := parseFaultConfig(kind+"=1", "", "300ms", "")
+	return cfg
+}
+
+func TestFaultsAgainstPowerClient(t *testing.T) {
+	// faults the client must report as fetch errors
+	for _, kind := range []string{fault5xx, faultReset, faultMalformed, faultLatency} {
+		t.Run(kind, func(t *testing.T) {
+			srv, f := faultServer(t, always(kind))
+			c := powerclient.New[PowerStatus](srv.URL, 100*time.Millisecond, time.Minute)
+			if err := c.Refresh(context.Background()); err == nil {
+				t.Fatalf("%s: no fetch error", kind)
+			}
+			if snap := c.Get(); snap.HasValue() || snap.Err == nil {
+				t.Fatalf("%s: %+v", kind, snap)
+			}
+			if f.state()["injected"].(map[string]int)[kind] != 1 {
+				t.Fatalf("%s: %v", kind, f.state())
+			}
+		})
+	}
+}
+
+func TestFaultsInBody(t *testing.T) {
+	srv, _ := faultServer(t, always(faultStale))
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st PowerStatus
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	ts, _ := time.Parse(time.RFC3339, st.LastUpdated)
+	if age := time.Since(ts); age < 9*time.Minute || st.BatteryPercent != 42 || resp.Header.Get("X-Injected-Fault") != "stale" {
+		t.Fatalf("stale: %+v, age %s", st, age)
+	}
+
+	srv, _ = faultServer(t, always(faultMissing))
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]any
+		json.NewDecoder(resp.Body).Decode(&m)
+		resp.Body.Close()
+		full := 15 // PowerStatus fields without omitempty
+		if n := len(m); n < full-3 || n >= full {
+			t.Fatalf("missing: %d fields left", n)
+		}
+	}
+}
+
+func TestFaultSchedule(t *testing.T) {
+	start := time.Unix(0, 0)
+	cfg, _ := parseFaultConfig("", "5xx@10m/1m", "", "")
+	f := newFaultInjector(cfg, start, rand.New(rand.NewSource(1)))
+	for _, tt := range []struct {
+		at   time.Duration
+		want bool
+	}{{0, true}, {59 * time.Second, true}, {time.Minute, false}, {9 * time.Minute, false}, {10*time.Minute + time.Second, true}} {
+		if got := f.pick(start.Add(tt.at))[fault5xx]; got != tt.want {
+			t.Errorf("at %s: 5xx %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// probabilities roughly hold
+	cfg, _ = parseFaultConfig("stale=0.25", "", "", "")
+	f.configure(cfg, start)
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if f.pick(start.Add(time.Minute))[faultStale] {
+			n++
+		}
+	}
+	if n < 200 || n > 300 {
+		t.Fatalf("stale in %d of 1000 at p=0.25", n)
+	}
+}
+
+func TestAdminFaults(t *testing.T) {
+	bat := newBattery(testParams(), time.Now(), 1)
+	ctl := newController(bat, "tok")
+	ctl.faults = newFaultInjector(faultConfig{}, time.Now(), rand.New(rand.NewSource(1)))
+	h := ctl.handler()
+	var mu sync.Mutex
+	call := func(method, body string) *httptest.ResponseRecorder {
+		mu.Lock()
+		defer mu.Unlock()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/admin/faults", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer tok")
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := call("POST", `{"probabilities": "5xx=0.5", "schedule": "reset@1h/1m", "stale_by": "3m"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"schedule":["reset@1h0m0s/1m0s"]`) ||
+		!strings.Contains(w.Body.String(), `"stale_by":"3m0s"`) {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if w := call("POST", `{"probabilities": "5xx=5"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad POST: %d", w.Code)
+	}
+	if w := call("DELETE", ""); !strings.Contains(w.Body.String(), `"probabilities":{}`) {
+		t.Fatalf("DELETE: %s", w.Body)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// energyModel maps CPU utilization (0..1) to node power, linearly between
+// idle and full load.
+type energyModel struct {
+	IdleW float64
+	MaxW  float64
+}
+
+func (m energyModel) watts(util float64) float64 {
+	return m.IdleW + (m.MaxW-m.IdleW)*clamp(util, 0, 1)
+}
+
+// loadReport is one workload's contribution, as POSTed to /load.
+type loadReport struct {
+	Source  string    `json:"source"`
+	Watts   float64   `json:"watts,omitempty"` // extra power on top of the energy model
+	CPU     float64   `json:"cpu,omitempty"`   // CPU utilization 0..1 of the whole node
+	TTL     float64   `json:"ttl_s,omitempty"` // seconds until the report expires (default 60)
+	Expires time.Time `json:"expires"`
+}
+
+// loadTracker combines reported and measured load. Reports expire so that
+// a pod that went away stops draining the battery. Measured utilization
+// (from /proc/stat) already covers everything on the host, so do not also
+// report the pods of the same node.
+type loadTracker struct {
+	mu       sync.Mutex
+	reports  map[string]loadReport
+	measured float64 // from /proc/stat, 0 if not sampled
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{reports: map[string]loadReport{}}
+}
+
+// current returns the total CPU utilization and extra watts at now.
+func (t *loadTracker) current(now time.Time) (util, watts float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	util = t.measured
+	for src, r := range t.reports {
+		if now.After(r.Expires) {
+			delete(t.reports, src)
+			continue
+		}
+		util += r.CPU
+		watts += r.Watts
+	}
+	return clamp(util, 0, 1), watts
+}
+
+func (t *loadTracker) report(r loadReport, now time.Time) error {
+	if r.Source == "" {
+		r.Source = "default"
+	}
+	if r.CPU < 0 || r.CPU > 1 || r.Watts < 0 || r.TTL < 0 {
+		return errors.New("want cpu in 0..1, non-negative watts and ttl_s")
+	}
+	if r.TTL == 0 {
+		r.TTL = 60
+	}
+	r.Expires = now.Add(time.Duration(r.TTL * float64(time.Second)))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reports[r.Source] = r
+	return nil
+}
+
+func (t *loadTracker) remove(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reports, source)
+}
+
+func (t *loadTracker) list() []loadReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]loadReport, 0, len(t.reports))
+	for _, r := range t.reports {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
+
+func (t *loadTracker) setMeasured(util float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.measured = util
+}
+
+// loadHandler serves /load:
+//
+//	POST   {"source": "pod-a", "cpu": 0.25, "watts": 0.5, "ttl_s": 30}
+//	DELETE ?source=pod-a
+//	GET    current reports and the resulting load
+//
+// apply passes the total to the models and returns the node's draw.
+func loadHandler(t *loadTracker, apply func(now time.Time, util, extraW float64) float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		switch r.Method {
+		case http.MethodPost:
+			var rep loadReport
+			if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+				http.Error(w, "bad load report: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := t.report(rep, now); err != nil {
+				http.Error(w, "bad load report: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			t.remove(r.URL.Query().Get("source"))
+		case http.MethodGet:
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		util, watts := t.current(now)
+		loadW := apply(now, util, watts)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"cpu":     round2(util),
+			"extra_w": round2(watts),
+			"load_w":  round2(loadW),
+			"reports": t.list(),
+		})
+	}
+}
+
+// cpuSampler computes CPU utilization from successive /proc/stat reads.
+type cpuSampler struct {
+	path            string
+	lastBusy, lastT uint64
+}
+
+// sample returns the utilization since the previous call; the first call
+// only primes the counters.
+func (s *cpuSampler) sample() (float64, bool, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return 0, false, fmt.Errorf("%s: empty", s.path)
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, false, fmt.Errorf("%s: no aggregate cpu line", s.path)
+	}
+	var total, idle uint64
+	for i, v := range fields[1:] {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %w", s.path, err)
+		}
+		if i >= 8 { // guest and guest_nice are already counted in user and nice
+			break
+		}
+		total += n
+		if i == 3 || i == 4 { // idle, iowait
+			idle += n
+		}
+	}
+	busy := total - idle
+	primed := s.lastT != 0
+	dBusy, dT := busy-s.lastBusy, total-s.lastT
+	s.lastBusy, s.lastT = busy, total
+	if !primed || dT == 0 {
+		return 0, false, nil
+	}
+	return float64(dBusy) / float64(dT), true, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTracker(t *testing.T) {
+	lt := newLoadTracker()
+	now := time.Unix(1000, 0)
+	if err := lt.report(loadReport{Source: "a", CPU: 0.25, TTL: 10}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.report(loadReport{Source: "b", CPU: 0.5, Watts: 1}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.report(loadReport{CPU: 2}, now); err == nil {
+		t.Fatal("cpu 2 accepted")
+	}
+	lt.setMeasured(0.5)
+	if util, watts := lt.current(now); util != 1 || watts != 1 {
+		t.Fatalf("util %g watts %g, want capped 1 and 1", util, watts)
+	}
+	// a expires after 10s, b after the default 60s
+	lt.setMeasured(0)
+	if util, _ := lt.current(now.Add(30 * time.Second)); util != 0.5 {
+		t.Fatalf("after 30s util %g, want 0.5", util)
+	}
+	lt.remove("b")
+	if util, watts := lt.current(now); util != 0 || watts != 0 || len(lt.list()) != 0 {
+		t.Fatalf("after remove: %g %g %v", util, watts, lt.list())
+	}
+}
+
+func TestLoadDrainsFaster(t *testing.T) {
+	p := testParams()
+	p.MaxLoadW = 15
+	start := time.Date(2025, 6, 1, 20, 0, 0, 0, time.Local)
+	idle := newBattery(p, start, 1)
+	busy := newBattery(p, start, 1)
+
+	// full CPU for the first hour plus 5 W extra: 20 W instead of 5 W
+	if w := busy.setLoad(start, 1, 5); w != 20 {
+		t.Fatalf("load %g W, want 20", w)
+	}
+	busy.setLoad(start.Add(time.Hour), 0, 0)
+	a, b := idle.status(start.Add(2*time.Hour)), busy.status(start.Add(2*time.Hour))
+	// idle: 25 - 10 Wh; busy: 25 - 20 - 5 Wh
+	if a.BatteryPercent != 30 || b.BatteryPercent != 0 || b.LoadW != 5 {
+		t.Fatalf("idle %+v\nbusy %+v", a, b)
+	}
+}
+
+func TestLoadHandler(t *testing.T) {
+	p := testParams()
+	p.MaxLoadW = 9
+	bat := newBattery(p, time.Now(), 1)
+	h := loadHandler(newLoadTracker(), bat.setLoad)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/load", strings.NewReader(`{"source":"pod-a","cpu":0.5}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"load_w":7`) {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if st := bat.status(time.Now()); st.LoadW != 7 || st.CPU != 0.5 {
+		t.Fatalf("status after POST: %+v", st)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("DELETE", "/load?source=pod-a", nil))
+	if !strings.Contains(w.Body.String(), `"load_w":5`) {
+		t.Fatalf("DELETE: %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/load", strings.NewReader(`{"watts":-1}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("negative watts: %d", w.Code)
+	}
+}
+
+func TestCPUSampler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stat")
+	write := func(line string) {
+		if err := os.WriteFile(path, []byte(line+"\ncpu0 1 2 3 4\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &cpuSampler{path: path}
+	write("cpu  100 0 100 800 0 0 0 0 0 0")
+	if _, ok, err := s.sample(); ok || err != nil {
+		t.Fatalf("first sample: %v %v, want priming only", ok, err)
+	}
+	// +300 busy, +100 idle
+	write("cpu  300 0 200 850 50 0 0 0 0 0")
+	if util, ok, err := s.sample(); !ok || err != nil || util != 0.75 {
+		t.Fatalf("util %g %v %v, want 0.75", util, ok, err)
+	}
+	write("intr 1 2 3")
+	if _, _, err := s.sample(); err == nil {
+		t.Fatal("garbage accepted")
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"time"
+	_ "time/tzdata" // --timezone in minimal images
 )
 
 // PowerStatus represents the node's (simulated) power data
@@ -16,45 +22,231 @@ type PowerStatus struct {
 	TimeOfDay      string `json:"time_of_day"`
 	SolarAvailable bool   `json:"solar_available"`
 	LastUpdated    string `json:"last_updated"`
+
+	// model details
+	EnergyWh float64  `json:"energy_wh"`
+	SolarW   float64  `json:"solar_w"`
+	ChargerW float64  `json:"charger_w"`
+	LoadW    float64  `json:"load_w"`
+	CPU      float64  `json:"cpu_util"`         // reported or measured, see /load
+	NetW     float64  `json:"net_w"`            // > 0 charges the battery
+	SimTime  string   `json:"sim_time"`         // in --timezone
+	Pinned   []string `json:"pinned,omitempty"` // fields overridden via /admin/pin
+
+	// solar model
+	SunElevation float64 `json:"sun_elevation_deg,omitempty"` // --solar-model=sun only
+	Irradiance   float64 `json:"irradiance_w_m2"`
+	Clouds       float64 `json:"clouds"`
+	Sunrise      string  `json:"sunrise,omitempty"` // of the simulated day
+	Sunset       string  `json:"sunset,omitempty"`
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
+	listen := flag.String("listen", ":8080", "HTTP listen address")
+	var p params
+	flag.Float64Var(&p.CapacityWh, "capacity-wh", 50, "battery capacity in Wh")
+	flag.Float64Var(&p.InitialPercent, "initial-percent", 80, "state of charge at start")
+	flag.Float64Var(&p.BaseLoadW, "base-load-w", 5, "idle node load in W")
+	flag.Float64Var(&p.MaxLoadW, "max-load-w", 8, "node load at 100% CPU in W")
+	flag.Float64Var(&p.SolarPeakW, "solar-peak-w", 20, "panel rating in W at 1000 W/m² (--solar-model=hours: input at noon under a clear sky)")
+	flag.StringVar(&p.SolarModel, "solar-model", "sun", "sun: sun position at --latitude/--longitude; hours: half-sine between --sunrise and --sunset")
+	flag.Float64Var(&p.Latitude, "latitude", winterthurLat, "site latitude in degrees (default: Winterthur)")
+	flag.Float64Var(&p.Longitude, "longitude", winterthurLon, "site longitude in degrees, east positive")
+	flag.StringVar(&p.Timezone, "timezone", winterthurTZ, "IANA time zone of the site, \"\" for the container's local time")
+	flag.Float64Var(&p.Sunrise, "sunrise", 6, "sunrise, local hour (--solar-model=hours)")
+	flag.Float64Var(&p.Sunset, "sunset", 18, "sunset, local hour (--solar-model=hours)")
+	flag.Float64Var(&p.Clouds, "clouds", 0.3, "maximum cloud cover 0..1 (varies randomly)")
+	cloudPath := flag.String("cloud-schedule", "", "file of \"HH:MM,cover\" or \"RFC3339,cover\" lines replacing the random cloud cover")
+	flag.Float64Var(&p.ChargerW, "charger-w", 0, "charger power in W, 0 = no charger")
+	flag.Float64Var(&p.ChargerOnBelow, "charger-on-below", 20, "connect the charger below this percent")
+	flag.Float64Var(&p.ChargerOffAbove, "charger-off-above", 90, "disconnect the charger above this percent")
+	flag.Float64Var(&p.ChargeEfficiency, "charge-efficiency", 0.9, "share of net input power stored")
+	flag.Float64Var(&p.TimeScale, "time-scale", 1, "simulated (or trace) seconds per real second, e.g. 60 for an hour per minute")
+	procStat := flag.String("proc-stat", "", "sample CPU utilization from this file, e.g. /proc/stat (default: only POST /load)")
+	sampleEvery := flag.Duration("load-sample-interval", 5*time.Second, "how often to sample --proc-stat and expire load reports")
+	tracePath := flag.String("trace", "", "replay this CSV trace instead of the battery model, e.g. a ConfigMap mount")
+	traceLoop := flag.Bool("trace-loop", true, "start the trace over at its end instead of holding the last row")
+	traceOffset := flag.Duration("trace-offset", 0, "start this far into the trace")
+	nodeOffsets := flag.String("trace-node-offsets", "", "per-node start offsets, e.g. pi-1=0h,pi-2=6h,*=12h (added to --trace-offset)")
+	seed := flag.Int64("seed", 0, "random seed (default: a hash of NODE_NAME, so runs are reproducible per node)")
+	startTime := flag.String("start-time", "", "simulated start, RFC3339, also used by reset (default: now); with --seed the run is reproducible")
+	profilePath := flag.String("profiles", "", "JSON file with per-node parameter profiles, e.g. a ConfigMap mount")
+	labelSpec := flag.String("node-labels", os.Getenv("NODE_LABELS"), "node labels for profile matching, k=v,... (default: $NODE_LABELS, else the API server)")
+	adminToken := flag.String("admin-token", os.Getenv("BATTERY_SIM_ADMIN_TOKEN"), "bearer token for /admin (default: $BATTERY_SIM_ADMIN_TOKEN; empty disables it)")
+	faultProbs := flag.String("faults", "", "inject faults into /status, e.g. latency=0.1,5xx=0.05,reset=0.02,malformed=0.02,stale=0.05,missing=0.05")
+	faultSchedule := flag.String("fault-schedule", "", "force faults periodically, e.g. 5xx@10m/1m (the first minute of every 10)")
+	faultLatency := flag.String("fault-latency", "2s", "delay of the latency fault")
+	faultStaleBy := flag.String("fault-stale-by", "10m", "how far the stale fault moves last_updated back")
+	thermalOn := flag.Bool("thermal", false, "also serve power-agent compatible /power from a thermal model driven by the same load")
+	tp := defaultThermalParams()
+	flag.Float64Var(&tp.AmbientC, "ambient-c", tp.AmbientC, "ambient temperature in °C (--thermal)")
+	flag.Float64Var(&tp.TauS, "thermal-tau-s", tp.TauS, "thermal time constant in simulated seconds (--thermal)")
+	flag.Float64Var(&tp.CapC, "thermal-cap-c", tp.CapC, "the clock is capped and throttle bits set above this °C (--thermal)")
+	uvBelow := flag.Float64("undervoltage-below", 0, "report undervoltage on /power while the battery is below this percent, 0 = never (--thermal)")
+	flag.Parse()
+
+	node := getNodeName()
+	if *seed == 0 {
+		*seed = nodeSeed(node)
+	}
+	applied := []string{}
+	if *profilePath != "" {
+		prs, err := loadProfiles(*profilePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("no profiles: %v", err) // optional ConfigMap not created
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		labels, err := parseLabels(*labelSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *labelSpec == "" && len(prs) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if labels, err = nodeLabels(ctx, node); err != nil {
+				log.Printf("node labels: %v; matching profiles by node name only", err)
+			}
+			cancel()
+		}
+		if applied, err = applyProfiles(&p, prs, node, labels); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := p.validate(); err != nil {
+		log.Fatal(err)
+	}
+	effective := map[string]any{"node": node, "seed": *seed, "profiles": applied, "params": p, "mode": "model"}
+	var simStart time.Time
+	if *startTime != "" {
+		var err error
+		if simStart, err = time.Parse(time.RFC3339, *startTime); err != nil {
+			log.Fatalf("--start-time: %v", err)
+		}
+		effective["start_time"] = simStart.Format(time.RFC3339)
+	}
+
+	if *thermalOn {
+		tp.HardC = tp.CapC + 5 // clock down to the minimum 5°C above the cap
+		if err := tp.validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var (
+		sim simulator
+		bat *battery
+		th  *thermal
+	)
+	if *tracePath != "" {
+		tr, err := loadTrace(*tracePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		offset, err := nodeOffset(*nodeOffsets, node)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rp := newReplay(tr, time.Now(), p.TimeScale, *traceOffset+offset, *traceLoop)
+		sim = rp
+		effective["mode"] = "trace"
+		effective["trace"] = map[string]any{"path": *tracePath, "offset": rp.Offset.String(), "loop": *traceLoop}
+		log.Printf("Replaying %s (%d rows, %s) from %s, x%g time, loop=%v",
+			*tracePath, len(tr.points), tr.duration(), rp.Offset, p.TimeScale, *traceLoop)
+	} else {
+		bat = newBattery(p, time.Now(), *seed)
+		if !simStart.IsZero() {
+			bat.startAt(simStart)
+		}
+		if *cloudPath != "" {
+			s, err := loadCloudSchedule(*cloudPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			bat.useCloudSchedule(s)
+			effective["cloud_schedule"] = *cloudPath
+		}
+		sim = bat
+		log.Printf("Simulating %.0f Wh, %.1f W load, %.0f W solar, x%g time, seed %d, profiles %v",
+			p.CapacityWh, p.BaseLoadW, p.SolarPeakW, p.TimeScale, *seed, applied)
+	}
 
+	faultCfg, err := parseFaultConfig(*faultProbs, *faultSchedule, *faultLatency, *faultStaleBy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctl := newController(sim, *adminToken)
+	ctl.faults = newFaultInjector(faultCfg, time.Now(), rand.New(rand.NewSource(*seed+1)))
+
+	if *thermalOn {
+		th = newThermal(tp, p.TimeScale, time.Now())
+		ctl.thermal = th
+		effective["thermal"] = tp
+		http.HandleFunc("/power", func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			ctl.faults.serveJSON(w, r, th.power(now), "timestamp", now)
+		})
+		log.Printf("Thermal model: %.0f°C ambient, cap at %.0f°C, tau %.0fs", tp.AmbientC, tp.CapC, tp.TauS)
+	}
+	if bat != nil || th != nil {
+		// measured and reported load drives the battery drain and the heat
+		apply := func(now time.Time, util, extraW float64) float64 {
+			var loadW float64
+			if bat != nil {
+				loadW = bat.setLoad(now, util, extraW)
+			}
+			if th != nil {
+				th.setLoad(now, util)
+				if *uvBelow > 0 {
+					th.setBatteryLow(float64(ctl.status(now).BatteryPercent) < *uvBelow)
+				}
+			}
+			return loadW
+		}
+		loads := newLoadTracker()
+		go trackLoad(loads, apply, *procStat, *sampleEvery)
+		http.HandleFunc("/load", loadHandler(loads, apply))
+	}
+	if len(faultCfg.Probabilities)+len(faultCfg.Schedule) > 0 {
+		log.Printf("Injecting faults %v, schedule %v", faultCfg.Probabilities, faultCfg.Schedule)
+	}
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		status := generatePowerStatus()
+		now := time.Now()
+		ctl.faults.serveJSON(w, r, ctl.status(now), "last_updated", now)
+	})
+	admin := ctl.handler()
+	http.Handle("/admin", admin)
+	http.Handle("/admin/", admin)
+
+	http.HandleFunc("/params", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(status)
+		json.NewEncoder(w).Encode(effective)
 	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Power metrics API daemon — GET /status\n"))
+		w.Write([]byte("Power metrics API daemon — GET /status, GET /power (--thermal), GET /params, GET|POST|DELETE /load, /admin (token)\n"))
 	})
 
-	addr := ":8080"
-	println("Serving power metrics on", addr)
-	http.ListenAndServe(addr, nil)
+	log.Printf("Serving power metrics on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
 }
 
-func generatePowerStatus() PowerStatus {
-	battery := rand.Intn(60) + 40 // 40–100%
-	isCharging := rand.Intn(2) == 0
-	hour := time.Now().Hour()
-
-	timeOfDay := "day"
-	if hour >= 18 || hour < 6 {
-		timeOfDay = "night"
+// trackLoad feeds measured and reported load into the models.
+func trackLoad(loads *loadTracker, apply func(now time.Time, util, extraW float64) float64, procStat string, every time.Duration) {
+	var cpu *cpuSampler
+	if procStat != "" {
+		cpu = &cpuSampler{path: procStat}
 	}
-
-	solar := timeOfDay == "day" && !isCharging
-
-	return PowerStatus{
-		NodeName:       getNodeName(),
-		BatteryPercent: battery,
-		IsCharging:     isCharging,
-		TimeOfDay:      timeOfDay,
-		SolarAvailable: solar,
-		LastUpdated:    time.Now().Format(time.RFC3339),
+	for now := range time.Tick(every) {
+		if cpu != nil {
+			util, ok, err := cpu.sample()
+			if err != nil {
+				log.Printf("cpu sample: %v", err)
+			} else if ok {
+				loads.setMeasured(util)
+			}
+		}
+		util, watts := loads.current(now)
+		apply(now, util, watts)
 	}
 }
 
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// params describe the simulated node: a battery of CapacityWh feeding the
+// node (BaseLoadW idle up to MaxLoadW at full CPU, see energyModel), charged
+// by a solar panel and optionally by a charger. With SolarModel "sun" the
+// panel follows the sun's position at Latitude/Longitude; otherwise it
+// follows a half-sine between the Sunrise and Sunset hours.
+type params struct {
+	CapacityWh       float64 `json:"capacity_wh"`
+	InitialPercent   float64 `json:"initial_percent"`
+	BaseLoadW        float64 `json:"base_load_w"`  // idle node
+	MaxLoadW         float64 `json:"max_load_w"`   // node at 100% CPU
+	SolarPeakW       float64 `json:"solar_peak_w"` // "sun": rating at 1000 W/m², else noon input
+	SolarModel       string  `json:"solar_model"`  // "sun" or "hours"
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	Timezone         string  `json:"timezone"`     // IANA name, "" = local
+	Sunrise          float64 `json:"sunrise_hour"` // "hours" model: local hour, e.g. 6.5
+	Sunset           float64 `json:"sunset_hour"`
+	Clouds           float64 `json:"clouds"`            // 0 = clear sky, 1 = solar may drop to zero
+	ChargerW         float64 `json:"charger_w"`         // 0 = no charger
+	ChargerOnBelow   float64 `json:"charger_on_below"`  // percent; charger connects below this ...
+	ChargerOffAbove  float64 `json:"charger_off_above"` // ... and disconnects above this
+	ChargeEfficiency float64 `json:"charge_efficiency"`
+	TimeScale        float64 `json:"time_scale"` // simulated seconds per real second
+}
+
+// gridStep is the integration step in simulated time. The state advances
+// on a fixed grid of whole steps from the start, one cloud draw each, so a
+// seed gives the same run however often /status is polled.
+const gridStep = time.Minute
+
+// battery integrates the state of charge over simulated time. Net power
+// (solar + charger - load) flows into the battery, with ChargeEfficiency
+// applied when charging; the charge is clamped to [0, CapacityWh].
+type battery struct {
+	mu       sync.Mutex
+	p        params
+	seed     int64
+	rnd      *rand.Rand
+	loc      *time.Location
+	schedule *cloudSchedule // nil: random cloud cover
+	origin   time.Time      // fixed simulated start (see startAt), zero = wall clock
+
+	// simulated time follows the wall clock from this pair on
+	simAnchor, realAnchor time.Time
+
+	wh        float64   // stored energy as of gridAt
+	simNow    time.Time // simulated clock
+	gridAt    time.Time // last grid point, see gridStep
+	loadSince time.Time // simulated time loadW applies from
+	loadWh    float64   // drawn by earlier loads between gridAt and loadSince
+	clouds    float64   // current cloud cover 0..1, random walk
+	chargerOn bool
+	paused    bool    // see pause
+	util      float64 // CPU utilization, see setLoad
+	loadW     float64 // node power draw
+
+	// last step, for reporting
+	solarW, chargerW, netW float64
+	elevation, irradiance  float64
+}
+
+func newBattery(p params, start time.Time, seed int64) *battery {
+	b := &battery{p: p, seed: seed, loc: time.Local}
+	if p.Timezone != "" {
+		if loc, err := time.LoadLocation(p.Timezone); err == nil { // see params.validate
+			b.loc = loc
+		}
+	}
+	b.loadW = p.BaseLoadW
+	b.restart(start, start)
+	return b
+}
+
+// startAt moves the simulated start to t, e.g. to replay a given day.
+func (b *battery) startAt(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.origin = t
+	b.restart(t, b.realAnchor)
+}
+
+// restart begins the simulation at simulated time sim, wall time now, with
+// the initial charge and a fresh random source, as a new run with the same
+// seed would.
+func (b *battery) restart(sim, now time.Time) {
+	b.rnd = rand.New(rand.NewSource(b.seed))
+	b.simAnchor, b.realAnchor = sim, now
+	b.simNow, b.gridAt, b.loadSince, b.loadWh = sim, sim, sim, 0
+	b.wh = b.p.CapacityWh * clamp(b.p.InitialPercent, 0, 100) / 100
+	b.clouds, b.chargerOn, b.paused = 0, false, false
+	b.sample(false)
+}
+
+// advance brings the simulation up to wall time now.
+func (b *battery) advance(now time.Time) {
+	if b.paused || !now.After(b.realAnchor) {
+		return
+	}
+	target := b.simAnchor.Add(time.Duration(float64(now.Sub(b.realAnchor)) * b.p.TimeScale))
+	for next := b.gridAt.Add(gridStep); !next.After(target); next = b.gridAt.Add(gridStep) {
+		b.step(next)
+	}
+	if target.After(b.simNow) {
+		b.simNow = target
+	}
+}
+
+// step integrates up to the next grid point.
+func (b *battery) step(next time.Time) {
+	b.loadWh += b.loadW * next.Sub(b.loadSince).Hours()
+	b.simNow, b.gridAt, b.loadSince = next, next, next
+	b.sample(true)
+
+	net := (b.solarW+b.chargerW)*gridStep.Hours() - b.loadWh
+	if net > 0 {
+		b.wh += net * b.p.ChargeEfficiency
+	} else {
+		b.wh += net
+	}
+	b.wh = clamp(b.wh, 0, b.p.CapacityWh)
+	b.loadWh = 0
+}
+
+// sample sets charger, clouds and solar input for simNow; draw advances
+// the random cloud walk by one grid step.
+func (b *battery) sample(draw bool) {
+	pct := b.percent()
+	switch {
+	case b.p.ChargerW <= 0:
+		b.chargerOn = false
+	case pct < b.p.ChargerOnBelow:
+		b.chargerOn = true
+	case pct >= b.p.ChargerOffAbove:
+		b.chargerOn = false
+	}
+
+	local := b.simNow.In(b.loc)
+	if b.schedule != nil {
+		b.clouds = b.schedule.at(local)
+	} else if draw && b.p.Clouds > 0 {
+		// random walk with a pull back to the average cover
+		mins := gridStep.Minutes()
+		b.clouds += (b.p.Clouds/2-b.clouds)*0.02*mins + b.rnd.NormFloat64()*0.05*math.Sqrt(mins)
+		b.clouds = clamp(b.clouds, 0, b.p.Clouds)
+	}
+	if b.p.SolarModel == "sun" {
+		b.elevation = sunElevation(local, b.p.Latitude, b.p.Longitude)
+		b.irradiance = clearSkyIrradiance(b.elevation)
+	} else {
+		b.elevation = math.NaN()
+		b.irradiance = 1000 * sunFactor(local, b.p.Sunrise, b.p.Sunset)
+	}
+	b.solarW = b.p.SolarPeakW * b.irradiance / 1000 * (1 - b.clouds)
+	b.chargerW = 0
+	if b.chargerOn {
+		b.chargerW = b.p.ChargerW
+	}
+	b.netW = b.solarW + b.chargerW - b.loadW
+}
+
+// setLoad advances to now under the old load, then switches to CPU
+// utilization util plus extraW. It returns the new draw.
+func (b *battery) setLoad(now time.Time, util, extraW float64) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	b.util = util
+	w := energyModel{IdleW: b.p.BaseLoadW, MaxW: b.p.MaxLoadW}.watts(util) + extraW
+	if w != b.loadW { // an unchanged load keeps the step whole, see gridStep
+		b.loadWh += b.loadW * b.simNow.Sub(b.loadSince).Hours()
+		b.loadSince, b.loadW = b.simNow, w
+		b.netW = b.solarW + b.chargerW - b.loadW
+	}
+	return b.loadW
+}
+
+// useCloudSchedule replaces the random cloud cover with s.
+func (b *battery) useCloudSchedule(s *cloudSchedule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.schedule = s
+	b.sample(false)
+}
+
+// pause freezes the simulation: simulated time and charge stand still
+// until resume.
+func (b *battery) pause(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	b.paused = true
+}
+
+func (b *battery) resume(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused {
+		b.simAnchor, b.realAnchor = b.simNow, now
+	}
+	b.paused = false
+}
+
+// reset restarts the simulation with the initial charge, at the fixed
+// start if there is one and else at now; the load and cloud schedule stay.
+func (b *battery) reset(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sim := now
+	if !b.origin.IsZero() {
+		sim = b.origin
+	}
+	b.restart(sim, now)
+}
+
+func (b *battery) percent() float64 {
+	if b.p.CapacityWh <= 0 {
+		return 0
+	}
+	return 100 * b.wh / b.p.CapacityWh
+}
+
+// charging reports whether energy currently flows into the battery.
+func (b *battery) charging() bool { return b.netW > 0 && b.wh < b.p.CapacityWh }
+
+// sunFactor is a half-sine between sunrise and sunset (local hours).
+func sunFactor(t time.Time, sunrise, sunset float64) float64 {
+	h := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	if sunset <= sunrise || h <= sunrise || h >= sunset {
+		return 0
+	}
+	return math.Sin(math.Pi * (h - sunrise) / (sunset - sunrise))
+}
+
+// status advances to now and reports the node's power state.
+func (b *battery) status(now time.Time) PowerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+
+	local := b.simNow.In(b.loc)
+	timeOfDay := "night"
+	var rise, set time.Time
+	if b.p.SolarModel == "sun" {
+		if b.elevation > -0.833 { // upper limb above the horizon
+			timeOfDay = "day"
+		}
+		rise, set, _ = sunTimes(local, b.p.Latitude, b.p.Longitude)
+	} else {
+		if b.irradiance > 0 {
+			timeOfDay = "day"
+		}
+		y, m, d := local.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, b.loc)
+		rise = midnight.Add(time.Duration(b.p.Sunrise * float64(time.Hour)))
+		set = midnight.Add(time.Duration(b.p.Sunset * float64(time.Hour)))
+	}
+	st := PowerStatus{
+		NodeName:       getNodeName(),
+		BatteryPercent: int(math.Round(b.percent())),
+		IsCharging:     b.charging(),
+		TimeOfDay:      timeOfDay,
+		SolarAvailable: b.solarW > 0.05*b.p.SolarPeakW,
+		LastUpdated:    now.Format(time.RFC3339),
+
+		EnergyWh: round2(b.wh),
+		SolarW:   round2(b.solarW),
+		ChargerW: round2(b.chargerW),
+		LoadW:    round2(b.loadW),
+		CPU:      round2(b.util),
+		NetW:     round2(b.netW),
+		SimTime:  local.Format(time.RFC3339),
+
+		Irradiance: round2(b.irradiance),
+		Clouds:     round2(b.clouds),
+	}
+	if !math.IsNaN(b.elevation) {
+		st.SunElevation = round2(b.elevation)
+	}
+	if !rise.IsZero() {
+		st.Sunrise, st.Sunset = rise.Format(time.RFC3339), set.Format(time.RFC3339)
+	}
+	return st
+}
+
+func clamp(v, lo, hi float64) float64 { return min(max(v, lo), hi) }
+
+func round2(v float64) float64 { return math.Round(v*100) / 100 }
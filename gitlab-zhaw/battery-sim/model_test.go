@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testParams() params {
+	return params{
+		CapacityWh: 50, InitialPercent: 50, BaseLoadW: 5, SolarPeakW: 20,
+		Sunrise: 6, Sunset: 18, ChargerOnBelow: 20, ChargerOffAbove: 90,
+		ChargeEfficiency: 1, TimeScale: 1,
+	}
+}
+
+func TestBatteryDrainsAtNight(t *testing.T) {
+	start := time.Date(2025, 6, 1, 20, 0, 0, 0, time.Local)
+	b := newBattery(testParams(), start, 1)
+
+	// 25 Wh at 5 W lasts 5 hours
+	st := b.status(start.Add(2 * time.Hour))
+	if st.BatteryPercent != 30 || st.IsCharging || st.SolarAvailable || st.TimeOfDay != "night" {
+		t.Fatalf("after 2h at night: %+v", st)
+	}
+	st = b.status(start.Add(6 * time.Hour))
+	if st.BatteryPercent != 0 || st.NetW != -5 {
+		t.Fatalf("after 6h at night: %+v", st)
+	}
+}
+
+func TestBatteryChargesBySolar(t *testing.T) {
+	start := time.Date(2025, 6, 1, 11, 0, 0, 0, time.Local)
+	b := newBattery(testParams(), start, 1)
+
+	prev := 50
+	for i := 1; i <= 60; i++ {
+		st := b.status(start.Add(time.Duration(i) * time.Minute))
+		if !st.IsCharging || !st.SolarAvailable || st.TimeOfDay != "day" {
+			t.Fatalf("minute %d around noon: %+v", i, st)
+		}
+		if d := st.BatteryPercent - prev; d < 0 || d > 1 {
+			t.Fatalf("minute %d: %d%% -> %d%%, want a smooth rise", i, prev, st.BatteryPercent)
+		}
+		prev = st.BatteryPercent
+	}
+	// ~19.5 W in - 5 W load for an hour: +29%
+	if prev < 75 || prev > 81 {
+		t.Fatalf("after an hour of noon sun: %d%%", prev)
+	}
+
+	// full: net power stays positive but the battery no longer charges
+	st := b.status(start.Add(3 * time.Hour))
+	if st.BatteryPercent != 100 || st.IsCharging || st.NetW <= 0 {
+		t.Fatalf("full battery: %+v", st)
+	}
+}
+
+func TestChargerHysteresis(t *testing.T) {
+	p := testParams()
+	p.InitialPercent, p.ChargerW, p.SolarPeakW = 22, 15, 0
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	b := newBattery(p, start, 1)
+
+	var on, off int
+	for m := 1; m <= 24*60; m++ {
+		st := b.status(start.Add(time.Duration(m) * time.Minute))
+		if st.ChargerW > 0 {
+			on++
+		} else {
+			off++
+		}
+		if st.BatteryPercent < 19 || st.BatteryPercent > 91 {
+			t.Fatalf("minute %d: %d%% outside the charger band", m, st.BatteryPercent)
+		}
+	}
+	if on == 0 || off == 0 {
+		t.Fatalf("charger on %d / off %d minutes, want both", on, off)
+	}
+}
+
+func TestTimeScaleAndClouds(t *testing.T) {
+	p := testParams()
+	p.TimeScale, p.Clouds = 60, 1
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	b := newBattery(p, start, 7)
+	st := b.status(start.Add(time.Minute)) // one simulated hour
+	if st.SimTime != start.Add(time.Hour).Format(time.RFC3339) {
+		t.Fatalf("sim time %s", st.SimTime)
+	}
+	if st.SolarW < 0 || st.SolarW > p.SolarPeakW || math.IsNaN(st.SolarW) {
+		t.Fatalf("solar %g W with clouds", st.SolarW)
+	}
+}
+
+func TestRunIndependentOfPolling(t *testing.T) {
+	p := testParams()
+	p.TimeScale, p.Clouds = 60, 1
+	start := time.Date(2025, 6, 1, 4, 0, 0, 0, time.Local)
+	end := start.Add(8 * time.Minute) // 8 simulated hours, through the morning
+	run := func(every time.Duration) (PowerStatus, float64, float64) {
+		b := newBattery(p, start, 42)
+		for at := start.Add(every); at.Before(end); at = at.Add(every) {
+			b.status(at)
+			b.setLoad(at, 0, 0)
+		}
+		return b.status(end), b.wh, b.clouds
+	}
+	want, wh, clouds := run(time.Hour)
+
+	// a reset run repeats a fresh one
+	b := newBattery(p, start, 42)
+	b.startAt(start)
+	b.status(end)
+	b.reset(end)
+	got := b.status(end.Add(end.Sub(start)))
+	got.LastUpdated = want.LastUpdated
+	if !reflect.DeepEqual(got, want) || b.wh != wh || b.clouds != clouds {
+		t.Fatalf("after reset: %v Wh, clouds %v, %+v\nwant %v Wh, clouds %v, %+v", b.wh, b.clouds, got, wh, clouds, want)
+	}
+
+	for _, every := range []time.Duration{7 * time.Second, 13*time.Second + 7*time.Millisecond, time.Minute} {
+		if got, gotWh, gotClouds := run(every); !reflect.DeepEqual(got, want) || gotWh != wh || gotClouds != clouds {
+			t.Fatalf("polled every %s: %v Wh, clouds %v, %+v\nwant %v Wh, clouds %v, %+v", every, gotWh, gotClouds, got, wh, clouds, want)
+		}
+	}
+}
+
+func TestStartAt(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := time.Date(2025, 6, 21, 12, 0, 0, 0, time.Local)
+	b := newBattery(testParams(), now, 1)
+	b.startAt(day)
+	if st := b.status(now.Add(time.Hour)); st.SimTime != day.Add(time.Hour).Format(time.RFC3339) || st.TimeOfDay != "day" {
+		t.Fatalf("from %s: %+v", day, st)
+	}
+	b.reset(now.Add(2 * time.Hour))
+	if st := b.status(now.Add(2 * time.Hour)); st.SimTime != day.Format(time.RFC3339) || st.BatteryPercent != 50 {
+		t.Fatalf("after reset: %+v", st)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+)
+
+// profile overrides some params on matching nodes, e.g.
+//
+//	{"name": "big-panel", "labels": {"power/panel": "large"}, "params": {"solar_peak_w": 40}}
+//	{"name": "pi-3", "node": "pi-3", "params": {"capacity_wh": 30, "base_load_w": 3.5}}
+//
+// A profile without node and labels matches every node.
+type profile struct {
+	Name   string            `json:"name"`
+	Node   string            `json:"node,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Params json.RawMessage   `json:"params"`
+}
+
+func (pr profile) matches(node string, labels map[string]string) bool {
+	if pr.Node != "" && pr.Node != node {
+		return false
+	}
+	for k, v := range pr.Labels {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProfiles reads a JSON array of profiles, e.g. from a ConfigMap.
+func loadProfiles(path string) ([]profile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prs []profile
+	if err := json.Unmarshal(b, &prs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, pr := range prs {
+		if pr.Name == "" {
+			prs[i].Name = fmt.Sprintf("#%d", i)
+		}
+		// catch typos in parameter names up front
+		dec := json.NewDecoder(bytes.NewReader(pr.Params))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&params{}); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %w", path, prs[i].Name, err)
+		}
+	}
+	return prs, nil
+}
+
+// applyProfiles applies every matching profile to p in file order, so later
+// profiles override earlier ones. It returns the names of those applied.
+func applyProfiles(p *params, prs []profile, node string, labels map[string]string) ([]string, error) {
+	applied := []string{}
+	for _, pr := range prs {
+		if !pr.matches(node, labels) {
+			continue
+		}
+		if err := json.Unmarshal(pr.Params, p); err != nil {
+			return applied, fmt.Errorf("profile %s: %w", pr.Name, err)
+		}
+		applied = append(applied, pr.Name)
+	}
+	return applied, nil
+}
+
+// validate rejects parameters the model cannot run with.
+func (p params) validate() error {
+	if p.CapacityWh <= 0 || p.TimeScale <= 0 || p.ChargeEfficiency <= 0 || p.ChargeEfficiency > 1 {
+		return errors.New("capacity-wh and time-scale must be positive, charge-efficiency in (0,1]")
+	}
+	if p.MaxLoadW < p.BaseLoadW {
+		return errors.New("max-load-w must be at least base-load-w")
+	}
+	switch p.SolarModel {
+	case "sun":
+		if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+			return errors.New("latitude must be in -90..90, longitude in -180..180")
+		}
+	case "hours":
+	default:
+		return fmt.Errorf("solar-model %q: want sun or hours", p.SolarModel)
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	return nil
+}
+
+// nodeSeed derives a stable random seed from the node name, so each node
+// gets its own but reproducible weather.
+func nodeSeed(node string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	return int64(h.Sum64() >> 1)
+}
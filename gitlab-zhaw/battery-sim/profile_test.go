@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	prs, err := loadProfiles("profiles.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		node   string
+		labels map[string]string
+		want   []string
+		check  func(params) bool
+	}{
+		{"pi-1", nil, []string{"default"}, func(p params) bool { return p.CapacityWh == 50 && p.SolarPeakW == 20 }},
+		{"pi-2", map[string]string{"power.zhaw.ch/panel": "large", "power.zhaw.ch/battery": "small"},
+			[]string{"default", "large-panel", "small-pack"},
+			func(p params) bool { return p.CapacityWh == 25 && p.SolarPeakW == 40 && p.BaseLoadW == 5 }},
+		{"pi-3", map[string]string{"power.zhaw.ch/panel": "small"}, []string{"default", "pi-3"},
+			func(p params) bool { return p.SolarPeakW == 20 && p.BaseLoadW == 3.5 && p.Clouds == 0.6 }},
+	} {
+		p := testParams()
+		applied, err := applyProfiles(&p, prs, tt.node, tt.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(applied, tt.want) || !tt.check(p) {
+			t.Errorf("%s: applied %v, params %+v", tt.node, applied, p)
+		}
+		if p.TimeScale != 1 || p.Sunrise != 6 {
+			t.Errorf("%s: profiles changed params they do not set: %+v", tt.node, p)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(path, []byte(`[{"name": "typo", "params": {"capacity": 10}}]`), 0o644)
+	if _, err := loadProfiles(path); err == nil {
+		t.Error("unknown parameter accepted")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	l, err := parseLabels("a=1, b = two,")
+	if err != nil || !reflect.DeepEqual(l, map[string]string{"a": "1", "b": "two"}) {
+		t.Fatalf("%v %v", l, err)
+	}
+	if _, err := parseLabels("a"); err == nil {
+		t.Fatal("label without value accepted")
+	}
+}
+
+func TestSeedReproducible(t *testing.T) {
+	if nodeSeed("pi-1") != nodeSeed("pi-1") || nodeSeed("pi-1") == nodeSeed("pi-2") {
+		t.Fatal("node seeds not stable or not distinct")
+	}
+	p := testParams()
+	p.Clouds = 1
+	start := time.Date(2025, 6, 1, 8, 0, 0, 0, time.Local)
+	run := func(seed int64) []float64 {
+		b := newBattery(p, start, seed)
+		var out []float64
+		for m := 10; m <= 600; m += 10 {
+			out = append(out, b.status(start.Add(time.Duration(m)*time.Minute)).SolarW)
+		}
+		return out
+	}
+	a, b, c := run(nodeSeed("pi-1")), run(nodeSeed("pi-1")), run(nodeSeed("pi-2"))
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed, different weather")
+	}
+	if reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds, same weather")
+	}
+}
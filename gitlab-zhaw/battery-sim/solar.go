@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Winterthur (ZHAW lab), the default site.
+const (
+	winterthurLat = 47.4988
+	winterthurLon = 8.7237
+	winterthurTZ  = "Europe/Zurich"
+)
+
+// solarGeometry returns the sun's declination (rad) and the equation of
+// time (minutes) at t, after the NOAA general solar position approximation.
+func solarGeometry(t time.Time) (decl, eqTime float64) {
+	u := t.UTC()
+	hour := float64(u.Hour()) + float64(u.Minute())/60 + float64(u.Second())/3600
+	g := 2 * math.Pi / 365 * (float64(u.YearDay()-1) + (hour-12)/24)
+	eqTime = 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl = 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+	return decl, eqTime
+}
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+func deg(rad float64) float64 { return rad * 180 / math.Pi }
+
+// sunElevation is the sun's angle above the horizon at t, in degrees.
+func sunElevation(t time.Time, lat, lon float64) float64 {
+	decl, eqTime := solarGeometry(t)
+	u := t.UTC()
+	minutes := float64(u.Hour())*60 + float64(u.Minute()) + float64(u.Second())/60
+	trueSolar := minutes + eqTime + 4*lon
+	ha := rad(trueSolar/4 - 180)
+	cosZenith := math.Sin(rad(lat))*math.Sin(decl) + math.Cos(rad(lat))*math.Cos(decl)*math.Cos(ha)
+	return 90 - deg(math.Acos(clamp(cosZenith, -1, 1)))
+}
+
+// sunTimes returns sunrise and sunset on the calendar day of day (in its
+// location). ok is false during polar day or night.
+func sunTimes(day time.Time, lat, lon float64) (rise, set time.Time, ok bool) {
+	y, m, d := day.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, day.Location())
+	decl, eqTime := solarGeometry(noon)
+	// -0.833°: refraction and the sun's radius
+	cosHA := math.Cos(rad(90.833))/(math.Cos(rad(lat))*math.Cos(decl)) - math.Tan(rad(lat))*math.Tan(decl)
+	if cosHA < -1 || cosHA > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	ha := deg(math.Acos(cosHA))
+	midnightUTC := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	at := func(minutes float64) time.Time {
+		return midnightUTC.Add(time.Duration(minutes * float64(time.Minute))).In(day.Location())
+	}
+	return at(720 - 4*(lon+ha) - eqTime), at(720 - 4*(lon-ha) - eqTime), true
+}
+
+// clearSkyIrradiance is the irradiance on a horizontal panel under a clear
+// sky, in W/m², using Meinel's air-mass attenuation of the direct beam.
+func clearSkyIrradiance(elevation float64) float64 {
+	if elevation <= 0 {
+		return 0
+	}
+	airMass := 1 / (math.Sin(rad(elevation)) + 0.50572*math.Pow(elevation+6.07995, -1.6364))
+	return 1353 * math.Pow(0.7, math.Pow(airMass, 0.678)) * math.Sin(rad(elevation))
+}
+
+// cloudSchedule sets the cloud cover from a file instead of a random walk.
+// Each line is "time,cover" with cover 0..1; times are either all daily
+// ("HH:MM", repeating every day) or all absolute (RFC 3339). The cover
+// holds until the next entry.
+type cloudSchedule struct {
+	daily   bool
+	entries []cloudEntry // sorted
+}
+
+type cloudEntry struct {
+	at    time.Time     // absolute entries
+	daily time.Duration // daily entries: time since midnight
+	cover float64
+}
+
+func loadCloudSchedule(path string) (*cloudSchedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := readCloudSchedule(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func readCloudSchedule(r io.Reader) (*cloudSchedule, error) {
+	s := &cloudSchedule{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		ts, cover, ok := strings.Cut(text, ",")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want time,cover", line)
+		}
+		var e cloudEntry
+		var err error
+		if e.cover, err = strconv.ParseFloat(strings.TrimSpace(cover), 64); err != nil || e.cover < 0 || e.cover > 1 {
+			return nil, fmt.Errorf("line %d: cover %q: want 0..1", line, cover)
+		}
+		ts = strings.TrimSpace(ts)
+		if hm, err := time.Parse("15:04", ts); err == nil {
+			e.daily = time.Duration(hm.Hour())*time.Hour + time.Duration(hm.Minute())*time.Minute
+			if len(s.entries) > 0 && !s.daily {
+				return nil, fmt.Errorf("line %d: daily and absolute times mixed", line)
+			}
+			s.daily = true
+		} else if e.at, err = time.Parse(time.RFC3339, ts); err == nil {
+			if s.daily {
+				return nil, fmt.Errorf("line %d: daily and absolute times mixed", line)
+			}
+		} else {
+			return nil, fmt.Errorf("line %d: time %q: want HH:MM or RFC 3339", line, ts)
+		}
+		s.entries = append(s.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.entries) == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		if s.daily {
+			return s.entries[i].daily < s.entries[j].daily
+		}
+		return s.entries[i].at.Before(s.entries[j].at)
+	})
+	return s, nil
+}
+
+// at returns the cover at t; daily times are read in t's location.
+func (s *cloudSchedule) at(t time.Time) float64 {
+	var i int
+	if s.daily {
+		y, m, d := t.Date()
+		since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+		i = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].daily > since })
+		if i == 0 { // before the first entry: yesterday's last one holds
+			return s.entries[len(s.entries)-1].cover
+		}
+	} else {
+		i = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].at.After(t) })
+		if i == 0 {
+			return s.entries[0].cover
+		}
+	}
+	return s.entries[i-1].cover
+}
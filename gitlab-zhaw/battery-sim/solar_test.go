@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSunTimesWinterthur(t *testing.T) {
+	zurich, err := time.LoadLocation(winterthurTZ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		day       time.Time
+		rise, set string // local
+	}{
+		{time.Date(2025, 6, 21, 0, 0, 0, 0, zurich), "05:30", "21:27"},
+		{time.Date(2025, 12, 21, 0, 0, 0, 0, zurich), "08:11", "16:37"},
+		{time.Date(2025, 3, 20, 0, 0, 0, 0, zurich), "06:29", "18:36"},
+	} {
+		rise, set, ok := sunTimes(tt.day, winterthurLat, winterthurLon)
+		if !ok {
+			t.Fatalf("%s: no sunrise", tt.day)
+		}
+		for _, c := range []struct {
+			got  time.Time
+			want string
+		}{{rise, tt.rise}, {set, tt.set}} {
+			want, _ := time.ParseInLocation("2006-01-02 15:04", tt.day.Format("2006-01-02 ")+c.want, zurich)
+			if d := c.got.Sub(want); d < -3*time.Minute || d > 3*time.Minute {
+				t.Errorf("%s: got %s, want %s", tt.day.Format("2006-01-02"), c.got.Format("15:04"), c.want)
+			}
+		}
+	}
+	if _, _, ok := sunTimes(time.Date(2025, 6, 21, 0, 0, 0, 0, time.UTC), 80, 0); ok {
+		t.Error("sunset during polar day")
+	}
+}
+
+func TestSunElevationAndIrradiance(t *testing.T) {
+	zurich, _ := time.LoadLocation(winterthurTZ)
+	// solar noon around 13:25 CEST at the summer solstice: 90 - 47.5 + 23.44
+	noon := sunElevation(time.Date(2025, 6, 21, 13, 25, 0, 0, zurich), winterthurLat, winterthurLon)
+	if math.Abs(noon-65.94) > 0.3 {
+		t.Errorf("solstice noon elevation %.2f°", noon)
+	}
+	if e := sunElevation(time.Date(2025, 6, 21, 1, 0, 0, 0, zurich), winterthurLat, winterthurLon); e > -10 {
+		t.Errorf("elevation at 1am %.2f°", e)
+	}
+	if g := clearSkyIrradiance(noon); g < 750 || g > 900 {
+		t.Errorf("clear-sky irradiance at %.0f°: %.0f W/m²", noon, g)
+	}
+	if g := clearSkyIrradiance(5); g <= 0 || g > 100 {
+		t.Errorf("irradiance at 5°: %.0f W/m²", g)
+	}
+	if clearSkyIrradiance(-1) != 0 {
+		t.Error("irradiance below the horizon")
+	}
+}
+
+func TestSunModelBattery(t *testing.T) {
+	p := testParams()
+	p.MaxLoadW, p.SolarModel, p.Latitude, p.Longitude, p.Timezone = 8, "sun", winterthurLat, winterthurLon, winterthurTZ
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	zurich, _ := time.LoadLocation(winterthurTZ)
+
+	// 19:00 UTC is still daylight in Winterthur in June, 20:00 UTC is not
+	start := time.Date(2025, 6, 21, 19, 0, 0, 0, time.UTC)
+	b := newBattery(p, start, 1)
+	st := b.status(start)
+	if st.TimeOfDay != "day" || st.SimTime != "2025-06-21T21:00:00+02:00" || !strings.HasPrefix(st.Sunset, "2025-06-21T21:2") {
+		t.Fatalf("21:00 CEST: %+v", st)
+	}
+	st = b.status(start.Add(time.Hour))
+	if st.TimeOfDay != "night" || st.SolarW != 0 || st.SolarAvailable {
+		t.Fatalf("22:00 CEST: %+v", st)
+	}
+
+	// clear noon: 20 W panel x ~0.85 kW/m²
+	noon := time.Date(2025, 6, 21, 13, 0, 0, 0, zurich)
+	b = newBattery(p, noon, 1)
+	if st := b.status(noon); st.SolarW < 15 || st.SolarW > 18 || !st.SolarAvailable || st.SunElevation < 60 {
+		t.Fatalf("noon: %+v", st)
+	}
+	// December noon is much weaker
+	dec := time.Date(2025, 12, 21, 12, 30, 0, 0, zurich)
+	b = newBattery(p, dec, 1)
+	if st := b.status(dec); st.SolarW < 3 || st.SolarW > 8 {
+		t.Fatalf("december noon: %+v", st)
+	}
+
+	p.SolarModel = "moon"
+	if err := p.validate(); err == nil {
+		t.Error("solar model moon accepted")
+	}
+}
+
+func TestCloudSchedule(t *testing.T) {
+	s, err := readCloudSchedule(strings.NewReader("# daily\n12:00,0.8\n06:00,0.2\n\n18:00,0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hm, want := range map[string]float64{"03:00": 0, "06:00": 0.2, "11:59": 0.2, "12:30": 0.8, "20:00": 0} {
+		at, _ := time.Parse("2006-01-02 15:04", "2025-06-21 "+hm)
+		if got := s.at(at); got != want {
+			t.Errorf("%s: cover %g, want %g", hm, got, want)
+		}
+	}
+
+	abs, err := readCloudSchedule(strings.NewReader("2025-06-21T10:00:00Z,0.5\n2025-06-21T12:00:00Z,1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abs.at(time.Date(2025, 6, 21, 9, 0, 0, 0, time.UTC)) != 0.5 || abs.at(time.Date(2025, 6, 22, 0, 0, 0, 0, time.UTC)) != 1 {
+		t.Error("absolute schedule")
+	}
+
+	for _, bad := range []string{"", "12:00\n", "12:00,2\n", "noon,0.5\n", "12:00,0.5\n2025-06-21T12:00:00Z,1\n"} {
+		if _, err := readCloudSchedule(strings.NewReader(bad)); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+
+	// overcast all day: no solar input at noon
+	p := testParams()
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	b := newBattery(p, start, 1)
+	overcast, _ := readCloudSchedule(strings.NewReader("00:00,1\n"))
+	b.useCloudSchedule(overcast)
+	if st := b.status(start.Add(time.Hour)); st.SolarW != 0 || st.Clouds != 1 {
+		t.Fatalf("overcast: %+v", st)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// thermalParams describe a Raspberry Pi's SoC temperature and clock.
+type thermalParams struct {
+	AmbientC    float64 `json:"ambient_c"`
+	IdleRiseC   float64 `json:"idle_rise_c"` // above ambient when idle
+	LoadRiseC   float64 `json:"load_rise_c"` // additional at 100% CPU and full clock
+	TauS        float64 `json:"tau_s"`       // time constant in simulated seconds
+	CapC        float64 `json:"cap_c"`       // firmware caps the clock above this (80 on a Pi 4)
+	HardC       float64 `json:"hard_c"`      // clock at MinClockMHz from here
+	MaxClockMHz float64 `json:"max_clock_mhz"`
+	MinClockMHz float64 `json:"min_clock_mhz"`
+	VoltV       float64 `json:"volt_v"`
+	SagVoltV    float64 `json:"sag_volt_v"` // core voltage during undervoltage
+}
+
+func defaultThermalParams() thermalParams {
+	return thermalParams{
+		AmbientC: 25, IdleRiseC: 20, LoadRiseC: 45, TauS: 120,
+		CapC: 80, HardC: 85, MaxClockMHz: 1800, MinClockMHz: 600,
+		VoltV: 0.86, SagVoltV: 0.8,
+	}
+}
+
+// Bits of vcgencmd get_throttled: the current state in the low bits, and
+// "has occurred since boot" 16 bits higher.
+const (
+	throttleUndervoltage = 1 << 0
+	throttleFreqCapped   = 1 << 1
+	throttleThrottled    = 1 << 2
+	throttleSoftTemp     = 1 << 3
+	throttleOccurredBits = 16
+)
+
+// agentState is the part of power-agent's /power payload that the
+// thermal-aware functions read, with the same field names.
+type agentState struct {
+	Timestamp       time.Time `json:"timestamp"`
+	TempC           float64   `json:"temp_c"`
+	VoltV           float64   `json:"volt_v"`
+	ClockArmMHz     float64   `json:"clock_arm_mhz"`
+	ThrottleHex     string    `json:"throttle_hex"`
+	Undervoltage    bool      `json:"undervoltage"`
+	FreqCapped      bool      `json:"freq_capped"`
+	Throttled       bool      `json:"throttled"`
+	Source          string    `json:"source"`
+	LastPollLatency string    `json:"last_poll_latency"`
+	AgeSeconds      float64   `json:"age_seconds"`
+	Stale           bool      `json:"stale"`
+
+	// simulation details
+	CPU      float64 `json:"cpu_util"`
+	AmbientC float64 `json:"ambient_c"`
+}
+
+// thermal integrates the SoC temperature over simulated time. It settles
+// towards ambient + IdleRiseC + LoadRiseC x CPU x clock share with time
+// constant TauS; above CapC the firmware lowers the clock, which in turn
+// limits the heat.
+type thermal struct {
+	mu        sync.Mutex
+	p         thermalParams
+	timeScale float64
+
+	realLast time.Time
+	tempC    float64
+	util     float64
+	clockMHz float64
+	uvUntil  time.Time // injected undervoltage
+	uvLow    bool      // battery too low for the supply
+	occurred uint32    // sticky throttle bits
+}
+
+func newThermal(p thermalParams, timeScale float64, start time.Time) *thermal {
+	return &thermal{p: p, timeScale: timeScale, realLast: start, tempC: p.AmbientC + p.IdleRiseC, clockMHz: p.MaxClockMHz}
+}
+
+func (t thermalParams) validate() error {
+	if t.TauS <= 0 || t.HardC <= t.CapC || t.MinClockMHz <= 0 || t.MaxClockMHz < t.MinClockMHz {
+		return fmt.Errorf("thermal: want tau > 0, hard limit above the cap, 0 < min clock <= max clock")
+	}
+	return nil
+}
+
+// advance brings the temperature up to wall time now.
+func (t *thermal) advance(now time.Time) {
+	if !now.After(t.realLast) {
+		return
+	}
+	sim := now.Sub(t.realLast).Seconds() * t.timeScale
+	t.realLast = now
+	for sim > 0 {
+		dt := math.Min(sim, 1)
+		sim -= dt
+		t.clockMHz = t.clock()
+		target := t.p.AmbientC + t.p.IdleRiseC + t.p.LoadRiseC*t.util*t.clockMHz/t.p.MaxClockMHz
+		t.tempC += (target - t.tempC) * (1 - math.Exp(-dt/t.p.TauS))
+	}
+	t.clockMHz = t.clock()
+}
+
+// clock is the ARM clock the firmware allows at the current temperature.
+func (t *thermal) clock() float64 {
+	if t.tempC <= t.p.CapC {
+		return t.p.MaxClockMHz
+	}
+	f := clamp((t.tempC-t.p.CapC)/(t.p.HardC-t.p.CapC), 0, 1)
+	return t.p.MaxClockMHz - (t.p.MaxClockMHz-t.p.MinClockMHz)*f
+}
+
+// setLoad advances to now under the old utilization, then switches to util.
+func (t *thermal) setLoad(now time.Time, util float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+	t.util = clamp(util, 0, 1)
+}
+
+// injectUndervoltage sags the supply until until; a zero until ends it.
+func (t *thermal) injectUndervoltage(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uvUntil = until
+}
+
+// setBatteryLow sags the supply while the battery is nearly empty.
+func (t *thermal) setBatteryLow(low bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uvLow = low
+}
+
+// setAmbient changes the ambient temperature from now on.
+func (t *thermal) setAmbient(now time.Time, c float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+	t.p.AmbientC = c
+}
+
+func (t *thermal) state(now time.Time) map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := map[string]any{"ambient_c": t.p.AmbientC, "undervoltage_battery_low": t.uvLow}
+	if now.Before(t.uvUntil) {
+		st["undervoltage_until"] = t.uvUntil
+	}
+	return st
+}
+
+// power reports the node like power-agent's /power.
+func (t *thermal) power(now time.Time) agentState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+
+	var bits uint32
+	uv := t.uvLow || now.Before(t.uvUntil)
+	if uv {
+		bits |= throttleUndervoltage | throttleFreqCapped
+	}
+	if t.tempC > t.p.CapC {
+		bits |= throttleFreqCapped | throttleThrottled | throttleSoftTemp
+	}
+	t.occurred |= bits
+	bits |= t.occurred << throttleOccurredBits
+
+	volt, clock := t.p.VoltV, t.clockMHz
+	if uv {
+		volt = t.p.SagVoltV
+		clock = math.Min(clock, t.p.MinClockMHz) // firmware drops to the minimum on undervoltage
+	}
+	return agentState{
+		Timestamp:       now,
+		TempC:           math.Round(t.tempC*10) / 10,
+		VoltV:           volt,
+		ClockArmMHz:     math.Round(clock*10) / 10,
+		ThrottleHex:     fmt.Sprintf("0x%x", bits),
+		Undervoltage:    uv,
+		FreqCapped:      bits&throttleFreqCapped != 0,
+		Throttled:       bits&throttleThrottled != 0,
+		Source:          "battery-sim",
+		LastPollLatency: "0s",
+		CPU:             round2(t.util),
+		AmbientC:        t.p.AmbientC,
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerkit/powertest"
+)
+
+func TestThermalHeatsAndThrottles(t *testing.T) {
+	start := time.Unix(0, 0)
+	th := newThermal(defaultThermalParams(), 1, start)
+
+	idle := th.power(start.Add(10 * time.Minute))
+	if idle.TempC != 45 || idle.FreqCapped || idle.ClockArmMHz != 1800 || idle.ThrottleHex != "0x0" {
+		t.Fatalf("idle: %+v", idle)
+	}
+
+	// full load would settle at 90°C; the cap holds it between 80 and 85
+	th.setLoad(start.Add(10*time.Minute), 1)
+	st := th.power(start.Add(30 * time.Minute))
+	if st.TempC <= 80 || st.TempC >= 85 || !st.FreqCapped || !st.Throttled || st.ClockArmMHz >= 1800 || st.ClockArmMHz <= 600 {
+		t.Fatalf("under load: %+v", st)
+	}
+	if st.ThrottleHex != "0xe000e" {
+		t.Fatalf("throttle bits %s, want capped, throttled and soft limit, now and since boot", st.ThrottleHex)
+	}
+
+	// idle again: cools down, the "occurred" bits stay
+	th.setLoad(start.Add(30*time.Minute), 0)
+	st = th.power(start.Add(60 * time.Minute))
+	if st.TempC > 50 || st.FreqCapped || st.Throttled || st.ClockArmMHz != 1800 || st.ThrottleHex != "0xe0000" {
+		t.Fatalf("cooled: %+v", st)
+	}
+
+	// a hot room pushes even an idle node over the cap
+	th.setAmbient(start.Add(60*time.Minute), 65)
+	if st := th.power(start.Add(90 * time.Minute)); !st.Throttled {
+		t.Fatalf("65°C ambient: %+v", st)
+	}
+}
+
+func TestThermalUndervoltage(t *testing.T) {
+	start := time.Unix(0, 0)
+	th := newThermal(defaultThermalParams(), 60, start)
+	th.injectUndervoltage(start.Add(time.Minute))
+	st := th.power(start.Add(30 * time.Second))
+	if !st.Undervoltage || st.VoltV != 0.8 || !st.FreqCapped || st.ClockArmMHz != 600 || st.ThrottleHex != "0x30003" {
+		t.Fatalf("undervoltage: %+v", st)
+	}
+	if st := th.power(start.Add(2 * time.Minute)); st.Undervoltage || st.VoltV != 0.86 || st.ThrottleHex != "0x30000" {
+		t.Fatalf("after the injection: %+v", st)
+	}
+	th.setBatteryLow(true)
+	if st := th.power(start.Add(3 * time.Minute)); !st.Undervoltage {
+		t.Fatalf("battery low: %+v", st)
+	}
+}
+
+func TestPowerCompatible(t *testing.T) {
+	now := time.Now()
+	th := newThermal(defaultThermalParams(), 1, now)
+	th.injectUndervoltage(now.Add(time.Hour))
+	b, _ := json.Marshal(th.power(now))
+	// the functions decode /power into this shape
+	var agent powertest.Agent
+	if err := json.Unmarshal(b, &agent); err != nil {
+		t.Fatal(err)
+	}
+	if agent.TempC != 45 || agent.ClockArmMHz != 600 || !agent.Undervoltage || agent.Stale || agent.Timestamp.IsZero() {
+		t.Fatalf("as power-agent: %+v", agent)
+	}
+}
+
+func TestAdminThermal(t *testing.T) {
+	now := time.Unix(0, 0)
+	bat := newBattery(testParams(), now, 1)
+	ctl := newController(bat, "tok")
+	ctl.now = func() time.Time { return now }
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer tok")
+		ctl.handler().ServeHTTP(w, r)
+		return w
+	}
+	if w := call("POST", "/admin/undervoltage", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("without --thermal: %d", w.Code)
+	}
+
+	ctl.thermal = newThermal(defaultThermalParams(), 1, now)
+	if w := call("POST", "/admin/undervoltage", `{"for": "5m"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"undervoltage_until"`) {
+		t.Fatalf("undervoltage: %d %s", w.Code, w.Body)
+	}
+	if !ctl.thermal.power(now.Add(4 * time.Minute)).Undervoltage {
+		t.Fatal("no undervoltage after the injection")
+	}
+	call("DELETE", "/admin/undervoltage", "")
+	if ctl.thermal.power(now.Add(4 * time.Minute)).Undervoltage {
+		t.Fatal("undervoltage after DELETE")
+	}
+	if w := call("POST", "/admin/ambient", `{"ambient_c": 40}`); !strings.Contains(w.Body.String(), `"ambient_c":40`) {
+		t.Fatalf("ambient: %s", w.Body)
+	}
+	if w := call("POST", "/admin/ambient", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("ambient without a value: %d", w.Code)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracePoint is one row of a recorded trace.
+type tracePoint struct {
+	At             time.Time
+	Percent        float64
+	Charging       bool
+	SolarAvailable bool
+	SolarW         float64 // NaN if the trace has no solar_w column
+}
+
+// trace is a recorded battery/solar time series, replayed instead of the
+// battery model for reproducible runs.
+type trace struct {
+	points []tracePoint
+}
+
+// readTrace parses a CSV trace. The header names the columns; timestamp
+// (RFC 3339 or unix seconds) and battery_percent are required, is_charging,
+// solar_available and solar_w are optional. Without solar_available, solar
+// counts as available when solar_w > 0.
+func readTrace(r io.Reader) (*trace, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("trace header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, req := range []string{"timestamp", "battery_percent"} {
+		if _, ok := col[req]; !ok {
+			return nil, fmt.Errorf("trace: missing column %q", req)
+		}
+	}
+
+	var tr trace
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("trace: %w", err)
+		}
+		p, err := parseTracePoint(rec, col)
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		tr.points = append(tr.points, p)
+	}
+	if len(tr.points) < 2 {
+		return nil, errors.New("trace: need at least two rows")
+	}
+	sort.SliceStable(tr.points, func(i, j int) bool { return tr.points[i].At.Before(tr.points[j].At) })
+	if tr.duration() <= 0 {
+		return nil, errors.New("trace: all rows have the same timestamp")
+	}
+	return &tr, nil
+}
+
+func loadTrace(path string) (*trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTrace(f)
+}
+
+func parseTracePoint(rec []string, col map[string]int) (tracePoint, error) {
+	field := func(name string) (string, bool) {
+		i, ok := col[name]
+		if !ok || i >= len(rec) || strings.TrimSpace(rec[i]) == "" {
+			return "", false
+		}
+		return strings.TrimSpace(rec[i]), true
+	}
+	p := tracePoint{SolarW: math.NaN()}
+
+	ts, _ := field("timestamp")
+	if at, err := time.Parse(time.RFC3339, ts); err == nil {
+		p.At = at
+	} else if sec, err := strconv.ParseFloat(ts, 64); err == nil {
+		p.At = time.Unix(0, int64(sec*float64(time.Second)))
+	} else {
+		return p, fmt.Errorf("timestamp %q: want RFC 3339 or unix seconds", ts)
+	}
+
+	pct, _ := field("battery_percent")
+	v, err := strconv.ParseFloat(pct, 64)
+	if err != nil || v < 0 || v > 100 {
+		return p, fmt.Errorf("battery_percent %q: want 0..100", pct)
+	}
+	p.Percent = v
+
+	if s, ok := field("solar_w"); ok {
+		if p.SolarW, err = strconv.ParseFloat(s, 64); err != nil || p.SolarW < 0 {
+			return p, fmt.Errorf("solar_w %q", s)
+		}
+		p.SolarAvailable = p.SolarW > 0
+	}
+	for name, dst := range map[string]*bool{"is_charging": &p.Charging, "solar_available": &p.SolarAvailable} {
+		if s, ok := field(name); ok {
+			if *dst, err = strconv.ParseBool(s); err != nil {
+				return p, fmt.Errorf("%s %q", name, s)
+			}
+		}
+	}
+	return p, nil
+}
+
+func (t *trace) duration() time.Duration {
+	return t.points[len(t.points)-1].At.Sub(t.points[0].At)
+}
+
+// at returns the trace at offset d from its first row: battery percent and
+// solar watts are interpolated linearly, the flags hold from the previous row.
+func (t *trace) at(d time.Duration) tracePoint {
+	when := t.points[0].At.Add(d)
+	i := sort.Search(len(t.points), func(i int) bool { return t.points[i].At.After(when) })
+	if i == 0 {
+		return t.points[0]
+	}
+	if i == len(t.points) {
+		return t.points[len(t.points)-1]
+	}
+	prev, next := t.points[i-1], t.points[i]
+	f := float64(when.Sub(prev.At)) / float64(next.At.Sub(prev.At))
+	p := prev
+	p.At = when
+	p.Percent = prev.Percent + (next.Percent-prev.Percent)*f
+	if !math.IsNaN(prev.SolarW) && !math.IsNaN(next.SolarW) {
+		p.SolarW = prev.SolarW + (next.SolarW-prev.SolarW)*f
+	}
+	return p
+}
+
+// replay plays a trace against wall time: Speed trace seconds per real
+// second, starting Offset into the trace, wrapping around if Loop is set and
+// holding the last row otherwise.
+type replay struct {
+	tr     *trace
+	Speed  float64
+	Offset time.Duration
+	Loop   bool
+
+	mu     sync.Mutex
+	start  time.Time     // wall time at from
+	from   time.Duration // position at start
+	frozen bool          // paused at from
+}
+
+func newReplay(tr *trace, start time.Time, speed float64, offset time.Duration, loop bool) *replay {
+	return &replay{tr: tr, Speed: speed, Offset: offset, Loop: loop, start: start, from: offset}
+}
+
+func (r *replay) pause(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.from, r.start, r.frozen = r.position(now), now, true
+}
+
+func (r *replay) resume(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start, r.frozen = now, false
+}
+
+// reset starts over at Offset.
+func (r *replay) reset(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start, r.from, r.frozen = now, r.Offset, false
+}
+
+// position is the offset into the trace at wall time now.
+func (r *replay) position(now time.Time) time.Duration {
+	d := r.from
+	if !r.frozen {
+		d += time.Duration(float64(now.Sub(r.start)) * r.Speed)
+	}
+	if total := r.tr.duration(); r.Loop {
+		d %= total
+		if d < 0 {
+			d += total
+		}
+	}
+	return d
+}
+
+func (r *replay) status(now time.Time) PowerStatus {
+	r.mu.Lock()
+	p := r.tr.at(r.position(now))
+	r.mu.Unlock()
+	st := PowerStatus{
+		NodeName:       getNodeName(),
+		BatteryPercent: int(math.Round(p.Percent)),
+		IsCharging:     p.Charging,
+		TimeOfDay:      "night",
+		SolarAvailable: p.SolarAvailable,
+		LastUpdated:    now.Format(time.RFC3339),
+		SimTime:        p.At.Format(time.RFC3339),
+	}
+	if p.SolarAvailable { // traces carry no sun position
+		st.TimeOfDay = "day"
+	}
+	if !math.IsNaN(p.SolarW) {
+		st.SolarW = round2(p.SolarW)
+	}
+	return st
+}
+
+// nodeOffset picks this node's entry from "node=duration,..." so that nodes
+// replaying the same trace are out of phase; "*" matches any other node.
+func nodeOffset(spec, node string) (time.Duration, error) {
+	var fallback time.Duration
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return 0, fmt.Errorf("node offset %q: want node=duration", kv)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("node offset %q: %w", kv, err)
+		}
+		switch strings.TrimSpace(name) {
+		case node:
+			return d, nil
+		case "*":
+			fallback = d
+		}
+	}
+	return fallback, nil
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"log"
-	"net/http"
 	"os"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
 )
 
 type PowerStatus struct {
@@ -20,6 +22,27 @@ type PowerStatus struct {
 	LastUpdated    string `json:"last_updated"`
 }
 
+// nightPolicy is the poller's example policy: run only when battery < 30%,
+// night, not charging. Override with POWER_POLICY_*.
+var nightPolicy = policy.Policy{
+	State:   "low",
+	Combine: "all",
+	Rules: []policy.Rule{
+		{Signal: "battery_percent", Op: "<", Value: 30},
+		{Signal: "night"},
+		{Signal: "is_charging", Not: true},
+	},
+}
+
+func (ps PowerStatus) reading() policy.Reading {
+	return policy.Reading{
+		BatteryPercent: float64(ps.BatteryPercent),
+		IsCharging:     ps.IsCharging,
+		SolarAvailable: ps.SolarAvailable,
+		TimeOfDay:      ps.TimeOfDay,
+	}
+}
+
 func main() {
 	target := getenv("POWER_STATUS_URL", "http://power-api.monitoring.svc.cluster.local:8080/status")
 	period := getenv("PERIOD", "30s")
@@ -29,27 +52,36 @@ func main() {
 		p = 30 * time.Second
 	}
 
+	pol, err := policy.Load(nightPolicy)
+	if err != nil {
+		log.Fatalf("power policy: %v", err)
+	}
+
 	c, err := cloudevents.NewClientHTTP()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	status := powerclient.New[PowerStatus](target, 800*time.Millisecond, p)
+
 	for {
-		status, err := fetch(target)
-		if err != nil {
+		if err := status.Refresh(context.Background()); err != nil {
 			log.Printf("fetch error: %v", err)
+		}
+		st := status.Get()
+		if !st.HasValue() {
+			// nothing read yet: no node and no reading to report
 			time.Sleep(p)
 			continue
 		}
 
-		// YOUR policy — example: run only when battery < 30%, night, not charging
-		shouldRun := status.BatteryPercent < 30 && status.TimeOfDay == "night" && !status.IsCharging
-		powerState := "ok"
-		if shouldRun {
-			powerState = "low"
-		}
+		// After an outage the event still goes out, with the last reading
+		// and power_state "unknown", so Triggers see that the data is gone.
+		d := decide(pol, st, 3*p)
+		shouldRun := runs(d)
+		powerState := d.State
 
-		data, _ := json.Marshal(status)
+		data, _ := json.Marshal(st.Value)
 
 		event := cloudevents.NewEvent()
 		event.SetSource("power-poller")
@@ -58,7 +90,7 @@ func main() {
 		// extensions that Triggers can filter on (strings/bools are fine)
 		event.SetExtension("should_run", shouldRun)
 		event.SetExtension("power_state", powerState)
-		event.SetExtension("node", status.NodeName)
+		event.SetExtension("node", st.Value.NodeName)
 
 		if err := event.SetData(cloudevents.ApplicationJSON, data); err != nil {
 			log.Printf("set data: %v", err)
@@ -71,14 +103,20 @@ func main() {
 	}
 }
 
-func fetch(url string) (PowerStatus, error) {
-	var ps PowerStatus
-	resp, err := http.Get(url)
-	if err != nil {
-		return ps, err
+// decide evaluates the poller's policy (default: battery < 30%, night, not
+// charging). Without a reading younger than maxAge the state is "unknown".
+func decide(pol *policy.Policy, st powerclient.Snapshot[PowerStatus], maxAge time.Duration) policy.Decision {
+	if ok, why := st.Usable(maxAge); !ok {
+		return pol.Unknown(why)
 	}
-	defer resp.Body.Close()
-	return ps, json.NewDecoder(resp.Body).Decode(&ps)
+	return pol.Evaluate(st.Value.reading())
+}
+
+// runs reports whether the workload should fire: on a policy match, and
+// never on an unknown state. on_unknown=closed marks an unknown state as
+// degraded, which here must not turn into a run.
+func runs(d policy.Decision) bool {
+	return d.State != policy.Unknown && d.Degraded
 }
 
 func getenv(k, def string) string {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powertest"
+)
+
+// TestDecide runs the poller's default policy against a scripted
+// battery-sim: it should only run at night on a low, discharging battery.
+func TestDecide(t *testing.T) {
+	open, closed := nightPolicy, nightPolicy
+	closed.OnUnknown = "closed"
+	for _, p := range []*policy.Policy{&open, &closed} {
+		if err := p.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	charging := powertest.Night(20)
+	charging.IsCharging = true
+	tests := []struct {
+		name   string
+		script []powertest.Response
+		pol    *policy.Policy
+		state  string
+		run    bool
+	}{
+		{"low at night", []powertest.Response{powertest.JSON(powertest.Night(20))}, &open, "low", true},
+		{"full at night", []powertest.Response{powertest.JSON(powertest.Night(80))}, &open, policy.OK, false},
+		{"low by day", []powertest.Response{powertest.JSON(powertest.Day(20))}, &open, policy.OK, false},
+		{"low but charging", []powertest.Response{powertest.JSON(charging)}, &open, policy.OK, false},
+		{"simulator down", []powertest.Response{powertest.Down()}, &open, policy.Unknown, false},
+		{"simulator down, fail closed", []powertest.Response{powertest.Down()}, &closed, policy.Unknown, false},
+		{"malformed JSON", []powertest.Response{powertest.Malformed()}, &open, policy.Unknown, false},
+		{"slow simulator", []powertest.Response{powertest.Slow(time.Second, powertest.Night(20))}, &open, policy.Unknown, false},
+		{"outage keeps the last reading", []powertest.Response{
+			powertest.JSON(powertest.Night(20)),
+			powertest.Status(503),
+		}, &open, "low", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := powertest.New(t, tt.script...)
+			c := powerclient.New[PowerStatus](srv.URL, 200*time.Millisecond, time.Minute)
+			for range tt.script {
+				_ = c.Refresh(context.Background())
+			}
+			d := decide(tt.pol, c.Get(), time.Minute)
+			if d.State != tt.state || runs(d) != tt.run {
+				t.Fatalf("state %q should_run %v, want %q %v (%v)", d.State, runs(d), tt.state, tt.run, d.Reasons)
+			}
+		})
+	}
+}
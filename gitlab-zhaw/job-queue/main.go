@@ -0,0 +1,314 @@
+// job-queue accepts battery-aware work now and runs it when the power
+// policy says ok, instead of running or dropping it on the spot like
+// battery-debug's should_run.
+//
+//	POST   /jobs        {"payload": ..., "priority": 5, "deadline_in": "6h", "callback_url": "..."}
+//	                    -> 202 {"id", "status_url", ...}, Location: /jobs/<id>
+//	GET    /jobs        all jobs in run order, ?state=queued|running|done|failed|cancelled
+//	GET    /jobs/{id}   one job
+//	DELETE /jobs/{id}   cancel a queued job
+//
+// Jobs are persisted in JOB_DIR and survive restarts. A job runs by POSTing
+// its payload to its callback_url or JOB_HANDLER_URL, or by running
+// JOB_HANDLER_CMD with the payload on stdin. callback_url is refused unless it
+// matches a prefix in JOB_CALLBACK_ALLOW. After its deadline (deadline as
+// RFC 3339, or deadline_in; default JOB_DEFAULT_DEADLINE) a job runs even
+// while the node is low or its power state unknown. Failed attempts are retried up to JOB_MAX_ATTEMPTS.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+)
+
+type PowerStatus struct {
+	NodeName       string `json:"node_name"`
+	BatteryPercent int    `json:"battery_percent"`
+	IsCharging     bool   `json:"is_charging"`
+	TimeOfDay      string `json:"time_of_day"`
+	SolarAvailable bool   `json:"solar_available"`
+	LastUpdated    string `json:"last_updated"`
+}
+
+func (ps PowerStatus) reading() policy.Reading {
+	return policy.Reading{
+		BatteryPercent: float64(ps.BatteryPercent),
+		IsCharging:     ps.IsCharging,
+		SolarAvailable: ps.SolarAvailable,
+		TimeOfDay:      ps.TimeOfDay,
+	}
+}
+
+// powerDecider evaluates pol against the cached simulator reading; no
+// reading, or one older than three TTLs, is unknown.
+func powerDecider(c *powerclient.Client[PowerStatus], pol *policy.Policy) func() policy.Decision {
+	return func() policy.Decision {
+		st := c.Get()
+		if ok, why := st.Usable(3 * c.TTL()); !ok {
+			return pol.Unknown(why)
+		}
+		return pol.Evaluate(st.Value.reading())
+	}
+}
+
+// server is the HTTP API.
+type server struct {
+	store           *store
+	sched           *scheduler
+	callbacks       callbackAllow // allowed callback_url prefixes
+	defaultDeadline time.Duration
+}
+
+type submitRequest struct {
+	Payload     json.RawMessage `json:"payload"`
+	Priority    int             `json:"priority"`
+	Deadline    time.Time       `json:"deadline"`
+	DeadlineIn  string          `json:"deadline_in"`
+	CallbackURL string          `json:"callback_url"`
+}
+
+const maxPayload = 1 << 20
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.submit)
+	mux.HandleFunc("GET /jobs", s.list)
+	mux.HandleFunc("GET /jobs/{id}", s.get)
+	mux.HandleFunc("DELETE /jobs/{id}", s.cancel)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	return mux
+}
+
+func (s *server) submit(w http.ResponseWriter, r *http.Request) {
+	var req submitRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxPayload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "bad job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	j := Job{
+		Priority:    req.Priority,
+		Payload:     req.Payload,
+		CallbackURL: req.CallbackURL,
+		Deadline:    req.Deadline,
+		CreatedAt:   now,
+	}
+	switch {
+	case req.DeadlineIn != "" && !req.Deadline.IsZero():
+		http.Error(w, "bad job: set deadline or deadline_in, not both", http.StatusBadRequest)
+		return
+	case req.DeadlineIn != "":
+		d, err := time.ParseDuration(req.DeadlineIn)
+		if err != nil {
+			http.Error(w, "bad job: deadline_in: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		j.Deadline = now.Add(d)
+	case j.Deadline.IsZero():
+		j.Deadline = now.Add(s.defaultDeadline)
+	}
+	if j.CallbackURL != "" && !s.callbacks.allows(j.CallbackURL) {
+		http.Error(w, "bad job: callback_url not allowed (see JOB_CALLBACK_ALLOW)", http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.store.add(j)
+	if err != nil {
+		http.Error(w, "store job: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.sched.notify()
+
+	statusURL := "/jobs/" + j.ID
+	w.Header().Set("Location", statusURL)
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"id":         j.ID,
+		"state":      j.State,
+		"status_url": statusURL,
+		"deadline":   j.Deadline,
+	})
+}
+
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", Queued, Running, Done, Failed, Cancelled:
+	default:
+		http.Error(w, "unknown state "+strconv.Quote(state), http.StatusBadRequest)
+		return
+	}
+	d := s.sched.decide()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"power_state": d.State,
+		"should_run":  runs(d),
+		"reasons":     d.Reasons,
+		"jobs":        s.store.list(state),
+	})
+}
+
+func (s *server) get(w http.ResponseWriter, r *http.Request) {
+	j, err := s.store.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func (s *server) cancel(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	cancelled := false
+	j, err := s.store.update(r.PathValue("id"), func(j *Job) bool {
+		if j.State != Queued {
+			return false
+		}
+		j.State, j.FinishedAt, j.RetryAt = Cancelled, &now, nil
+		cancelled = true
+		return true
+	})
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case !cancelled:
+		http.Error(w, fmt.Sprintf("job is %s", j.State), http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, j)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func main() {
+	port := getenv("PORT", "8080")
+
+	pol, err := policy.Load(policy.Battery)
+	if err != nil {
+		log.Fatalf("power policy: %v", err)
+	}
+
+	// Prefer explicit URL, else the simulator on HOST_IP, else localhost.
+	powerURL := os.Getenv("POWER_STATUS_URL")
+	if powerURL == "" {
+		if host := os.Getenv("HOST_IP"); host != "" {
+			powerURL = "http://" + host + ":8080/status"
+		}
+	}
+	if powerURL == "" {
+		powerURL = "http://localhost:8080/status"
+	}
+	status := powerclient.New[PowerStatus](powerURL, 800*time.Millisecond, 5*time.Second)
+
+	st, err := openStore(getenv("JOB_DIR", "/var/lib/job-queue"))
+	if err != nil {
+		log.Fatalf("job store: %v", err)
+	}
+
+	var cmd []string
+	if c := os.Getenv("JOB_HANDLER_CMD"); c != "" {
+		cmd = strings.Fields(c)
+	}
+	callbacks, err := parseCallbackAllow(os.Getenv("JOB_CALLBACK_ALLOW"))
+	if err != nil {
+		log.Fatalf("JOB_CALLBACK_ALLOW: %v", err)
+	}
+	sched := newScheduler(st, powerDecider(status, pol), newExecutor(os.Getenv("JOB_HANDLER_URL"), cmd, callbacks),
+		atoi("JOB_WORKERS", 1))
+	sched.maxAttempts = atoi("JOB_MAX_ATTEMPTS", sched.maxAttempts)
+	sched.timeout = duration("JOB_TIMEOUT", sched.timeout)
+	retention := duration("JOB_RETENTION", 7*24*time.Hour)
+
+	s := &server{store: st, sched: sched, callbacks: callbacks, defaultDeadline: duration("JOB_DEFAULT_DEADLINE", 24*time.Hour)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// warm the cache so the first tick already sees a reading
+	_ = status.Refresh(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		sched.loop(ctx, duration("JOB_POLL_INTERVAL", 10*time.Second))
+		close(done)
+	}()
+	go func() {
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+		for range t.C {
+			st.prune(retention, time.Now())
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.Printf("listening on :%s, %d queued jobs, power from %s", port, len(st.list(Queued)), status.URL())
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdown)
+	<-done
+	log.Println("server shut down")
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func atoi(k string, def int) int {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("%s: want a positive integer, got %q", k, v)
+	}
+	return n
+}
+
+func duration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s: want a positive duration, got %q", k, v)
+	}
+	return d
+}
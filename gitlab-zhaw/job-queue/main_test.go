@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powertest"
+)
+
+// testQueue wires a scheduler to a fake battery-sim and a recording executor.
+type testQueue struct {
+	srv   *powertest.Server
+	power *powerclient.Client[PowerStatus]
+	store *store
+	sched *scheduler
+	api   http.Handler
+
+	mu   sync.Mutex
+	ran  []string // payloads in execution order
+	fail map[string]bool
+}
+
+func newTestQueue(t *testing.T, dir string) *testQueue {
+	t.Helper()
+	q := &testQueue{fail: map[string]bool{}}
+	q.srv = powertest.New(t, powertest.JSON(powertest.Night(15)))
+	q.power = powerclient.New[PowerStatus](q.srv.URL, 200*time.Millisecond, time.Minute)
+	st, err := openStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.store = st
+	pol := policy.Battery
+	q.sched = newScheduler(st, powerDecider(q.power, &pol), func(ctx context.Context, j Job) (string, error) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		p := string(j.Payload)
+		q.ran = append(q.ran, p)
+		if q.fail[p] {
+			return "", errors.New("boom")
+		}
+		return "ok " + p, nil
+	}, 1)
+	q.sched.backoff = 0
+	q.api = (&server{store: st, sched: q.sched, defaultDeadline: time.Hour}).routes()
+	return q
+}
+
+// setPower switches the simulator and refreshes the cached reading.
+func (q *testQueue) setPower(t *testing.T, b powertest.Battery) {
+	t.Helper()
+	q.srv.Set(powertest.JSON(b))
+	if err := q.power.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drain ticks until nothing more starts.
+func (q *testQueue) drain() {
+	for i := 0; i < 10; i++ {
+		q.sched.tick(context.Background())
+		q.sched.wg.Wait()
+	}
+}
+
+func (q *testQueue) submit(t *testing.T, body string) Job {
+	t.Helper()
+	w := httptest.NewRecorder()
+	q.api.ServeHTTP(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit %s: %d %s", body, w.Code, w.Body)
+	}
+	var out struct {
+		ID        string `json:"id"`
+		StatusURL string `json:"status_url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != out.StatusURL || out.StatusURL != "/jobs/"+out.ID {
+		t.Fatalf("Location %q, status_url %q", w.Header().Get("Location"), out.StatusURL)
+	}
+	j, err := q.store.get(out.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func (q *testQueue) ranJobs() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.ran...)
+}
+
+// TestDeferUntilOK ensures that jobs wait while the battery is low, that an
+// expired deadline forces a job through, and that the rest run by priority
+// once power is back.
+func TestDeferUntilOK(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.setPower(t, powertest.Night(15))
+
+	low := q.submit(t, `{"payload": "low", "priority": 1}`)
+	high := q.submit(t, `{"payload": "high", "priority": 9}`)
+	q.submit(t, `{"payload": "urgent", "deadline": "2000-01-01T00:00:00Z"}`)
+	q.drain()
+	if got := q.ranJobs(); len(got) != 1 || got[0] != `"urgent"` {
+		t.Fatalf("while low ran %v, want only the overdue job", got)
+	}
+	if j, _ := q.store.get(high.ID); j.State != Queued {
+		t.Fatalf("high-priority job is %s while low", j.State)
+	}
+	urgent := q.store.list(Done)[0]
+	if !urgent.Forced || urgent.PowerState != "low" || urgent.Result != `ok "urgent"` {
+		t.Fatalf("overdue job = %+v", urgent)
+	}
+
+	q.setPower(t, powertest.Day(80))
+	q.drain()
+	if got := strings.Join(q.ranJobs(), " "); got != `"urgent" "high" "low"` {
+		t.Fatalf("ran %s", got)
+	}
+	for _, id := range []string{low.ID, high.ID} {
+		if j, _ := q.store.get(id); j.State != Done || j.Forced || j.PowerState != policy.OK {
+			t.Fatalf("job %s = %+v", id, j)
+		}
+	}
+}
+
+// TestPowerAPIDown ensures that jobs wait while the simulator fails, even
+// though the default policy fails open, and that overdue jobs still run.
+func TestPowerAPIDown(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.srv.Set(powertest.Status(http.StatusInternalServerError))
+	if err := q.power.Refresh(context.Background()); err == nil {
+		t.Fatal("want a fetch error")
+	}
+
+	waiting := q.submit(t, `{"payload": "waiting"}`)
+	q.submit(t, `{"payload": "urgent", "deadline": "2000-01-01T00:00:00Z"}`)
+	q.drain()
+	if got := q.ranJobs(); len(got) != 1 || got[0] != `"urgent"` {
+		t.Fatalf("while the power API is down ran %v, want only the overdue job", got)
+	}
+	if j, _ := q.store.get(waiting.ID); j.State != Queued {
+		t.Fatalf("job is %s while the power API is down", j.State)
+	}
+	if urgent := q.store.list(Done)[0]; !urgent.Forced || urgent.PowerState != policy.Unknown {
+		t.Fatalf("overdue job = %+v", urgent)
+	}
+
+	w := httptest.NewRecorder()
+	q.api.ServeHTTP(w, httptest.NewRequest("GET", "/jobs", nil))
+	var out struct {
+		PowerState string `json:"power_state"`
+		ShouldRun  bool   `json:"should_run"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.PowerState != policy.Unknown || out.ShouldRun {
+		t.Fatalf("listing = %+v", out)
+	}
+}
+
+// TestRetryAndCancel covers failed attempts and DELETE /jobs/{id}.
+func TestRetryAndCancel(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	q.setPower(t, powertest.Day(80))
+	q.sched.maxAttempts = 2
+	q.fail[`"bad"`] = true
+
+	bad := q.submit(t, `{"payload": "bad"}`)
+	q.drain()
+	j, _ := q.store.get(bad.ID)
+	if j.State != Failed || j.Attempts != 2 || j.Error != "boom" {
+		t.Fatalf("failing job = %+v", j)
+	}
+
+	q.setPower(t, powertest.Night(10))
+	later := q.submit(t, `{"payload": "later"}`)
+	for _, tt := range []struct {
+		id   string
+		want int
+	}{{later.ID, http.StatusOK}, {later.ID, http.StatusConflict}, {bad.ID, http.StatusConflict}, {"nope", http.StatusNotFound}} {
+		w := httptest.NewRecorder()
+		q.api.ServeHTTP(w, httptest.NewRequest("DELETE", "/jobs/"+tt.id, nil))
+		if w.Code != tt.want {
+			t.Fatalf("DELETE %s: %d, want %d", tt.id, w.Code, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	q.api.ServeHTTP(w, httptest.NewRequest("GET", "/jobs?state=cancelled", nil))
+	var out struct {
+		PowerState string `json:"power_state"`
+		Jobs       []Job  `json:"jobs"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.PowerState != "low" || len(out.Jobs) != 1 || out.Jobs[0].ID != later.ID {
+		t.Fatalf("listing = %+v", out)
+	}
+}
+
+// TestPersistence ensures that queued jobs survive a restart and that jobs
+// cut off while running are queued again.
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir)
+	q.setPower(t, powertest.Night(10))
+	a := q.submit(t, `{"payload": {"n": 1}, "priority": 3, "deadline_in": "2h"}`)
+	b := q.submit(t, `{"payload": {"n": 2}}`)
+	if _, err := q.store.update(b.ID, func(j *Job) bool { j.State = Running; return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := openStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := st.list(Queued)
+	if len(got) != 2 || got[0].ID != a.ID || got[1].ID != b.ID {
+		t.Fatalf("reloaded %+v", got)
+	}
+	if string(got[0].Payload) != `{"n":1}` || !got[0].Deadline.Equal(a.Deadline) {
+		t.Fatalf("job a = %+v", got[0])
+	}
+}
+
+func TestSubmitValidation(t *testing.T) {
+	q := newTestQueue(t, t.TempDir())
+	for _, body := range []string{
+		`not json`,
+		`{"payload": 1, "unknown": true}`,
+		`{"deadline_in": "soon"}`,
+		`{"deadline_in": "1h", "deadline": "2030-01-01T00:00:00Z"}`,
+		`{"callback_url": "file:///etc/passwd"}`,
+		`{"callback_url": "http://169.254.169.254/latest/meta-data/"}`, // no JOB_CALLBACK_ALLOW
+	} {
+		w := httptest.NewRecorder()
+		q.api.ServeHTTP(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestCallbackAllow(t *testing.T) {
+	allow, err := parseCallbackAllow("http://battery-debug.default.svc/hooks/, https://jobs.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for raw, want := range map[string]bool{
+		"http://battery-debug.default.svc/hooks/done":    true,
+		"http://Battery-Debug.default.svc/hooks/":        true,
+		"https://jobs.example.com/any/path":              true,
+		"http://battery-debug.default.svc/admin":         false,
+		"https://battery-debug.default.svc/hooks/done":   false, // scheme must match
+		"http://battery-debug.default.svc.evil/hooks/":   false,
+		"http://battery-debug.default.svc:9000/hooks/":   false,
+		"https://jobs.example.com@169.254.169.254/":      false,
+		"http://user@battery-debug.default.svc/hooks/":   false,
+		"https://jobs.example.com.attacker.net/callback": false,
+	} {
+		if got := allow.allows(raw); got != want {
+			t.Errorf("allows(%q) = %v, want %v", raw, got, want)
+		}
+	}
+	for _, bad := range []string{"battery-debug/hooks", "ftp://host/", "http://"} {
+		if _, err := parseCallbackAllow(bad); err == nil {
+			t.Errorf("parseCallbackAllow(%q): want an error", bad)
+		}
+	}
+
+	// accepted on submit when allowed
+	q := newTestQueue(t, t.TempDir())
+	q.api = (&server{store: q.store, sched: q.sched, callbacks: allow, defaultDeadline: time.Hour}).routes()
+	q.submit(t, `{"callback_url": "https://jobs.example.com/done"}`)
+
+	// and refused at run time for jobs stored before the list changed
+	var hit bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer target.Close()
+	exec := newExecutor("", nil, allow)
+	if _, err := exec(context.Background(), Job{ID: "j1", CallbackURL: target.URL}); err == nil || hit {
+		t.Fatalf("err %v hit %v, want the callback refused", err, hit)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"powerkit/policy"
+)
+
+// execFunc runs one job and returns its result.
+type execFunc func(ctx context.Context, j Job) (string, error)
+
+// maxResult caps the handler output kept in the job record.
+const maxResult = 4 << 10
+
+// callbackAllow lists where per-job callbacks may point, from
+// JOB_CALLBACK_ALLOW, e.g. "http://battery-debug.default.svc.cluster.local/".
+// A callback must match an entry's scheme and host exactly and start with its
+// path. Without entries, callback_url is refused: anyone who can submit a job
+// could otherwise make the queue POST anywhere inside the cluster.
+type callbackAllow []*url.URL
+
+func parseCallbackAllow(s string) (callbackAllow, error) {
+	var allow callbackAllow
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q: want an http(s) URL prefix", v)
+		}
+		allow = append(allow, u)
+	}
+	return allow, nil
+}
+
+func (a callbackAllow) allows(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, p := range a {
+		if u.Scheme == p.Scheme && strings.EqualFold(u.Host, p.Host) && strings.HasPrefix(u.Path, p.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// newExecutor runs jobs by POSTing the payload to the job's callback URL or
+// handlerURL, or else by running cmd with the payload on stdin. Callbacks
+// are checked against allow again, for jobs stored under an older list.
+func newExecutor(handlerURL string, cmd []string, allow callbackAllow) execFunc {
+	client := &http.Client{}
+	return func(ctx context.Context, j Job) (string, error) {
+		url := j.CallbackURL
+		if url != "" && !allow.allows(url) {
+			return "", fmt.Errorf("callback_url %s not allowed by JOB_CALLBACK_ALLOW", url)
+		}
+		if url == "" {
+			url = handlerURL
+		}
+		switch {
+		case url != "":
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(j.Payload))
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Job-ID", j.ID)
+			req.Header.Set("X-Job-Attempt", fmt.Sprint(j.Attempts))
+			resp, err := client.Do(req)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResult))
+			if resp.StatusCode/100 != 2 {
+				return string(body), fmt.Errorf("POST %s: %s", url, resp.Status)
+			}
+			return string(body), nil
+		case len(cmd) > 0:
+			c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+			c.Stdin = bytes.NewReader(j.Payload)
+			c.Env = append(c.Environ(), "JOB_ID="+j.ID, fmt.Sprintf("JOB_ATTEMPT=%d", j.Attempts))
+			var out bytes.Buffer
+			c.Stdout, c.Stderr = &out, &out
+			err := c.Run()
+			res := out.String()
+			if len(res) > maxResult {
+				res = res[:maxResult]
+			}
+			return strings.TrimSpace(res), err
+		}
+		return "", fmt.Errorf("no handler: set JOB_HANDLER_URL or JOB_HANDLER_CMD, or pass callback_url")
+	}
+}
+
+// scheduler starts queued jobs while the power policy says ok, and jobs
+// whose deadline has passed regardless of power.
+type scheduler struct {
+	store       *store
+	decide      func() policy.Decision
+	exec        execFunc
+	timeout     time.Duration // per attempt
+	maxAttempts int
+	backoff     time.Duration // times the attempt number
+
+	slots chan struct{} // one per worker
+	wake  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newScheduler(st *store, decide func() policy.Decision, exec execFunc, workers int) *scheduler {
+	return &scheduler{
+		store:       st,
+		decide:      decide,
+		exec:        exec,
+		timeout:     5 * time.Minute,
+		maxAttempts: 3,
+		backoff:     30 * time.Second,
+		slots:       make(chan struct{}, max(workers, 1)),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// notify asks the loop for an early tick, e.g. after a new job came in.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop ticks every interval until ctx is done, then waits for running jobs.
+func (s *scheduler) loop(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-t.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// runs reports whether jobs may start under d: only when the policy says
+// ok, so neither a low battery nor a missing reading (whatever on_unknown
+// says) runs them before their deadline.
+func runs(d policy.Decision) bool { return d.OK() }
+
+// tick starts as many runnable jobs as there are free workers.
+func (s *scheduler) tick(ctx context.Context) {
+	now := time.Now()
+	var d policy.Decision
+	decided := false
+	for _, j := range s.store.list(Queued) {
+		if j.RetryAt != nil && now.Before(*j.RetryAt) {
+			continue
+		}
+		if !decided { // only ask for power when there is work
+			d, decided = s.decide(), true
+		}
+		forced := !runs(d) && j.due(now)
+		if !runs(d) && !forced {
+			continue
+		}
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return // all workers busy
+		}
+		started, err := s.store.update(j.ID, func(j *Job) bool {
+			if j.State != Queued { // cancelled meanwhile
+				return false
+			}
+			j.State, j.StartedAt, j.RetryAt = Running, &now, nil
+			j.Attempts++
+			j.Forced, j.PowerState = forced, d.State
+			return true
+		})
+		if err != nil || started.State != Running {
+			<-s.slots
+			if err != nil {
+				log.Printf("job %s: %v", j.ID, err)
+			}
+			continue
+		}
+		if forced {
+			log.Printf("job %s: deadline passed, running while %s", j.ID, d.State)
+		}
+		s.wg.Add(1)
+		go s.run(ctx, started)
+	}
+}
+
+func (s *scheduler) run(ctx context.Context, j Job) {
+	defer s.wg.Done()
+	defer func() { <-s.slots }()
+
+	runCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	res, err := s.exec(runCtx, j)
+	cancel()
+
+	now := time.Now()
+	_, uerr := s.store.update(j.ID, func(j *Job) bool {
+		j.Result = res
+		switch {
+		case err == nil:
+			j.State, j.FinishedAt, j.Error = Done, &now, ""
+		case ctx.Err() != nil: // shutting down: not the job's fault
+			j.State, j.StartedAt, j.Error = Queued, nil, "interrupted by shutdown"
+			j.Attempts--
+		case j.Attempts < s.maxAttempts:
+			retry := now.Add(time.Duration(j.Attempts) * s.backoff)
+			j.State, j.RetryAt, j.Error = Queued, &retry, err.Error()
+		default:
+			j.State, j.FinishedAt, j.Error = Failed, &now, err.Error()
+		}
+		return true
+	})
+	if uerr != nil {
+		log.Printf("job %s: %v", j.ID, uerr)
+	}
+	if err != nil {
+		log.Printf("job %s attempt %d: %v", j.ID, j.Attempts, err)
+	}
+	s.notify() // a worker is free
+}
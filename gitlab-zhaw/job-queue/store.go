@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Done      = "done"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// Job is a unit of deferred work. It is persisted as JSON, one file per job.
+type Job struct {
+	ID          string          `json:"id"`
+	State       string          `json:"state"`
+	Priority    int             `json:"priority"` // higher runs first
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	CallbackURL string          `json:"callback_url,omitempty"` // overrides the configured handler
+	Deadline    time.Time       `json:"deadline"`               // runs regardless of power after this
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	Attempts    int             `json:"attempts"`
+	RetryAt     *time.Time      `json:"retry_at,omitempty"` // earliest next attempt after a failure
+	Forced      bool            `json:"forced,omitempty"`   // last run started by the deadline, not by power
+	PowerState  string          `json:"power_state,omitempty"`
+	Result      string          `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// due reports whether the job's deadline has passed.
+func (j *Job) due(now time.Time) bool { return !j.Deadline.IsZero() && !now.Before(j.Deadline) }
+
+var errNotFound = errors.New("job not found")
+
+// store keeps jobs in memory and mirrors every change to dir, so queued
+// work survives restarts. Writes go through a temp file and rename.
+type store struct {
+	dir string
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// openStore loads the jobs in dir. Jobs that were running when the process
+// died are queued again.
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &store{dir: dir, jobs: map[string]*Job{}}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var j Job
+		if err := json.Unmarshal(b, &j); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if j.State == Running {
+			j.State, j.StartedAt = Queued, nil
+			if err := s.write(&j); err != nil {
+				return nil, err
+			}
+		}
+		s.jobs[j.ID] = &j
+	}
+	return s, nil
+}
+
+// add assigns an ID and persists j as queued.
+func (s *store) add(j Job) (Job, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Job{}, err
+	}
+	j.ID, j.State = hex.EncodeToString(id), Queued
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(&j); err != nil {
+		return Job{}, err
+	}
+	s.jobs[j.ID] = &j
+	return j, nil
+}
+
+func (s *store) get(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errNotFound
+	}
+	return *j, nil
+}
+
+// update applies fn to the job and persists it; fn returning false leaves
+// the job unchanged.
+func (s *store) update(id string, fn func(*Job) bool) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errNotFound
+	}
+	c := *j
+	if !fn(&c) {
+		return *j, nil
+	}
+	if err := s.write(&c); err != nil {
+		return *j, err
+	}
+	*j = c
+	return c, nil
+}
+
+// list returns the jobs in run order: priority, then deadline, then age.
+// An empty state matches all.
+func (s *store) list(state string) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if state == "" || j.State == state {
+			out = append(out, *j)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool {
+		a, b := out[i], out[k]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if !a.Deadline.Equal(b.Deadline) {
+			return a.Deadline.Before(b.Deadline)
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+	return out
+}
+
+// prune drops finished jobs older than keep.
+func (s *store) prune(keep time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > keep {
+			if err := os.Remove(s.path(id)); err == nil || errors.Is(err, os.ErrNotExist) {
+				delete(s.jobs, id)
+			}
+		}
+	}
+}
+
+// write must be called with s.mu held (or before the store is shared).
+func (s *store) write(j *Job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(j.ID))
+}
+
+func (s *store) path(id string) string {
+	return filepath.Join(s.dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
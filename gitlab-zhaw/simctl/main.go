@@ -0,0 +1,274 @@
+// simctl drives the battery-sim admin API on every node at once, e.g. to
+// demo how the functions react to a sudden drop:
+//
+//	simctl pin -for 5m battery_percent=10 is_charging=false
+//	simctl status
+//	simctl unpin
+//	simctl pause | resume | reset | state | params
+//	simctl faults -schedule 5xx@10m/1m latency=0.1,reset=0.02 | faults off
+//	simctl undervoltage -for 2m | undervoltage off | ambient 40 | power   (--thermal)
+//
+// Targets come from --targets (or $SIMCTL_TARGETS), a comma-separated list of
+// host:port or URLs, or with --kubectl from the nodes' internal IPs (the
+// simulator DaemonSet uses hostNetwork). The token comes from --token or
+// $BATTERY_SIM_ADMIN_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func main() {
+	fs := flag.NewFlagSet("simctl", flag.ExitOnError)
+	targets := fs.String("targets", os.Getenv("SIMCTL_TARGETS"), "comma-separated simulators, host:port or URL (default: $SIMCTL_TARGETS)")
+	kubectl := fs.Bool("kubectl", false, "target every node's internal IP, via kubectl get nodes")
+	port := fs.Int("port", 8080, "simulator port with --kubectl")
+	token := fs.String("token", os.Getenv("BATTERY_SIM_ADMIN_TOKEN"), "admin token (default: $BATTERY_SIM_ADMIN_TOKEN)")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: simctl [flags] status|power|params|state|pin|unpin|pause|resume|reset|faults|undervoltage|ambient [args]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	list := splitTargets(*targets)
+	if *kubectl {
+		ips, err := nodeIPs()
+		if err != nil {
+			fatalf("kubectl: %v", err)
+		}
+		for _, ip := range ips {
+			list = append(list, fmt.Sprintf("%s:%d", ip, *port))
+		}
+	}
+	if len(list) == 0 {
+		fatalf("no targets: use --targets, $SIMCTL_TARGETS or --kubectl")
+	}
+	req, err := buildRequest(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	failed := 0
+	for _, res := range fanOut(context.Background(), client, list, req, *token) {
+		if res.err != nil {
+			failed++
+			fmt.Printf("%s\tERROR %v\n", res.target, res.err)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", res.target, res.body)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "simctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// request is one admin call, sent to every target.
+type request struct {
+	method, path string
+	body         []byte
+	admin        bool // needs the token
+}
+
+func buildRequest(args []string) (request, error) {
+	if len(args) == 0 {
+		return request{}, errors.New("missing command")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "status", "params", "power":
+		return request{method: http.MethodGet, path: "/" + cmd}, nil
+	case "state":
+		return request{method: http.MethodGet, path: "/admin", admin: true}, nil
+	case "pause", "resume", "reset":
+		return request{method: http.MethodPost, path: "/admin/" + cmd, admin: true}, nil
+	case "unpin":
+		q := url.Values{"field": args}
+		return request{method: http.MethodDelete, path: "/admin/pin?" + q.Encode(), admin: true}, nil
+	case "faults":
+		if len(args) == 1 && args[0] == "off" {
+			return request{method: http.MethodDelete, path: "/admin/faults", admin: true}, nil
+		}
+		fs := flag.NewFlagSet("faults", flag.ContinueOnError)
+		schedule := fs.String("schedule", "", "fault windows, e.g. 5xx@10m/1m")
+		latency := fs.String("latency", "", "delay of the latency fault (simulator default 2s)")
+		staleBy := fs.String("stale-by", "", "age of the stale fault (simulator default 10m)")
+		if err := fs.Parse(args); err != nil {
+			return request{}, err
+		}
+		if fs.NArg() > 1 || (fs.NArg() == 0 && *schedule == "") {
+			return request{}, errors.New("faults: want kind=probability,... and/or -schedule, or off")
+		}
+		b, _ := json.Marshal(map[string]string{
+			"probabilities": fs.Arg(0),
+			"schedule":      *schedule,
+			"latency":       *latency,
+			"stale_by":      *staleBy,
+		})
+		return request{method: http.MethodPost, path: "/admin/faults", body: b, admin: true}, nil
+	case "undervoltage":
+		if len(args) == 1 && args[0] == "off" {
+			return request{method: http.MethodDelete, path: "/admin/undervoltage", admin: true}, nil
+		}
+		fs := flag.NewFlagSet("undervoltage", flag.ContinueOnError)
+		dur := fs.Duration("for", 0, "then the supply recovers (default: until \"undervoltage off\")")
+		if err := fs.Parse(args); err != nil {
+			return request{}, err
+		}
+		body := map[string]string{}
+		if *dur > 0 {
+			body["for"] = dur.String()
+		}
+		b, _ := json.Marshal(body)
+		return request{method: http.MethodPost, path: "/admin/undervoltage", body: b, admin: true}, nil
+	case "ambient":
+		var c float64
+		if len(args) != 1 {
+			return request{}, errors.New("ambient: want the temperature in °C")
+		}
+		if _, err := fmt.Sscan(args[0], &c); err != nil {
+			return request{}, fmt.Errorf("ambient: %q: want °C", args[0])
+		}
+		b, _ := json.Marshal(map[string]float64{"ambient_c": c})
+		return request{method: http.MethodPost, path: "/admin/ambient", body: b, admin: true}, nil
+	case "pin":
+		fs := flag.NewFlagSet("pin", flag.ContinueOnError)
+		dur := fs.Duration("for", 0, "timed override, then the model resumes (default: until unpin)")
+		if err := fs.Parse(args); err != nil {
+			return request{}, err
+		}
+		body, err := pinBody(fs.Args(), *dur)
+		if err != nil {
+			return request{}, err
+		}
+		return request{method: http.MethodPost, path: "/admin/pin", body: body, admin: true}, nil
+	}
+	return request{}, fmt.Errorf("unknown command %q", cmd)
+}
+
+// pinBody turns field=value pairs into the /admin/pin body; values are
+// JSON (10, true) or else strings (day).
+func pinBody(pairs []string, dur time.Duration) ([]byte, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("pin: want field=value, e.g. battery_percent=10")
+	}
+	body := map[string]any{}
+	for _, kv := range pairs {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("pin: %q: want field=value", kv)
+		}
+		var val any
+		if err := json.Unmarshal([]byte(v), &val); err != nil {
+			val = v
+		}
+		body[k] = val
+	}
+	if dur > 0 {
+		body["for"] = dur.String()
+	}
+	return json.Marshal(body)
+}
+
+type result struct {
+	target string
+	body   string
+	err    error
+}
+
+// fanOut sends req to all targets in parallel; results are in target order.
+func fanOut(ctx context.Context, client *http.Client, targets []string, req request, token string) []result {
+	results := make([]result, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := send(ctx, client, t, req, token)
+			results[i] = result{target: t, body: body, err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func send(ctx context.Context, client *http.Client, target string, req request, token string) (string, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = strings.NewReader(string(req.body))
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, baseURL(target)+req.path, body)
+	if err != nil {
+		return "", err
+	}
+	if req.body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if req.admin {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	out := strings.TrimSpace(string(b))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, out)
+	}
+	return out, nil
+}
+
+func baseURL(target string) string {
+	if strings.Contains(target, "://") {
+		return strings.TrimSuffix(target, "/")
+	}
+	return "http://" + target
+}
+
+func splitTargets(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// nodeIPs lists the nodes' internal IPs.
+func nodeIPs() ([]string, error) {
+	out, err := exec.Command("kubectl", "get", "nodes", "-o",
+		`jsonpath={range .items[*]}{.status.addresses[?(@.type=="InternalIP")].address}{"\n"}{end}`).Output()
+	if err != nil {
+		return nil, err
+	}
+	ips := strings.Fields(string(out))
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRequest(t *testing.T) {
+	req, err := buildRequest([]string{"pin", "-for", "5m", "battery_percent=10", "is_charging=false", "time_of_day=night"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	json.Unmarshal(req.body, &body)
+	if req.method != "POST" || req.path != "/admin/pin" || !req.admin ||
+		body["battery_percent"] != 10.0 || body["is_charging"] != false || body["time_of_day"] != "night" || body["for"] != "5m0s" {
+		t.Fatalf("pin: %+v %v", req, body)
+	}
+	if req, _ := buildRequest([]string{"unpin", "is_charging"}); req.method != "DELETE" || req.path != "/admin/pin?field=is_charging" {
+		t.Fatalf("unpin: %+v", req)
+	}
+	if req, _ := buildRequest([]string{"status"}); req.admin || req.path != "/status" {
+		t.Fatalf("status: %+v", req)
+	}
+	if req, _ := buildRequest([]string{"undervoltage", "-for", "2m"}); req.path != "/admin/undervoltage" || string(req.body) != `{"for":"2m0s"}` {
+		t.Fatalf("undervoltage: %+v", req)
+	}
+	if req, _ := buildRequest([]string{"undervoltage", "off"}); req.method != "DELETE" {
+		t.Fatalf("undervoltage off: %+v", req)
+	}
+	if req, _ := buildRequest([]string{"ambient", "38.5"}); string(req.body) != `{"ambient_c":38.5}` {
+		t.Fatalf("ambient: %+v", req)
+	}
+	req, _ = buildRequest([]string{"faults", "-schedule", "5xx@10m/1m", "-stale-by", "1h", "latency=0.1,reset=0.02"})
+	body = nil
+	json.Unmarshal(req.body, &body)
+	if req.method != "POST" || req.path != "/admin/faults" || !req.admin ||
+		body["probabilities"] != "latency=0.1,reset=0.02" || body["schedule"] != "5xx@10m/1m" || body["stale_by"] != "1h" {
+		t.Fatalf("faults: %+v %v", req, body)
+	}
+	if req, _ := buildRequest([]string{"faults", "off"}); req.method != "DELETE" || req.path != "/admin/faults" {
+		t.Fatalf("faults off: %+v", req)
+	}
+	for _, bad := range [][]string{nil, {"explode"}, {"pin"}, {"pin", "battery_percent"}, {"ambient", "warm"}, {"faults"}, {"faults", "a=1", "b=2"}} {
+		if _, err := buildRequest(bad); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var got []string
+	sim := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, r.Method+" "+r.URL.Path+" "+string(b))
+		w.Write([]byte(`{"paused":true}` + "\n"))
+	}))
+	defer sim.Close()
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	client := &http.Client{Timeout: time.Second}
+	req, _ := buildRequest([]string{"pause"})
+	res := fanOut(context.Background(), client, []string{strings.TrimPrefix(sim.URL, "http://"), down.URL}, req, "tok")
+	if res[0].err != nil || res[0].body != `{"paused":true}` || res[1].err == nil {
+		t.Fatalf("results: %+v", res)
+	}
+	if len(got) != 1 || got[0] != "POST /admin/pause " {
+		t.Fatalf("simulator saw %q", got)
+	}
+	if res := fanOut(context.Background(), client, []string{sim.URL}, req, "wrong"); res[0].err == nil || !strings.Contains(res[0].err.Error(), "401") {
+		t.Fatalf("wrong token: %+v", res)
+	}
+}
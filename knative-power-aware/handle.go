@@ -3,11 +3,18 @@ package function
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"sync"
 	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermetrics"
+	"powerkit/powermw"
 )
 
 type Power struct {
@@ -18,54 +25,97 @@ type Power struct {
 	Undervoltage bool      `json:"undervoltage"`
 	FreqCapped   bool      `json:"freq_capped"`
 	Throttled    bool      `json:"throttled"`
+	Stale        bool      `json:"stale"` // power-agent no longer trusts its sample
 	LastError    string    `json:"last_error,omitempty"`
 }
 
-var (
-	powerURL string
-	cli      = &http.Client{Timeout: 600 * time.Millisecond}
+// power serves the last power-agent reading without waiting on the
+// network and refreshes it in the background once older than 5s.
+var power *powerclient.Client[Power]
 
-	mu      sync.Mutex
-	cache   Power
-	cacheAt time.Time
-	ttl     = 5 * time.Second
-)
+// pol decides when the node counts as degraded (see package policy for the
+// POWER_POLICY_* variables); the default is the thermal policy.
+var pol = loadPolicy()
+
+// metrics is served on /metrics (see package powermetrics).
+var metrics = powermetrics.New(powermetrics.Config{
+	Policy:  pol,
+	Source:  scrapeInfo,
+	Stats:   func() powerclient.Stats { return power.Stats() },
+	Signals: []string{"temp_c", "volt_v", "clock_arm_mhz", "throttled"},
+})
+
+func loadPolicy() *policy.Policy {
+	p, err := policy.Load(policy.Thermal)
+	if err != nil {
+		log.Fatalf("power policy: %v", err)
+	}
+	return p
+}
+
+func (p Power) reading() policy.Reading {
+	return policy.Reading{
+		TempC:        p.TempC,
+		VoltV:        p.VoltV,
+		ClockArmMHz:  p.ClockArmMHz,
+		Undervoltage: p.Undervoltage,
+		FreqCapped:   p.FreqCapped,
+		Throttled:    p.Throttled,
+	}
+}
 
 func init() {
 	// Prefer explicit URL, else build from HOST_IP
-	powerURL = os.Getenv("POWER_API_URL")
+	powerURL := os.Getenv("POWER_API_URL")
 	if powerURL == "" {
 		if host := os.Getenv("HOST_IP"); host != "" {
 			powerURL = "http://" + host + ":8085/power"
 		}
 	}
+	power = powerclient.New[Power](powerURL, 600*time.Millisecond, 5*time.Second).OnFetch(metrics.ObserveFetch)
 }
 
-func getPower() (Power, error) {
-	mu.Lock()
-	defer mu.Unlock()
-	if time.Since(cacheAt) < ttl && cache.Timestamp.Unix() != 0 {
-		return cache, nil
-	}
-	if powerURL == "" {
-		return Power{LastError: "POWER_API_URL/HOST_IP not set"}, nil
+// getPower returns the cached reading; a fetch error is copied into
+// LastError next to the last good values.
+func getPower() powerclient.Snapshot[Power] { return observed(power.Get()) }
+
+// peekPower is getPower for /metrics scrapes, which must not count as
+// cache lookups (see powerclient.Client.Peek).
+func peekPower() powerclient.Snapshot[Power] { return observed(power.Peek()) }
+
+// observed feeds the temperature trend and copies a fetch error into
+// LastError.
+func observed(s powerclient.Snapshot[Power]) powerclient.Snapshot[Power] {
+	if s.HasValue() {
+		temps.add(s.Value)
 	}
-	req, _ := http.NewRequest("GET", powerURL, nil)
-	resp, err := cli.Do(req)
-	if err != nil {
-		cache = Power{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+	if s.Err != nil {
+		s.Value.LastError = s.Err.Error()
 	}
-	defer resp.Body.Close()
-	var p Power
-	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
-		cache = Power{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+	return s
+}
+
+// currentReading is the reading for /policy/evaluate, with why it can't be
+// trusted, like currentInfo.
+func currentReading() (policy.Reading, string) {
+	info := currentInfo()
+	return info.Reading, info.Unknown
+}
+
+// currentInfo is the middleware's source; missing, old or stale readings
+// make the state unknown.
+func currentInfo() powermw.Info { return infoOf(getPower()) }
+
+// scrapeInfo is currentInfo for the /metrics gauges.
+func scrapeInfo() powermw.Info { return infoOf(peekPower()) }
+
+func infoOf(s powerclient.Snapshot[Power]) powermw.Info {
+	// tolerate errors; LastError will be set
+	_, unknown := s.Usable(3 * power.TTL())
+	if unknown == "" && s.Value.Stale {
+		unknown = "power-agent reports a stale sample"
 	}
-	cache, cacheAt = p, time.Now()
-	return p, nil
+	return powermw.Info{Power: s.Value, Reading: s.Value.reading(), Age: s.Age, Fresh: s.Fresh, Err: s.Err, Unknown: unknown}
 }
 
 // Handle an HTTP Request.
@@ -76,8 +126,43 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 	 * Try running `go test`.  Add more test as you code in `handle_test.go`.
 	 */
 
-	p, _ := getPower() // tolerate errors; LastError will be set
-	degraded := p.Undervoltage || p.FreqCapped || p.Throttled || p.TempC > 70.0
+	switch r.URL.Path {
+	case "/policy/evaluate":
+		policy.EvaluateHandler(pol, currentReading, policy.EvalDebugFromEnv(os.Getenv))(w, r)
+		return
+	case "/metrics":
+		metrics.Handler()(w, r)
+		return
+	}
+
+	handler().ServeHTTP(w, r)
+}
+
+// chain is the instrumented middleware around respond, built on first use
+// from pol and shed; tests that swap those reset chainOnce.
+var (
+	chain     http.Handler
+	chainOnce sync.Once
+)
+
+func handler() http.Handler {
+	chainOnce.Do(func() {
+		chain = metrics.Instrument(powermw.New(powermw.Config{
+			Policy:     pol,
+			Source:     currentInfo,
+			Shed:       shed.enabled,
+			Allow:      shed.allow,
+			RetryAfter: shed.retryAfter,
+		})(http.HandlerFunc(respond)))
+	})
+	return chain
+}
+
+// respond echoes the request together with the power state attached by the
+// middleware.
+func respond(w http.ResponseWriter, r *http.Request) {
+	info, _ := powermw.FromContext(r.Context())
+	p, _ := info.Power.(Power)
 
 	dump, err := httputil.DumpRequest(r, true)
 	if err != nil {
@@ -87,9 +172,13 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]any{
-		"degraded": degraded,
-		"power":    p,
-		"request":  string(dump),
+		"degraded":    info.Degraded(),
+		"state":       info.Decision.State,
+		"reasons":     info.Decision.Reasons,
+		"power":       p,
+		"power_age_s": math.Round(info.Age.Seconds()*10) / 10,
+		"power_fresh": info.Fresh,
+		"request":     string(dump),
 	})
 
 	fmt.Println("Received request")
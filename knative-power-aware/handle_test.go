@@ -1,9 +1,19 @@
 package function
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermw"
+	"powerkit/powertest"
 )
 
 // TestHandle ensures that Handle executes without error and returns the
@@ -23,3 +33,207 @@ func TestHandle(t *testing.T) {
 		t.Fatalf("unexpected response code: %v", res.StatusCode)
 	}
 }
+
+// servePower points the function at a fake power-agent returning p.
+func servePower(t *testing.T, p Power) {
+	t.Helper()
+	usePower(t, powertest.New(t, powertest.JSON(p)), time.Second)
+	if err := power.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// usePower points the function at srv until the test ends.
+func usePower(t *testing.T, srv *powertest.Server, timeout time.Duration) {
+	t.Helper()
+	old := power
+	power = powerclient.New[Power](srv.URL, timeout, time.Minute)
+	t.Cleanup(func() { power = old })
+}
+
+// rebuild makes the next request build the middleware chain from the
+// current pol and shed, and the first one after the test from the restored
+// ones.
+func rebuild(t *testing.T) {
+	t.Helper()
+	chainOnce = sync.Once{}
+	t.Cleanup(func() { chainOnce = sync.Once{} })
+}
+
+// TestHandleShed ensures that a degraded node sheds non-priority requests
+// with 503 and Retry-After when shedding is enabled.
+func TestHandleShed(t *testing.T) {
+	servePower(t, Power{Timestamp: time.Now(), TempC: 82})
+	old := shed
+	t.Setenv("SHED_ALLOW_PATHS", "/priority")
+	t.Setenv("SHED_ALLOW_HEADERS", "X-Priority=high")
+	shed = shedConfig{enabled: true, fixedRetry: 30, allow: powermw.AllowFromEnv(os.Getenv)}
+	defer func() { shed = old }()
+	rebuild(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{"shed", "/work", "", http.StatusServiceUnavailable},
+		{"priority path", "/priority/job", "", http.StatusOK},
+		{"priority header", "/work", "high", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Priority", tt.header)
+			}
+			Handle(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("unexpected response code: %v", w.Code)
+			}
+			if tt.want == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "30" {
+				t.Fatalf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// TestHandleUnknown ensures that an unreachable power-agent yields the
+// unknown state, which is only shed with a fail-closed policy.
+func TestHandleUnknown(t *testing.T) {
+	oldPower, oldPol, oldShed := power, pol, shed
+	defer func() { power, pol, shed = oldPower, oldPol, oldShed }()
+	power = powerclient.New[Power]("", time.Second, time.Minute)
+	shed = shedConfig{enabled: true, fixedRetry: 10}
+
+	for _, tt := range []struct {
+		onUnknown string
+		want      int
+	}{{"open", http.StatusOK}, {"closed", http.StatusServiceUnavailable}} {
+		p := policy.Thermal
+		p.OnUnknown = tt.onUnknown
+		if err := p.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		pol = &p
+		rebuild(t)
+
+		w := httptest.NewRecorder()
+		Handle(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Code != tt.want || w.Header().Get("X-Power-State") != policy.Unknown {
+			t.Fatalf("on_unknown=%s: status %d state %q, want %d unknown",
+				tt.onUnknown, w.Code, w.Header().Get("X-Power-State"), tt.want)
+		}
+	}
+}
+
+// TestHandleScenarios walks the fake power-agent through scripted node
+// states; each step refreshes the reading once and sends one request.
+func TestHandleScenarios(t *testing.T) {
+	oldPol, oldShed := pol, shed
+	defer func() { pol, shed = oldPol, oldShed }()
+	p := policy.Thermal
+	pol = &p
+	shed = shedConfig{enabled: true, fixedRetry: 15}
+	rebuild(t)
+
+	type step struct {
+		resp  powertest.Response
+		state string
+	}
+	stale := powertest.Cool()
+	stale.Stale = true
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"cool, throttled, recovered", []step{
+			{powertest.JSON(powertest.Cool()), policy.OK},
+			{powertest.JSON(powertest.Hot()), "degraded"},
+			{powertest.JSON(powertest.Throttled()), "degraded"},
+			{powertest.JSON(powertest.Cool()), policy.OK},
+		}},
+		{"undervoltage", []step{{powertest.JSON(powertest.Undervolted()), "degraded"}}},
+		{"agent down", []step{{powertest.Down(), policy.Unknown}}},
+		{"server error", []step{{powertest.Status(http.StatusInternalServerError), policy.Unknown}}},
+		{"malformed JSON", []step{{powertest.Malformed(), policy.Unknown}}},
+		{"slow agent", []step{{powertest.Slow(time.Second, powertest.Cool()), policy.Unknown}}},
+		{"stale sample", []step{{powertest.JSON(stale), policy.Unknown}}},
+		{"down keeps the last reading", []step{
+			{powertest.JSON(powertest.Throttled()), "degraded"},
+			{powertest.Down(), "degraded"},
+			{powertest.Malformed(), "degraded"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := powertest.New(t)
+			usePower(t, srv, 200*time.Millisecond)
+			for i, st := range tt.steps {
+				srv.Set(st.resp)
+				_ = power.Refresh(context.Background())
+
+				w := httptest.NewRecorder()
+				Handle(w, httptest.NewRequest("GET", "http://example.com/work", nil))
+				want := http.StatusOK
+				if st.state == "degraded" {
+					want = http.StatusServiceUnavailable
+				}
+				if got := w.Header().Get("X-Power-State"); got != st.state || w.Code != want {
+					t.Fatalf("step %d: state %q status %d, want %q %d", i, got, w.Code, st.state, want)
+				}
+			}
+		})
+	}
+}
+
+// TestHandleMetrics ensures that requests show up on /metrics labelled by
+// the power decision, next to the last observed temperature.
+func TestHandleMetrics(t *testing.T) {
+	servePower(t, Power{Timestamp: time.Now(), TempC: 55.5})
+	Handle(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/work", nil))
+
+	w := httptest.NewRecorder()
+	Handle(w, httptest.NewRequest("GET", "http://example.com/metrics", nil))
+	for _, want := range []string{
+		`power_requests_total{state="ok",route="handler",code="200"} `,
+		`power_request_duration_seconds_count{state="ok"} `,
+		`power_reading{signal="temp_c"} 55.5`,
+		`power_api_cache_hit_ratio `,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("missing %q in\n%s", want, w.Body.String())
+		}
+	}
+}
+
+// TestParseShedConfig ensures that invalid SHED_* values fail instead of
+// silently falling back to the defaults.
+func TestParseShedConfig(t *testing.T) {
+	env := func(kv map[string]string) func(string) string {
+		return func(k string) string { return kv[k] }
+	}
+	c, err := parseShedConfig(env(map[string]string{"SHED_MODE": "true", "SHED_RETRY_AFTER": "trend", "SHED_RETRY_MAX": "60"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.enabled || c.fixedRetry != 0 || c.minRetry != 5 || c.maxRetry != 60 {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if c, _ := parseShedConfig(env(map[string]string{"SHED_RETRY_AFTER": "30"})); c.fixedRetry != 30 {
+		t.Fatalf("fixed retry: %+v", c)
+	}
+
+	for _, bad := range []map[string]string{
+		{"SHED_RETRY_AFTER": "30s"},
+		{"SHED_RETRY_AFTER": "0"},
+		{"SHED_RETRY_MIN": "-1"},
+		{"SHED_RETRY_MAX": "soon"},
+		{"SHED_RETRY_MIN": "30", "SHED_RETRY_MAX": "10"},
+	} {
+		if _, err := parseShedConfig(env(bad)); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+}
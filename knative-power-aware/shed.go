@@ -0,0 +1,144 @@
+package function
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"powerkit/powermw"
+)
+
+// Load shedding: with SHED_MODE=on, requests that arrive while the node is
+// degraded get 503 + Retry-After instead of the full payload, so the
+// activator/queue-proxy retries them on a healthier replica.
+//
+//	SHED_MODE          off (default) | on (also true, 1, shed)
+//	SHED_RETRY_AFTER   trend (default) | fixed seconds, e.g. "30"
+//	SHED_RETRY_MIN     lower bound for trend-based Retry-After in seconds (default 5)
+//	SHED_RETRY_MAX     upper bound, also used while still heating up (default 120)
+//	SHED_ALLOW_PATHS   comma-separated path prefixes that are never shed, e.g. "/healthz,/priority"
+//	SHED_ALLOW_HEADERS comma-separated "Header" or "Header=value" that mark priority requests
+type shedConfig struct {
+	enabled    bool
+	fixedRetry int // seconds; 0 means derive from the thermal trend
+	minRetry   int
+	maxRetry   int
+	allow      func(*http.Request) bool // priority traffic, see powermw.AllowFromEnv
+}
+
+var shed = loadShed()
+
+func loadShed() shedConfig {
+	c, err := parseShedConfig(os.Getenv)
+	if err != nil {
+		log.Fatalf("shed config: %v", err)
+	}
+	return c
+}
+
+// parseShedConfig reads the SHED_* variables; invalid values are errors
+// rather than falling back to the defaults.
+func parseShedConfig(getenv func(string) string) (shedConfig, error) {
+	c := shedConfig{
+		enabled:  powermw.ShedFromEnv(getenv),
+		minRetry: 5,
+		maxRetry: 120,
+		allow:    powermw.AllowFromEnv(getenv),
+	}
+	seconds := func(name string, dst *int) error {
+		v := getenv(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s: %q is not a positive number of seconds", name, v)
+		}
+		*dst = n
+		return nil
+	}
+	if v := getenv("SHED_RETRY_AFTER"); v != "trend" {
+		if err := seconds("SHED_RETRY_AFTER", &c.fixedRetry); err != nil {
+			return c, err
+		}
+	}
+	if err := seconds("SHED_RETRY_MIN", &c.minRetry); err != nil {
+		return c, err
+	}
+	if err := seconds("SHED_RETRY_MAX", &c.maxRetry); err != nil {
+		return c, err
+	}
+	if c.maxRetry < c.minRetry {
+		return c, fmt.Errorf("SHED_RETRY_MAX %d is below SHED_RETRY_MIN %d", c.maxRetry, c.minRetry)
+	}
+	return c, nil
+}
+
+// retryAfter returns the Retry-After in seconds. While the node is cooling
+// it estimates when the temperature falls below the limit; otherwise (still
+// heating, or degraded by flags only) it falls back to maxRetry.
+func (c shedConfig) retryAfter(info powermw.Info) int {
+	if c.fixedRetry > 0 {
+		return c.fixedRetry
+	}
+	p, _ := info.Power.(Power)
+	limit, hasLimit := pol.Limit("temp_c")
+	slope, ok := temps.slope()
+	if !hasLimit || !ok || slope >= 0 || p.TempC <= limit {
+		return c.maxRetry
+	}
+	secs := int(math.Ceil((p.TempC - limit) / -slope))
+	return min(max(secs, c.minRetry), c.maxRetry)
+}
+
+// tempHistory keeps recent temperature samples to estimate the thermal trend.
+type tempHistory struct {
+	mu      sync.Mutex
+	samples []tempSample
+}
+
+type tempSample struct {
+	at    time.Time
+	tempC float64
+}
+
+const trendWindow = 2 * time.Minute
+
+var temps tempHistory
+
+func (h *tempHistory) add(p Power) {
+	if p.Timestamp.IsZero() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.samples); n > 0 && !p.Timestamp.After(h.samples[n-1].at) {
+		return // same sample served from power-agent's cache
+	}
+	h.samples = append(h.samples, tempSample{at: p.Timestamp, tempC: p.TempC})
+	cut := 0
+	for cut < len(h.samples)-1 && p.Timestamp.Sub(h.samples[cut].at) > trendWindow {
+		cut++
+	}
+	h.samples = h.samples[cut:]
+}
+
+// slope returns the temperature change in °C per second across the window.
+func (h *tempHistory) slope() (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < 2 {
+		return 0, false
+	}
+	first, last := h.samples[0], h.samples[len(h.samples)-1]
+	dt := last.at.Sub(first.at).Seconds()
+	if dt <= 0 {
+		return 0, false
+	}
+	return (last.tempC - first.tempC) / dt, true
+}
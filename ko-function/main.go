@@ -5,13 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
 	"syscall"
 	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermetrics"
+	"powerkit/powermw"
+	"powerkit/readiness"
 )
 
 type Power struct {
@@ -22,62 +29,79 @@ type Power struct {
 	Undervoltage bool      `json:"undervoltage"`
 	FreqCapped   bool      `json:"freq_capped"`
 	Throttled    bool      `json:"throttled"`
+	Stale        bool      `json:"stale"` // power-agent no longer trusts its sample
 	LastError    string    `json:"last_error,omitempty"`
 }
 
-var (
-	powerURL string
-	cli      = &http.Client{Timeout: 600 * time.Millisecond}
-
-	mu      sync.Mutex
-	cache   Power
-	cacheAt time.Time
-	ttl     = 5 * time.Second
-)
+// power serves the last power-agent reading without waiting on the
+// network and refreshes it in the background once older than 5s.
+var power *powerclient.Client[Power]
+
+// source adapts power for the middleware; missing, old or stale readings
+// make the state unknown.
+var source powermw.Source
+
+// pol decides when the node counts as degraded (POWER_POLICY_*, see package
+// policy); the default is the thermal policy.
+var pol *policy.Policy
+
+func (p Power) reading() policy.Reading {
+	return policy.Reading{
+		TempC:        p.TempC,
+		VoltV:        p.VoltV,
+		ClockArmMHz:  p.ClockArmMHz,
+		Undervoltage: p.Undervoltage,
+		FreqCapped:   p.FreqCapped,
+		Throttled:    p.Throttled,
+	}
+}
 
 func init() {
 	// Prefer explicit URL, else build from HOST_IP
-	powerURL = os.Getenv("POWER_API_URL")
+	powerURL := os.Getenv("POWER_API_URL")
 	if powerURL == "" {
 		if host := os.Getenv("HOST_IP"); host != "" {
 			powerURL = "http://" + host + ":8085/power"
 		}
 	}
+	power = powerclient.New[Power](powerURL, 600*time.Millisecond, 5*time.Second)
+	source = newSource(powermw.FromClient(power, Power.reading))
 }
 
-func getPower() (Power, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if time.Since(cacheAt) < ttl && !cache.Timestamp.IsZero() {
-		return cache, nil
-	}
-	if powerURL == "" {
-		return Power{LastError: "POWER_API_URL/HOST_IP not set"}, nil
-	}
-
-	req, _ := http.NewRequest("GET", powerURL, nil)
-	resp, err := cli.Do(req)
-	if err != nil {
-		cache = Power{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+// newSource wraps a client source for the middleware or metrics; stale
+// samples count as unknown.
+func newSource(fromClient powermw.Source) powermw.Source {
+	return func() powermw.Info {
+		info := fromClient()
+		if p, _ := info.Power.(Power); info.Unknown == "" && p.Stale {
+			info.Unknown = "power-agent reports a stale sample"
+		}
+		return info
 	}
-	defer resp.Body.Close()
+}
 
-	var p Power
-	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
-		cache = Power{LastError: err.Error()}
-		cacheAt = time.Now()
-		return cache, nil
+// getPower returns the cached reading; a fetch error is copied into
+// LastError next to the last good values.
+func getPower() powerclient.Snapshot[Power] {
+	s := power.Get()
+	if s.Err != nil {
+		s.Value.LastError = s.Err.Error()
 	}
-	cache, cacheAt = p, time.Now()
-	return p, nil
+	return s
 }
 
+// Handle reports the power state that the power middleware attached to the
+// request (see package powermw).
 func Handle(w http.ResponseWriter, r *http.Request) {
-	p, _ := getPower() // tolerate errors; LastError will be set
-	degraded := p.Undervoltage || p.FreqCapped || p.Throttled || p.TempC > 70.0
+	info, ok := powermw.FromContext(r.Context())
+	if !ok { // not behind the middleware
+		info = source()
+		info.Decision = powermw.Decide(pol, info)
+	}
+	p, _ := info.Power.(Power)
+	if info.Err != nil {
+		p.LastError = info.Err.Error() // tolerate errors; report them next to the data
+	}
 
 	// Dump the request for debugging (to logs, not to the client).
 	if dump, err := httputil.DumpRequest(r, true); err == nil {
@@ -88,17 +112,63 @@ func Handle(w http.ResponseWriter, r *http.Request) {
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	_ = enc.Encode(map[string]any{
-		"degraded": degraded,
-		"power":    p,
+		"degraded":    info.Degraded(),
+		"state":       info.Decision.State,
+		"reasons":     info.Decision.Reasons,
+		"power":       p,
+		"power_age_s": math.Round(info.Age.Seconds()*10) / 10,
+		"power_fresh": info.Fresh,
 		"server": map[string]any{
 			"time": time.Now().UTC(),
 		},
 	})
 }
 
-// health/readiness endpoints (handy for k8s)
+// health endpoint (handy for k8s); /readyz is served by the readiness gate
 func healthz(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
-func readyz(w http.ResponseWriter, _ *http.Request)  { w.WriteHeader(http.StatusOK) }
+
+// retryAfterFromEnv reads SHED_RETRY_AFTER, the Retry-After seconds for
+// shed requests in both modes (default 30).
+func retryAfterFromEnv() (func(powermw.Info) int, error) {
+	secs := 30
+	if v := os.Getenv("SHED_RETRY_AFTER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("SHED_RETRY_AFTER: %q is not a positive number of seconds", v)
+		}
+		secs = n
+	}
+	return func(powermw.Info) int { return secs }, nil
+}
+
+// currentDecision evaluates the policy against the cached power reading.
+func currentDecision() policy.Decision {
+	return powermw.Decide(pol, source())
+}
+
+// routes serves the function's endpoints at the root, or in proxy mode
+// under the admin prefix with everything else going to the proxy.
+func routes(proxyCfg *proxyConfig, mw powermw.Config, metrics *powermetrics.Metrics, gate *readiness.Gate) *http.ServeMux {
+	mux := http.NewServeMux()
+	admin := "/"
+	if proxyCfg != nil {
+		// sidecar/gateway: the upstream's own /metrics, /healthz etc. are proxied too
+		admin = proxyCfg.adminPrefix
+		mux.Handle("/", metrics.Instrument(newPowerProxy(proxyCfg, mw)))
+		mux.Handle(admin+"state", powermw.New(powermw.Config{Policy: pol, Source: source})(http.HandlerFunc(Handle)))
+	} else {
+		mux.Handle("/", metrics.Instrument(powermw.New(mw)(http.HandlerFunc(Handle))))
+	}
+	mux.Handle(admin+"metrics", metrics.Handler())
+	mux.HandleFunc(admin+"healthz", healthz)
+	mux.HandleFunc(admin+"readyz", gate.Handler(currentDecision))
+	// POLICY_EVAL_DEBUG=1 also lets clients test their own expressions
+	mux.HandleFunc(admin+"policy/evaluate", policy.EvaluateHandler(pol, func() (policy.Reading, string) {
+		info := source()
+		return info.Reading, info.Unknown
+	}, policy.EvalDebugFromEnv(os.Getenv)))
+	return mux
+}
 
 func main() {
 	port := os.Getenv("PORT")
@@ -106,14 +176,54 @@ func main() {
 		port = "8080"
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", Handle)
-	mux.HandleFunc("/healthz", healthz)
-	mux.HandleFunc("/readyz", readyz)
+	var err error
+	if pol, err = policy.Load(policy.Thermal); err != nil {
+		log.Fatalf("power policy: %v", err)
+	}
+
+	// READYZ_POWER_AWARE=on fails /readyz while degraded (see package readiness)
+	gate, err := readiness.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCfg, err := loadProxyConfig()
+	if err != nil {
+		log.Fatalf("proxy config: %v", err)
+	}
+	retryAfter, err := retryAfterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// request and power API metrics on /metrics (see package powermetrics)
+	metrics := powermetrics.New(powermetrics.Config{
+		Policy:  pol,
+		Source:  newSource(powermw.PeekClient(power, Power.reading)), // scrapes aren't cache lookups
+		Stats:   power.Stats,
+		Signals: []string{"temp_c", "volt_v", "clock_arm_mhz", "throttled"},
+	})
+	power.OnFetch(metrics.ObserveFetch)
+
+	// SHED_MODE=on answers degraded requests with 503 (SHED_ALLOW_* pass through)
+	mw := powermw.Config{
+		Policy:     pol,
+		Source:     source,
+		Shed:       powermw.ShedFromEnv(os.Getenv),
+		RetryAfter: retryAfter,
+		Allow:      powermw.AllowFromEnv(os.Getenv),
+	}
+
+	// warm the cache so the first requests already see a reading
+	go func() { _ = power.Refresh(context.Background()) }()
+
+	if proxyCfg != nil {
+		log.Printf("proxy mode: upstream=%s degraded action=%s admin=%s", proxyCfg.upstream, proxyCfg.action, proxyCfg.adminPrefix)
+	}
 
 	srv := &http.Server{
 		Addr:              ":" + port,
-		Handler:           mux,
+		Handler:           routes(proxyCfg, mw, metrics, gate),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermetrics"
+	"powerkit/powermw"
+	"powerkit/powertest"
+	"powerkit/readiness"
+)
+
+// usePower points the function at srv with the thermal policy until the
+// test ends.
+func usePower(t *testing.T, srv *powertest.Server) {
+	t.Helper()
+	oldPower, oldSource, oldPol := power, source, pol
+	power = powerclient.New[Power](srv.URL, 200*time.Millisecond, time.Minute)
+	source = newSource(powermw.FromClient(power, Power.reading))
+	p := policy.Thermal
+	pol = &p
+	t.Cleanup(func() { power, source, pol = oldPower, oldSource, oldPol })
+}
+
+// TestHandleScenarios walks the fake power-agent through scripted node
+// states and checks the report and shedding of the middleware-wrapped Handle.
+func TestHandleScenarios(t *testing.T) {
+	stale := powertest.Cool()
+	stale.Stale = true
+	tests := []struct {
+		name   string
+		script []powertest.Response
+		states []string // one request per step
+	}{
+		{"cool, throttled, recovered", []powertest.Response{
+			powertest.JSON(powertest.Cool()),
+			powertest.JSON(powertest.Throttled()),
+			powertest.JSON(powertest.Cool()),
+		}, []string{policy.OK, "degraded", policy.OK}},
+		{"agent down", []powertest.Response{powertest.Down()}, []string{policy.Unknown}},
+		{"malformed JSON", []powertest.Response{powertest.Malformed()}, []string{policy.Unknown}},
+		{"slow agent", []powertest.Response{powertest.Slow(time.Second, powertest.Cool())}, []string{policy.Unknown}},
+		{"stale sample", []powertest.Response{powertest.JSON(stale)}, []string{policy.Unknown}},
+		{"failure keeps the last reading", []powertest.Response{
+			powertest.JSON(powertest.Hot()),
+			powertest.Status(http.StatusBadGateway),
+		}, []string{"degraded", "degraded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := powertest.New(t, tt.script...)
+			usePower(t, srv)
+			h := powermw.New(powermw.Config{Policy: pol, Source: source, Shed: true})(http.HandlerFunc(Handle))
+
+			for i, want := range tt.states {
+				_ = power.Refresh(context.Background())
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+				if want == "degraded" {
+					if w.Code != http.StatusServiceUnavailable {
+						t.Fatalf("step %d: status %d, want 503", i, w.Code)
+					}
+					continue
+				}
+				var out struct {
+					State    string `json:"state"`
+					Degraded bool   `json:"degraded"`
+					Power    Power  `json:"power"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if out.State != want || out.Degraded {
+					t.Fatalf("step %d: state %q degraded %v, want %q", i, out.State, out.Degraded, want)
+				}
+				if want == policy.Unknown && out.Power.LastError == "" && !out.Power.Stale {
+					t.Fatalf("step %d: unknown state without an error", i)
+				}
+			}
+		})
+	}
+}
+
+// TestProxyScenarios checks the per-route degraded actions as the node
+// heats up and recovers.
+func TestProxyScenarios(t *testing.T) {
+	backend := func(name string) *url.URL {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		u, _ := url.Parse(s.URL)
+		return u
+	}
+	cfg := &proxyConfig{
+		upstream: backend("local"),
+		fallback: backend("cloud"),
+		action:   "fallback",
+		routes: []route{
+			{"/static/", "cache"},
+			{"/report", "lite"},
+			{"/batch", "shed"},
+		},
+		lite:        []byte(`{"lite":true}`),
+		liteType:    "application/json",
+		cacheMaxLen: 8,
+	}
+	srv := powertest.New(t)
+	usePower(t, srv)
+	pp := newPowerProxy(cfg, powermw.Config{
+		Policy:     pol,
+		Source:     source,
+		RetryAfter: func(powermw.Info) int { return 7 },
+		Allow:      func(r *http.Request) bool { return r.URL.Path == "/priority" },
+	})
+
+	tests := []struct {
+		node  powertest.Response
+		path  string
+		route string
+		body  string
+	}{
+		{powertest.JSON(powertest.Cool()), "/static/app.js", "upstream", "local/static/app.js"},
+		{powertest.JSON(powertest.Cool()), "/api/x", "upstream", "local/api/x"},
+		{powertest.JSON(powertest.Throttled()), "/api/x", "fallback", "cloud/api/x"},
+		{powertest.JSON(powertest.Throttled()), "/static/app.js", "cache", "local/static/app.js"},
+		{powertest.JSON(powertest.Throttled()), "/static/other.js", "shed", ""}, // cache miss
+		{powertest.JSON(powertest.Throttled()), "/report", "lite", `{"lite":true}`},
+		{powertest.JSON(powertest.Throttled()), "/batch/run", "shed", ""},
+		{powertest.JSON(powertest.Throttled()), "/priority", "upstream", "local/priority"},
+		{powertest.JSON(powertest.Cool()), "/batch/run", "upstream", "local/batch/run"},
+	}
+	for i, tt := range tests {
+		srv.Set(tt.node)
+		if err := power.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		pp.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Header().Get("X-Power-Route"); got != tt.route {
+			t.Fatalf("%d %s: route %q, want %q", i, tt.path, got, tt.route)
+		}
+		if got, want := w.Header().Get("X-Node-Degraded"), strconv.FormatBool(tt.route != "upstream" || tt.path == "/priority"); got != want {
+			t.Fatalf("%d %s: X-Node-Degraded %q, want %q", i, tt.path, got, want)
+		}
+		if tt.route == "shed" {
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "7" {
+				t.Fatalf("%d %s: status %d Retry-After %q", i, tt.path, w.Code, w.Header().Get("Retry-After"))
+			}
+			continue
+		}
+		if w.Body.String() != tt.body {
+			t.Fatalf("%d %s: body %q, want %q", i, tt.path, w.Body.String(), tt.body)
+		}
+	}
+}
+
+// TestProxyCache checks what the "cache" action may replay: keyed by the
+// client's URL under an upstream base path, never credentialed or private
+// responses, Vary honoured and no cookies handed out.
+func TestProxyCache(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/base/cookie":
+			w.Header().Set("Set-Cookie", "session=alice")
+		case "/base/vary":
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		_, _ = io.WriteString(w, r.URL.Path+" "+r.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(up.Close)
+	base, _ := url.Parse(up.URL + "/base")
+	srv := powertest.New(t)
+	usePower(t, srv)
+	pp := newPowerProxy(&proxyConfig{upstream: base, action: "cache", cacheMaxLen: 8}, powermw.Config{Policy: pol, Source: source})
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		pp.ServeHTTP(w, r)
+		return w
+	}
+	setNode := func(st powertest.Response) {
+		srv.Set(st)
+		if err := power.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setNode(powertest.JSON(powertest.Cool()))
+	get("/plain")
+	get("/private")
+	get("/cookie")
+	get("/auth", "Authorization", "Bearer alice")
+	get("/vary", "Accept-Language", "de")
+
+	setNode(powertest.JSON(powertest.Throttled()))
+	tests := []struct {
+		path, lang, route, body string
+	}{
+		{"/plain", "", "cache", "/base/plain "},
+		{"/private", "", "shed", ""},
+		{"/cookie", "", "shed", ""},
+		{"/auth", "", "shed", ""},
+		{"/vary", "de", "cache", "/base/vary de"},
+		{"/vary", "fr", "shed", ""},
+	}
+	for _, tt := range tests {
+		w := get(tt.path, "Accept-Language", tt.lang)
+		if got := w.Header().Get("X-Power-Route"); got != tt.route {
+			t.Fatalf("%s (%s): route %q, want %q", tt.path, tt.lang, got, tt.route)
+		}
+		if tt.route == "cache" && w.Body.String() != tt.body {
+			t.Fatalf("%s (%s): body %q, want %q", tt.path, tt.lang, w.Body.String(), tt.body)
+		}
+		if w.Header().Get("Set-Cookie") != "" {
+			t.Fatalf("%s: replayed Set-Cookie", tt.path)
+		}
+	}
+}
+
+// TestProxyStreams checks that without a "cache" route upstream responses
+// reach the client as they are written instead of being buffered.
+func TestProxyStreams(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "rest\n")
+	}))
+	t.Cleanup(up.Close)
+	u, _ := url.Parse(up.URL)
+	srv := powertest.New(t, powertest.JSON(powertest.Cool()))
+	usePower(t, srv)
+	_ = power.Refresh(context.Background())
+	front := httptest.NewServer(newPowerProxy(&proxyConfig{upstream: u, action: "shed", cacheMaxLen: 8}, powermw.Config{Policy: pol, Source: source}))
+	t.Cleanup(front.Close)
+	t.Cleanup(func() { close(release) }) // cleanups run last-in first-out
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(front.URL + "/stream")
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, len("first\n"))
+		_, _ = io.ReadFull(resp.Body, buf)
+		got <- string(buf)
+	}()
+	select {
+	case s := <-got:
+		if s != "first\n" {
+			t.Fatalf("first chunk %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first chunk held back until the upstream finished")
+	}
+}
+
+// TestProxyRoutes checks that proxy mode forwards everything, including the
+// upstream's own /metrics and /healthz, except the admin prefix.
+func TestProxyRoutes(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "upstream"+r.URL.Path)
+	}))
+	t.Cleanup(up.Close)
+	u, _ := url.Parse(up.URL)
+	srv := powertest.New(t, powertest.JSON(powertest.Cool()))
+	usePower(t, srv)
+	_ = power.Refresh(context.Background())
+	gate, err := readiness.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw := powermw.Config{Policy: pol, Source: source}
+	mux := routes(&proxyConfig{upstream: u, action: "shed", cacheMaxLen: 8, adminPrefix: "/_power/"},
+		mw, powermetrics.New(powermetrics.Config{Policy: pol, Source: source}), gate)
+
+	tests := []struct {
+		path string
+		code int
+		body string // prefix of the body
+	}{
+		{"/metrics", http.StatusOK, "upstream/metrics"},
+		{"/healthz", http.StatusOK, "upstream/healthz"},
+		{"/power-state", http.StatusOK, "upstream/power-state"},
+		{"/_power/healthz", http.StatusOK, ""},
+		{"/_power/readyz", http.StatusOK, ""},
+		{"/_power/metrics", http.StatusOK, "# HELP"},
+		{"/_power/state", http.StatusOK, "{"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || !strings.HasPrefix(w.Body.String(), tt.body) {
+			t.Fatalf("%s: %d %q, want %d %q...", tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+		if fromUpstream := strings.HasPrefix(w.Body.String(), "upstream"); fromUpstream == strings.HasPrefix(tt.path, "/_power/") {
+			t.Fatalf("%s: served by the wrong side: %q", tt.path, w.Body.String())
+		}
+	}
+}
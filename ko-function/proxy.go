@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"powerkit/powermw"
+)
+
+// Proxy mode turns the server into a power-aware sidecar/gateway. It is
+// enabled by UPSTREAM_URL. Every path is proxied, including the upstream's
+// own /metrics and /healthz, except the sidecar's endpoints, which move under
+// POWER_ADMIN_PREFIX: /_power/state (the power report), /_power/metrics,
+// /_power/healthz, /_power/readyz and /_power/policy/evaluate by default.
+//
+//	UPSTREAM_URL        local upstream that gets all traffic while the node is ok
+//	POWER_ADMIN_PREFIX  path prefix of the sidecar's endpoints (default /_power/)
+//	FALLBACK_URL        where "fallback" routes go while degraded, e.g. a cloud instance
+//	DEGRADED_ACTION     default action while degraded: fallback | cache | lite | shed | upstream
+//	                    (default fallback if FALLBACK_URL is set, else shed)
+//	ROUTE_POLICY        per-route actions by longest path prefix, e.g. "/api/=fallback,/static/=cache,/report=lite"
+//	LITE_RESPONSE       body served by "lite" (LITE_CONTENT_TYPE, default application/json)
+//	SHED_RETRY_AFTER    Retry-After seconds for "shed" (default 30)
+//	SHED_ALLOW_*        priority requests that go upstream even while degraded (see powermw.AllowFromEnv)
+//
+// The proxy sits behind the power middleware (package powermw), like the
+// plain function, so every response carries X-Power-State and
+// X-Node-Degraded and degraded requests take their route's action.
+//
+// "cache" serves the last successful upstream GET response for the URL and
+// sheds on a miss. Only shareable responses are kept: none to requests with
+// Authorization or Cookie, none marked private or no-store or setting a
+// cookie, and a Vary header must match. Every response carries X-Power-Route
+// with the path taken.
+type proxyConfig struct {
+	upstream    *url.URL
+	fallback    *url.URL
+	action      string
+	routes      []route // sorted by descending prefix length
+	lite        []byte
+	liteType    string
+	cacheMaxLen int
+	adminPrefix string // starts and ends with "/"
+}
+
+type route struct {
+	prefix string
+	action string
+}
+
+var validActions = map[string]bool{"fallback": true, "cache": true, "lite": true, "shed": true, "upstream": true}
+
+func loadProxyConfig() (*proxyConfig, error) {
+	up := os.Getenv("UPSTREAM_URL")
+	if up == "" {
+		return nil, nil
+	}
+	c := &proxyConfig{
+		liteType:    getenv("LITE_CONTENT_TYPE", "application/json"),
+		lite:        []byte(getenv("LITE_RESPONSE", `{"degraded":true,"lite":true}`)),
+		adminPrefix: getenv("POWER_ADMIN_PREFIX", "/_power/"),
+		cacheMaxLen: 256,
+	}
+	var err error
+	if c.upstream, err = url.Parse(up); err != nil {
+		return nil, fmt.Errorf("UPSTREAM_URL: %w", err)
+	}
+	if p := c.adminPrefix; len(p) < 3 || !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") {
+		return nil, fmt.Errorf("POWER_ADMIN_PREFIX: %q must look like /_power/", p)
+	}
+	c.action = "shed"
+	if fb := os.Getenv("FALLBACK_URL"); fb != "" {
+		if c.fallback, err = url.Parse(fb); err != nil {
+			return nil, fmt.Errorf("FALLBACK_URL: %w", err)
+		}
+		c.action = "fallback"
+	}
+	if a := os.Getenv("DEGRADED_ACTION"); a != "" {
+		c.action = a
+	}
+	for _, kv := range strings.Split(os.Getenv("ROUTE_POLICY"), ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		prefix, action, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("ROUTE_POLICY: %q is not prefix=action", kv)
+		}
+		c.routes = append(c.routes, route{prefix: strings.TrimSpace(prefix), action: strings.TrimSpace(action)})
+	}
+	sort.SliceStable(c.routes, func(i, j int) bool { return len(c.routes[i].prefix) > len(c.routes[j].prefix) })
+
+	for _, a := range append([]route{{"", c.action}}, c.routes...) {
+		if !validActions[a.action] {
+			return nil, fmt.Errorf("unknown degraded action %q", a.action)
+		}
+		if a.action == "fallback" && c.fallback == nil {
+			return nil, fmt.Errorf("action fallback needs FALLBACK_URL")
+		}
+	}
+	return c, nil
+}
+
+// actionFor returns the degraded action for a request path.
+func (c *proxyConfig) actionFor(path string) string {
+	for _, rt := range c.routes {
+		if strings.HasPrefix(path, rt.prefix) {
+			return rt.action
+		}
+	}
+	return c.action
+}
+
+// caches reports whether any route uses the "cache" action.
+func (c *proxyConfig) caches() bool {
+	if c.action == "cache" {
+		return true
+	}
+	for _, rt := range c.routes {
+		if rt.action == "cache" {
+			return true
+		}
+	}
+	return false
+}
+
+// powerProxy forwards to the upstream while healthy and applies the
+// configured degraded action otherwise.
+type powerProxy struct {
+	cfg      *proxyConfig
+	mw       powermw.Config
+	handler  http.Handler
+	upstream *httputil.ReverseProxy
+	fallback *httputil.ReverseProxy
+	cache    *responseCache
+}
+
+// newPowerProxy builds the proxy behind powermw.New(mw); the proxy takes
+// over mw's Reroute and sheds with mw's RetryAfter.
+func newPowerProxy(cfg *proxyConfig, mw powermw.Config) *powerProxy {
+	pp := &powerProxy{cfg: cfg, cache: newResponseCache(cfg.cacheMaxLen)}
+	mw.Shed, mw.Reroute = false, http.HandlerFunc(pp.degraded)
+	pp.mw = mw
+	pp.handler = powermw.New(mw)(http.HandlerFunc(pp.forward))
+	pp.upstream = newReverseProxy(cfg.upstream)
+	if cfg.caches() {
+		// storing buffers bodies, so only when a route can replay them
+		rewrite := pp.upstream.Rewrite
+		pp.upstream.Rewrite = func(pr *httputil.ProxyRequest) {
+			rewrite(pr)
+			// the cache is keyed by what clients ask for, not the upstream URL
+			pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), inboundKey{}, pr.In))
+		}
+		pp.upstream.ModifyResponse = pp.cache.store
+	}
+	if cfg.fallback != nil {
+		pp.fallback = newReverseProxy(cfg.fallback)
+	}
+	return pp
+}
+
+func newReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("proxy %s: %v", target.Host, err)
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		},
+	}
+}
+
+func (pp *powerProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pp.handler.ServeHTTP(w, r)
+}
+
+// forward serves healthy and priority requests from the upstream.
+func (pp *powerProxy) forward(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Power-Route", "upstream")
+	pp.upstream.ServeHTTP(w, r)
+}
+
+// degraded applies the route's action while the node is degraded.
+func (pp *powerProxy) degraded(w http.ResponseWriter, r *http.Request) {
+	info, _ := powermw.FromContext(r.Context())
+	action := pp.cfg.actionFor(r.URL.Path)
+	if action == "cache" {
+		if pp.cache.serve(w, r) {
+			return
+		}
+		action = "shed" // cache miss
+	}
+	w.Header().Set("X-Power-Route", action)
+
+	switch action {
+	case "upstream":
+		pp.upstream.ServeHTTP(w, r)
+	case "fallback":
+		pp.fallback.ServeHTTP(w, r)
+	case "lite":
+		w.Header().Set("Content-Type", pp.cfg.liteType)
+		_, _ = w.Write(pp.cfg.lite)
+	default:
+		pp.mw.ShedResponse(w, info)
+	}
+}
+
+// responseCache keeps the last successful upstream GET response per URL.
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]cachedResponse
+	order   []string // insertion order for eviction
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	vary   http.Header // request header values named by Vary
+}
+
+// inboundKey carries the client's request to ModifyResponse.
+type inboundKey struct{}
+
+const maxCachedBody = 1 << 20
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{max: max, entries: map[string]cachedResponse{}}
+}
+
+// store is the upstream proxy's ModifyResponse hook.
+func (c *responseCache) store(resp *http.Response) error {
+	in, _ := resp.Request.Context().Value(inboundKey{}).(*http.Request)
+	if in == nil || in.Method != http.MethodGet || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+	if !shareable(in, resp) || resp.ContentLength > maxCachedBody {
+		return nil
+	}
+	orig := resp.Body
+	body, err := io.ReadAll(io.LimitReader(orig, maxCachedBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxCachedBody {
+		// too large to cache: pass through what was read plus the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		return nil
+	}
+	_ = orig.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	vary := http.Header{}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary[http.CanonicalHeaderKey(name)] = in.Header.Values(name)
+			}
+		}
+	}
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+
+	key := in.URL.RequestURI()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = cachedResponse{status: resp.StatusCode, header: header, body: body, vary: vary}
+	for len(c.order) > c.max {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	return nil
+}
+
+// shareable reports whether resp may be replayed to other clients.
+func shareable(in *http.Request, resp *http.Response) bool {
+	if in.Header.Get("Authorization") != "" || in.Header.Get("Cookie") != "" || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "no-store" || d == "private" || strings.HasPrefix(d, "private=") {
+				return false
+			}
+		}
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.Contains(v, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[r.URL.RequestURI()]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for name, vs := range e.vary {
+		if strings.Join(r.Header.Values(name), ",") != strings.Join(vs, ",") {
+			return false
+		}
+	}
+	for k, vs := range e.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("X-Power-Route", "cache")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+	return true
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,35 @@
+#!/usr/bin/env python3
+"""Example power-agent collector plugin (JSON lines on stdout).
+
+Replace read_battery() with the real UPS HAT / USB meter driver call.
+"""
+import json
+import random
+import sys
+import time
+
+
+def send(msg):
+    sys.stdout.write(json.dumps(msg) + "\n")
+    sys.stdout.flush()
+
+
+def read_battery():
+    return {"battery_percent": round(random.uniform(40, 100), 1), "input_watts": round(random.uniform(3, 6), 2)}
+
+
+send({
+    "type": "hello",
+    "name": "ups",
+    "version": "0.1.0",
+    "capabilities": [
+        {"name": "battery_percent", "unit": "%"},
+        {"name": "input_watts", "unit": "W"},
+    ],
+})
+while True:
+    try:
+        send({"type": "sample", "values": read_battery()})
+    except Exception as e:  # report and keep going; the agent restarts us if we go silent
+        send({"type": "error", "message": str(e)})
+    time.sleep(5)
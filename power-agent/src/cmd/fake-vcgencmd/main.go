@@ -0,0 +1,222 @@
+// fake-vcgencmd stands in for the Raspberry Pi's vcgencmd off the Pi, so
+// power-agent can be run and tested end-to-end on amd64: build it as
+// "vcgencmd" and put it first on PATH.
+//
+//	go build -o /tmp/fakebin/vcgencmd ./cmd/fake-vcgencmd
+//	PATH=/tmp/fakebin:$PATH go run . --debug
+//
+// It answers the commands power-agent and its probes use, in the real
+// output format:
+//
+//	measure_temp           temp=48.7'C
+//	measure_volts [core]   volt=0.8600V
+//	measure_clock arm      frequency(48)=1800000000
+//	get_throttled          throttled=0x0
+//	get_config arm_freq    arm_freq=1800
+//
+// The readings come from a JSON state file ($FAKE_VCGENCMD_STATE), re-read on
+// every call so a test can change them between polls:
+//
+//	{"temp_c": 82.1, "volt_v": 0.8, "clock_arm_hz": 600000000, "throttled": "0x50005",
+//	 "clocks": {"core": 500000000}, "config": {"arm_freq": "1800"},
+//	 "fail": {"measure_temp": "vchi"}, "delay": "200ms"}
+//
+// and from environment variables, which win over the file:
+// FAKE_VCGENCMD_TEMP, _VOLTS, _CLOCK_HZ, _THROTTLED, _DELAY and _FAIL, the
+// latter either one mode for every command ("vchi") or per command
+// ("measure_temp=garbage,get_throttled=vchi"). Failure modes:
+//
+//	vchi      "VCHI initialization failed", exit status 255 (no /dev/vcio access)
+//	notreg    error=2 error_msg="Command not registered", exit status 255
+//	garbage   malformed output, exit status 0
+//	empty     no output, exit status 0
+//	hang      never answers, until killed (poll timeouts)
+//
+// With $FAKE_VCGENCMD_LOG set, every call is appended to that file, one line
+// each, so tests can count polls.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// state is the simulated firmware state.
+type state struct {
+	TempC      float64            `json:"temp_c"`
+	VoltV      float64            `json:"volt_v"`
+	ClockArmHz float64            `json:"clock_arm_hz"`
+	Clocks     map[string]float64 `json:"clocks,omitempty"` // other measure_clock sources
+	Throttled  string             `json:"throttled"`        // hex, as vcgencmd prints it
+	Config     map[string]string  `json:"config,omitempty"` // get_config values
+	Fail       map[string]string  `json:"fail,omitempty"`   // command (or "*") -> failure mode
+	Delay      string             `json:"delay,omitempty"`  // before every answer
+}
+
+// an idle Pi 4 at stock clocks
+func defaultState() state {
+	return state{
+		TempC: 48.7, VoltV: 0.86, ClockArmHz: 1.8e9, Throttled: "0x0",
+		Clocks: map[string]float64{"core": 500e6, "v3d": 500e6},
+		Config: map[string]string{"arm_freq": "1800"},
+	}
+}
+
+// clockIDs are the firmware clock ids printed by measure_clock.
+var clockIDs = map[string]int{"arm": 48, "core": 1, "h264": 28, "isp": 45, "v3d": 46, "uart": 22, "pwm": 25, "emmc": 50, "pixel": 29, "hdmi": 0}
+
+func main() {
+	args := os.Args[1:]
+	if p := os.Getenv("FAKE_VCGENCMD_LOG"); p != "" {
+		if f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			fmt.Fprintln(f, strings.Join(args, " "))
+			f.Close()
+		}
+	}
+	st, err := loadState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fake-vcgencmd: %v\n", err)
+		os.Exit(2)
+	}
+	if st.Delay != "" {
+		d, err := time.ParseDuration(st.Delay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake-vcgencmd: delay %q: %v\n", st.Delay, err)
+			os.Exit(2)
+		}
+		time.Sleep(d)
+	}
+
+	if len(args) == 0 {
+		fmt.Println(`error=1 error_msg="Command not supplied"`)
+		os.Exit(255)
+	}
+	cmd := args[0]
+	mode := st.Fail[cmd]
+	if mode == "" {
+		mode = st.Fail["*"]
+	}
+	switch mode {
+	case "":
+	case "vchi":
+		fmt.Fprintln(os.Stderr, "VCHI initialization failed")
+		os.Exit(255)
+	case "notreg":
+		fmt.Println(`error=2 error_msg="Command not registered"`)
+		os.Exit(255)
+	case "garbage":
+		fmt.Println(cmd + "=?!")
+		return
+	case "empty":
+		return
+	case "hang":
+		time.Sleep(24 * time.Hour)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "fake-vcgencmd: unknown failure mode %q\n", mode)
+		os.Exit(2)
+	}
+
+	out, ok := answer(st, cmd, args[1:])
+	if !ok {
+		fmt.Println(`error=2 error_msg="Command not registered"`)
+		os.Exit(255)
+	}
+	fmt.Println(out)
+}
+
+// answer formats the reply to one command like the real vcgencmd.
+func answer(st state, cmd string, args []string) (string, bool) {
+	switch cmd {
+	case "measure_temp":
+		return fmt.Sprintf("temp=%.1f'C", st.TempC), true
+	case "measure_volts":
+		return fmt.Sprintf("volt=%.4fV", st.VoltV), true
+	case "measure_clock":
+		src := "arm"
+		if len(args) > 0 {
+			src = args[0]
+		}
+		id, known := clockIDs[src]
+		if !known {
+			return "frequency(0)=0", true
+		}
+		hz := st.ClockArmHz
+		if src != "arm" {
+			hz = st.Clocks[src]
+		}
+		return fmt.Sprintf("frequency(%d)=%.0f", id, hz), true
+	case "get_throttled":
+		return "throttled=" + st.Throttled, true
+	case "get_config":
+		if len(args) == 0 {
+			return `error=1 error_msg="Command not supplied"`, true
+		}
+		v, ok := st.Config[args[0]]
+		if !ok {
+			v = "0"
+		}
+		return args[0] + "=" + v, true
+	}
+	return "", false
+}
+
+// loadState starts from the defaults, applies the state file and then the
+// environment overrides.
+func loadState() (state, error) {
+	st := defaultState()
+	if p := os.Getenv("FAKE_VCGENCMD_STATE"); p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return st, err
+		}
+		if err := json.Unmarshal(b, &st); err != nil {
+			return st, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	for _, f := range []struct {
+		env string
+		dst *float64
+	}{
+		{"FAKE_VCGENCMD_TEMP", &st.TempC},
+		{"FAKE_VCGENCMD_VOLTS", &st.VoltV},
+		{"FAKE_VCGENCMD_CLOCK_HZ", &st.ClockArmHz},
+	} {
+		v := os.Getenv(f.env)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return st, fmt.Errorf("%s=%q: want a number", f.env, v)
+		}
+		*f.dst = n
+	}
+	if v := os.Getenv("FAKE_VCGENCMD_THROTTLED"); v != "" {
+		if _, err := strconv.ParseUint(strings.TrimPrefix(v, "0x"), 16, 32); err != nil {
+			return st, fmt.Errorf("FAKE_VCGENCMD_THROTTLED=%q: want hex like 0x50005", v)
+		}
+		if !strings.HasPrefix(v, "0x") {
+			v = "0x" + v
+		}
+		st.Throttled = v
+	}
+	if v := os.Getenv("FAKE_VCGENCMD_DELAY"); v != "" {
+		st.Delay = v
+	}
+	if v := os.Getenv("FAKE_VCGENCMD_FAIL"); v != "" {
+		st.Fail = map[string]string{}
+		for _, kv := range strings.Split(v, ",") {
+			if k, mode, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+				st.Fail[k] = mode
+			} else {
+				st.Fail["*"] = k
+			}
+		}
+	}
+	return st, nil
+}
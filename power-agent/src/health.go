@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// healthConfig holds the thresholds behind the /power freshness fields and
+// the /healthz and /readyz probes.
+type healthConfig struct {
+	staleAfter      time.Duration
+	livenessTimeout time.Duration
+	maxFailures     int
+}
+
+// withFreshness fills in the age/stale fields of s relative to the last
+// successful poll.
+func withFreshness(s State, h pollHealth, staleAfter time.Duration) State {
+	if h.LastOK.IsZero() {
+		s.AgeSeconds = -1
+		s.Stale = true
+		return s
+	}
+	age := time.Since(h.LastOK)
+	s.LastSuccessAt = h.LastOK
+	s.AgeSeconds = math.Round(age.Seconds()*10) / 10
+	s.Stale = age > staleAfter
+	return s
+}
+
+// healthzHandler is the liveness probe: it only fails when the poller
+// goroutine stopped making progress (e.g. vcgencmd hangs past its timeout),
+// not when polls fail, since restarting the agent would not fix the firmware.
+func healthzHandler(c *cache, hc healthConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		if since := time.Since(h.Heartbeat); since > hc.livenessTimeout {
+			http.Error(w, fmt.Sprintf("poller stuck: no progress for %s", since.Round(time.Second)),
+				http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+// readyzHandler is the readiness probe: not ready until the first good
+// sample exists, and again after maxFailures consecutive failed polls.
+func readyzHandler(c *cache, hc healthConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		switch {
+		case h.LastOK.IsZero():
+			http.Error(w, "no successful poll yet", http.StatusServiceUnavailable)
+			return
+		case hc.maxFailures > 0 && h.Failures >= hc.maxFailures:
+			http.Error(w, fmt.Sprintf("%d consecutive failed polls", h.Failures), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}
+}
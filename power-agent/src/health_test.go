@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithFreshness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		lastOK time.Time
+		age    float64
+		stale  bool
+	}{
+		{"never polled", time.Time{}, -1, true},
+		{"fresh", now.Add(-2 * time.Second), 2, false},
+		{"at the threshold", now.Add(-14 * time.Second), 14, false},
+		{"past the threshold", now.Add(-16 * time.Second), 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := withFreshness(State{TempC: 50}, pollHealth{LastOK: tt.lastOK}, 15*time.Second)
+			if s.AgeSeconds != tt.age || s.Stale != tt.stale || s.TempC != 50 {
+				t.Fatalf("age %v stale %v, want %v %v", s.AgeSeconds, s.Stale, tt.age, tt.stale)
+			}
+			if !s.LastSuccessAt.Equal(tt.lastOK) {
+				t.Fatalf("last_success_at %v, want %v", s.LastSuccessAt, tt.lastOK)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	hc := healthConfig{livenessTimeout: time.Minute}
+	var c cache
+	if code := statusOf(healthzHandler(&c, hc)); code != http.StatusServiceUnavailable {
+		t.Fatalf("before the first round: %d, want 503", code)
+	}
+	c.Record(State{}, errors.New("vchi")) // a failed round is still progress
+	if code := statusOf(healthzHandler(&c, hc)); code != http.StatusOK {
+		t.Fatalf("after a failed round: %d, want 200", code)
+	}
+	c.mu.Lock()
+	c.heartbeat = time.Now().Add(-2 * time.Minute)
+	c.mu.Unlock()
+	if code := statusOf(healthzHandler(&c, hc)); code != http.StatusServiceUnavailable {
+		t.Fatalf("stuck poller: %d, want 503", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	fail := errors.New("vchi")
+	ok := func() State { return State{Timestamp: time.Now()} }
+	steps := []struct {
+		err  error
+		want int
+	}{
+		{fail, http.StatusServiceUnavailable}, // no good poll yet
+		{nil, http.StatusOK},
+		{fail, http.StatusOK},
+		{fail, http.StatusServiceUnavailable}, // --ready-max-failures=2 reached
+		{fail, http.StatusServiceUnavailable},
+		{nil, http.StatusOK}, // a good poll resets the count
+	}
+	var c cache
+	h := readyzHandler(&c, healthConfig{maxFailures: 2})
+	if code := statusOf(h); code != http.StatusServiceUnavailable {
+		t.Fatalf("before the first round: %d, want 503", code)
+	}
+	for i, st := range steps {
+		c.Record(ok(), st.err)
+		if code := statusOf(h); code != st.want {
+			t.Fatalf("step %d: %d, want %d", i, code, st.want)
+		}
+	}
+
+	// maxFailures 0 never goes unready once a good poll exists
+	var c0 cache
+	c0.Record(ok(), nil)
+	for range 5 {
+		c0.Record(ok(), fail)
+	}
+	if code := statusOf(readyzHandler(&c0, healthConfig{})); code != http.StatusOK {
+		t.Fatalf("max failures 0: %d, want 200", code)
+	}
+}
+
+func statusOf(h http.HandlerFunc) int {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	return w.Code
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests run power-agent against cmd/fake-vcgencmd, built as
+// "vcgencmd" into a temp dir at the front of PATH. They are skipped with
+// -short or without a go command to build the binaries.
+
+var (
+	fakeBin     string // dir with the fake vcgencmd and the agent
+	fakeSkipped string // why the binaries were not built
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	goBin, err := exec.LookPath("go")
+	switch {
+	case testing.Short():
+		fakeSkipped = "integration test skipped with -short"
+	case err != nil:
+		fakeSkipped = "no go command to build the fake vcgencmd: " + err.Error()
+	}
+	if fakeSkipped != "" {
+		os.Exit(m.Run())
+	}
+
+	dir, err := os.MkdirTemp("", "power-agent-it")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, b := range []struct{ out, pkg string }{{"vcgencmd", "./cmd/fake-vcgencmd"}, {"power-agent", "."}} {
+		cmd := exec.Command(goBin, "build", "-o", filepath.Join(dir, b.out), b.pkg)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "build %s: %v\n%s", b.pkg, err, out)
+			os.RemoveAll(dir)
+			os.Exit(1)
+		}
+	}
+	fakeBin = dir
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeState points the fake at a fresh state file and returns a function
+// that rewrites it.
+func fakeState(t *testing.T, env ...string) func(json string) {
+	t.Helper()
+	if fakeSkipped != "" {
+		t.Skip(fakeSkipped)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("{}")
+	t.Setenv("FAKE_VCGENCMD_STATE", path)
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	return write
+}
+
+func TestPollOnceHealthy(t *testing.T) {
+	fakeState(t)
+	st, err := pollOnce(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TempC != 48.7 || st.VoltV != 0.86 || st.ClockArmMHz != 1800 || st.ThrottleHex != "0x0" {
+		t.Fatalf("state = %+v", st)
+	}
+	if st.Undervoltage || st.FreqCapped || st.Throttled {
+		t.Fatalf("flags set on a healthy Pi: %+v", st)
+	}
+	if st.RawClock != "frequency(48)=1800000000" {
+		t.Fatalf("raw clock = %q", st.RawClock)
+	}
+}
+
+func TestPollOnceThrottled(t *testing.T) {
+	write := fakeState(t)
+	write(`{"temp_c": 82.4, "volt_v": 0.8, "clock_arm_hz": 600123456, "throttled": "0x50005"}`)
+	st, err := pollOnce(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TempC != 82.4 || st.VoltV != 0.8 || st.ClockArmMHz != 600.1 {
+		t.Fatalf("state = %+v", st)
+	}
+	if !st.Undervoltage || st.FreqCapped || !st.Throttled || st.ThrottleHex != "0x50005" {
+		t.Fatalf("throttle flags = %+v", st)
+	}
+}
+
+func TestPollOnceEnvOverrides(t *testing.T) {
+	write := fakeState(t, "FAKE_VCGENCMD_TEMP=70", "FAKE_VCGENCMD_THROTTLED=2")
+	write(`{"temp_c": 50}`)
+	st, err := pollOnce(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TempC != 70 || !st.FreqCapped || st.ThrottleHex != "0x2" {
+		t.Fatalf("state = %+v", st)
+	}
+}
+
+func TestPollOnceFailures(t *testing.T) {
+	for _, tc := range []struct {
+		fail, want string
+	}{
+		{"vchi", "VCHI initialization failed"},
+		{"get_throttled=notreg", "Command not registered"},
+		{"measure_volts=garbage", "parseVolts"},
+		{"measure_clock=empty", "parseClock"},
+	} {
+		t.Run(tc.fail, func(t *testing.T) {
+			fakeState(t, "FAKE_VCGENCMD_FAIL="+tc.fail)
+			st, err := pollOnce(2 * time.Second)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want %q", err, tc.want)
+			}
+			if !strings.Contains(st.LastError, tc.want) {
+				t.Fatalf("last_error = %q", st.LastError)
+			}
+		})
+	}
+}
+
+func TestPollOnceHangTimesOut(t *testing.T) {
+	fakeState(t, "FAKE_VCGENCMD_FAIL=measure_temp=hang")
+	start := time.Now()
+	if _, err := pollOnce(300 * time.Millisecond); err == nil {
+		t.Fatal("want a timeout error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("poll took %s despite the timeout", d)
+	}
+}
+
+// TestAgentEndToEnd runs the agent binary against the fake and follows
+// /power and /readyz while the firmware breaks and recovers.
+func TestAgentEndToEnd(t *testing.T) {
+	write := fakeState(t)
+	write(`{"temp_c": 55.5, "throttled": "0x0"}`)
+
+	agent := exec.Command(filepath.Join(fakeBin, "power-agent"),
+		"--listen=127.0.0.1:0", "--poll-interval=100ms", "--poll-timeout=1s", "--ready-max-failures=1")
+	logs, err := agent.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		agent.Process.Kill()
+		agent.Wait()
+	})
+
+	// the agent logs the address it bound
+	addrc := make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(logs)
+		for sc.Scan() {
+			if _, rest, ok := strings.Cut(sc.Text(), "listening on "); ok {
+				addrc <- strings.Fields(rest)[0]
+			}
+		}
+	}()
+	var addr string
+	select {
+	case addr = <-addrc:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent never logged its listen address")
+	}
+
+	base := "http://" + addr
+	client := &http.Client{Timeout: 2 * time.Second}
+	get := func(path string) (int, State) {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			return 0, State{}
+		}
+		defer resp.Body.Close()
+		var st State
+		json.NewDecoder(resp.Body).Decode(&st)
+		return resp.StatusCode, st
+	}
+	waitFor := func(what string, ok func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitFor("ready", func() bool { code, _ := get("/readyz"); return code == http.StatusOK })
+	if _, st := get("/power"); st.TempC != 55.5 || st.Source != "vcgencmd" || st.Stale {
+		t.Fatalf("/power = %+v", st)
+	}
+
+	write(`{"temp_c": 81, "throttled": "0xe0006"}`)
+	waitFor("throttling in /power", func() bool { _, st := get("/power"); return st.Throttled })
+	if _, st := get("/power"); st.TempC != 81 || !st.FreqCapped || st.Undervoltage {
+		t.Fatalf("/power = %+v", st)
+	}
+
+	write(`{"temp_c": 81, "fail": {"*": "vchi"}}`)
+	waitFor("not ready", func() bool { code, _ := get("/readyz"); return code == http.StatusServiceUnavailable })
+	_, st := get("/power")
+	if !strings.Contains(st.LastError, "VCHI initialization failed") || st.TempC != 81 {
+		t.Fatalf("/power after failure = %+v", st)
+	}
+
+	write(`{"temp_c": 60}`)
+	waitFor("ready again", func() bool { code, _ := get("/readyz"); return code == http.StatusOK })
+	if _, st := get("/power?fresh=true"); st.TempC != 60 || st.Throttled {
+		t.Fatalf("/power after recovery = %+v", st)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -34,14 +36,37 @@ type State struct {
 	RawThrottle string `json:"raw_throttle,omitempty"`
 	RawClock    string `json:"raw_clock,omitempty"`
 
+	// User-defined probes (--probes-config), keyed by probe name
+	Custom       map[string]float64 `json:"custom,omitempty"`
+	CustomErrors map[string]string  `json:"custom_errors,omitempty"`
+
+	// External collector plugins (--plugins-config); their values are merged into Custom
+	Plugins map[string]PluginStatus `json:"plugins,omitempty"`
+
 	// Error visibility
 	LastError   string    `json:"last_error,omitempty"`
 	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+
+	// Freshness, filled in when serving /power
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+	AgeSeconds    float64   `json:"age_seconds"` // -1 until the first good poll
+	Stale         bool      `json:"stale"`
 }
 
 type cache struct {
 	mu    sync.RWMutex
 	state State
+
+	lastOK    time.Time // timestamp of the last successful poll
+	failures  int       // consecutive failed polls
+	heartbeat time.Time // last time the poller finished a round
+}
+
+// pollHealth is a snapshot of the poller bookkeeping used by the probes.
+type pollHealth struct {
+	LastOK    time.Time
+	Failures  int
+	Heartbeat time.Time
 }
 
 func (c *cache) Get() State {
@@ -49,12 +74,48 @@ func (c *cache) Get() State {
 	defer c.mu.RUnlock()
 	return c.state
 }
-func (c *cache) Set(s State) {
+
+// Record stores the outcome of a poll. A failed poll keeps the last good
+// readings and only updates the error fields, so a broken vcgencmd never
+// shows up as a 0°C node; the age/stale fields tell consumers how old the
+// readings are.
+func (c *cache) Record(s State, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.heartbeat = time.Now()
+	if err != nil {
+		c.failures++
+		if c.lastOK.IsZero() {
+			s.Custom, s.CustomErrors = c.state.Custom, c.state.CustomErrors
+			c.state = s // nothing better to show yet
+			return
+		}
+		c.state.LastError = s.LastError
+		c.state.LastErrorAt = s.LastErrorAt
+		c.state.LastPollLatency = s.LastPollLatency
+		return
+	}
+	c.failures = 0
+	c.lastOK = s.Timestamp
+	s.Custom, s.CustomErrors = c.state.Custom, c.state.CustomErrors // see RecordProbes
 	c.state = s
 }
 
+// RecordProbes stores the latest custom probe values. Probes run after and
+// independently of the vcgencmd rounds, so a slow probe never holds up a
+// poll.
+func (c *cache) RecordProbes(vals map[string]float64, errs map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Custom, c.state.CustomErrors = vals, errs
+}
+
+func (c *cache) Health() pollHealth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return pollHealth{LastOK: c.lastOK, Failures: c.failures, Heartbeat: c.heartbeat}
+}
+
 var debug bool
 
 func dbg(format string, args ...any) {
@@ -209,10 +270,45 @@ func pollOnce(timeout time.Duration) (State, error) {
 	return s, nil
 }
 
+// parseMaxAge reads the freshness request of a /power call: fresh=true asks
+// for a sample no older than the on-demand poll spacing, max_age (a duration
+// like "2s" or plain seconds) sets the bound explicitly.
+func parseMaxAge(r *http.Request, freshGap time.Duration) (time.Duration, bool, error) {
+	q := r.URL.Query()
+	if v := q.Get("max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			secs, ferr := strconv.ParseFloat(v, 64)
+			if ferr != nil {
+				return 0, false, fmt.Errorf("invalid max_age %q", v)
+			}
+			d = time.Duration(secs * float64(time.Second))
+		}
+		if d < 0 {
+			return 0, false, fmt.Errorf("invalid max_age %q: negative", v)
+		}
+		return d, true, nil
+	}
+	if v := q.Get("fresh"); v != "" {
+		fresh, err := strconv.ParseBool(v)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid fresh %q", v)
+		}
+		return freshGap, fresh, nil
+	}
+	return 0, false, nil
+}
+
 func main() {
 	listen := flag.String("listen", ":8085", "HTTP listen address")
 	poll := flag.Duration("poll-interval", 5*time.Second, "vcgencmd poll interval")
 	timeout := flag.Duration("poll-timeout", 800*time.Millisecond, "timeout per vcgencmd")
+	staleAfter := flag.Duration("stale-after", 0, "mark /power stale when the last good poll is older than this (default 3x poll-interval)")
+	livenessTimeout := flag.Duration("liveness-timeout", 0, "fail /healthz when the poller made no progress for this long (default 3x poll-interval + poll-timeout)")
+	maxFailures := flag.Int("ready-max-failures", 3, "fail /readyz after this many consecutive failed polls")
+	probesPath := flag.String("probes-config", "", "JSON file with user-defined probes (see probes.go)")
+	pluginsPath := flag.String("plugins-config", "", "JSON file with external collector plugins (see plugins.go)")
+	freshGap := flag.Duration("fresh-min-interval", time.Second, "minimum spacing between on-demand polls for /power?fresh=true")
 	flag.BoolVar(&debug, "debug", false, "enable verbose debug logging")
 	flag.Parse()
 
@@ -230,14 +326,47 @@ func main() {
 		log.Printf("      Typically available on Raspberry Pi OS. If running in a container, you may need to install it on the host and mount it, or run agent on host.")
 	}
 
+	hc := healthConfig{
+		staleAfter:      *staleAfter,
+		livenessTimeout: *livenessTimeout,
+		maxFailures:     *maxFailures,
+	}
+	if hc.staleAfter <= 0 {
+		hc.staleAfter = 3 * *poll
+	}
+	if hc.livenessTimeout <= 0 {
+		hc.livenessTimeout = 3**poll + *timeout
+	}
+
+	var probes []probe
+	if *probesPath != "" {
+		var err error
+		if probes, err = loadProbes(*probesPath, *timeout); err != nil {
+			log.Fatalf("probes: %v", err)
+		}
+		log.Printf("loaded %d custom probes from %s", len(probes), *probesPath)
+	}
+
+	var plugins *pluginSet
+	if *pluginsPath != "" {
+		cfgs, err := loadPlugins(*pluginsPath)
+		if err != nil {
+			log.Fatalf("plugins: %v", err)
+		}
+		if err := checkCustomNames(probes, cfgs); err != nil {
+			log.Fatalf("plugins: %v", err)
+		}
+		plugins = newPluginSet(cfgs)
+		plugins.Start()
+		log.Printf("started %d collector plugins from %s", len(cfgs), *pluginsPath)
+	}
+
 	var c cache
+	smp := &sampler{c: &c, timeout: *timeout, minGap: *freshGap, probes: probes}
 
-	// Initial poll (non-fatal)
-	if s, err := pollOnce(*timeout); err != nil {
+	// Initial poll (non-fatal); state is still recorded so /power shows last_error
+	if err := smp.Poll(context.Background()); err != nil {
 		log.Printf("initial poll failed: %v", err)
-		c.Set(s) // still set state so /power shows last_error
-	} else {
-		c.Set(s)
 	}
 
 	// Background poller
@@ -245,33 +374,48 @@ func main() {
 		t := time.NewTicker(*poll)
 		defer t.Stop()
 		for range t.C {
-			s, err := pollOnce(*timeout)
-			if err != nil {
-				log.Printf("poll error: %v", err)
-			}
-			c.Set(s)
-			dbg("polled: temp=%.2fC volt=%.3fV arm=%.1fMHz uv=%v thr=%v fc=%v",
-				s.TempC, s.VoltV, s.ClockArmMHz, s.Undervoltage, s.Throttled, s.FreqCapped)
+			_ = smp.Poll(context.Background()) // errors are logged and recorded by the sampler
 		}
 	}()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/power", func(w http.ResponseWriter, r *http.Request) {
-		st := c.Get()
+		maxAge, onDemand, err := parseMaxAge(r, *freshGap)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if onDemand {
+			polled, err := smp.Refresh(r.Context(), maxAge)
+			switch {
+			case errors.Is(err, errRateLimited):
+				w.Header().Set("X-Power-Poll", "rate-limited")
+			case err != nil: // the poll failed or the client gave up: cached data
+				w.Header().Set("X-Power-Poll", "failed")
+			case polled:
+				w.Header().Set("X-Power-Poll", "fresh")
+			default:
+				w.Header().Set("X-Power-Poll", "cached")
+			}
+		}
+		st := plugins.Merge(withFreshness(c.Get(), c.Health(), hc.staleAfter))
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(st); err != nil {
 			log.Printf("write /power error: %v", err)
 		}
 	})
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	})
+	mux.HandleFunc("/metrics", metricsHandler(&c, hc, probes, plugins))
+	mux.HandleFunc("/healthz", healthzHandler(&c, hc))
+	mux.HandleFunc("/readyz", readyzHandler(&c, hc))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("ok\n"))
 	})
 
-	log.Printf("power-agent listening on %s (poll=%s, timeout=%s)", *listen, poll.String(), timeout.String())
-	log.Fatal(http.ListenAndServe(*listen, mux))
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the bound address, so --listen=127.0.0.1:0 can be found in the log
+	log.Printf("power-agent listening on %s (poll=%s, timeout=%s)", ln.Addr(), poll.String(), timeout.String())
+	log.Fatal(http.Serve(ln, mux))
 }
-
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		query    string
+		want     time.Duration
+		onDemand bool
+		bad      bool
+	}{
+		{"", 0, false, false},
+		{"fresh=true", time.Second, true, false},
+		{"fresh=false", time.Second, false, false},
+		{"fresh=maybe", 0, false, true},
+		{"max_age=2s", 2 * time.Second, true, false},
+		{"max_age=1.5", 1500 * time.Millisecond, true, false},
+		{"max_age=0", 0, true, false},
+		{"max_age=-1s", 0, false, true},
+		{"max_age=-1", 0, false, true},
+		{"max_age=soon", 0, false, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/power?"+tt.query, nil)
+		d, onDemand, err := parseMaxAge(r, time.Second)
+		if (err != nil) != tt.bad {
+			t.Fatalf("%q: err %v", tt.query, err)
+		}
+		if !tt.bad && (d != tt.want || onDemand != tt.onDemand) {
+			t.Fatalf("%q: %v %v, want %v %v", tt.query, d, onDemand, tt.want, tt.onDemand)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricsHandler serves the cached state in the Prometheus text format. It is
+// written by hand to keep the agent free of dependencies.
+func metricsHandler(c *cache, hc healthConfig, probes []probe, plugins *pluginSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		st := plugins.Merge(withFreshness(c.Get(), h, hc.staleAfter))
+		units := plugins.Units()
+		for _, p := range probes {
+			units[p.Name] = p.Unit
+		}
+
+		var b strings.Builder
+		gauge := func(name, help string, v float64) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+		}
+		gauge("power_agent_temp_celsius", "SoC temperature from vcgencmd measure_temp.", st.TempC)
+		gauge("power_agent_core_volts", "Core voltage from vcgencmd measure_volts.", st.VoltV)
+		gauge("power_agent_clock_arm_mhz", "ARM clock from vcgencmd measure_clock arm.", st.ClockArmMHz)
+		gauge("power_agent_undervoltage", "1 if undervoltage is currently detected.", b2f(st.Undervoltage))
+		gauge("power_agent_freq_capped", "1 if the ARM frequency is currently capped.", b2f(st.FreqCapped))
+		gauge("power_agent_throttled", "1 if the SoC is currently throttled.", b2f(st.Throttled))
+		gauge("power_agent_sample_age_seconds", "Age of the last successful poll, -1 before the first.", st.AgeSeconds)
+		gauge("power_agent_stale", "1 if the cached sample is older than --stale-after.", b2f(st.Stale))
+		gauge("power_agent_consecutive_poll_failures", "Consecutive failed vcgencmd polls.", float64(h.Failures))
+		if !h.Heartbeat.IsZero() {
+			gauge("power_agent_last_poll_timestamp_seconds", "Unix time the poller last finished a round.",
+				float64(h.Heartbeat.UnixNano())/float64(time.Second))
+		}
+
+		if len(st.Custom) > 0 {
+			names := make([]string, 0, len(st.Custom))
+			for name := range st.Custom {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			b.WriteString("# HELP power_agent_custom User-defined probe and plugin values.\n# TYPE power_agent_custom gauge\n")
+			for _, name := range names {
+				fmt.Fprintf(&b, "power_agent_custom{probe=%q,unit=%q} %g\n", name, units[name], st.Custom[name])
+			}
+		}
+		if len(probes) > 0 {
+			b.WriteString("# HELP power_agent_custom_up 1 if the probe succeeded in the last round.\n# TYPE power_agent_custom_up gauge\n")
+			for _, p := range probes {
+				_, ok := st.Custom[p.Name]
+				fmt.Fprintf(&b, "power_agent_custom_up{probe=%q} %g\n", p.Name, b2f(ok))
+			}
+		}
+		if names := plugins.Names(); len(names) > 0 {
+			b.WriteString("# HELP power_agent_plugin_up 1 if the collector plugin is running and said hello.\n# TYPE power_agent_plugin_up gauge\n")
+			for _, name := range names {
+				fmt.Fprintf(&b, "power_agent_plugin_up{plugin=%q} %g\n", name, b2f(st.Plugins[name].Running))
+			}
+			b.WriteString("# HELP power_agent_plugin_restarts_total Collector plugin restarts.\n# TYPE power_agent_plugin_restarts_total counter\n")
+			for _, name := range names {
+				fmt.Fprintf(&b, "power_agent_plugin_restarts_total{plugin=%q} %d\n", name, st.Plugins[name].Restarts)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+	}
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
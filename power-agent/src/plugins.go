@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// External collector plugins are long-lived processes listed in
+// --plugins-config:
+//
+//	{"plugins": [
+//	  {"name": "ups", "command": "/opt/plugins/ups_hat.py", "timeout": "20s"}
+//	]}
+//
+// They talk to the agent in JSON lines on stdout, one message per line:
+//
+//	{"type": "hello", "name": "ups", "version": "1.0", "capabilities": [{"name": "battery_percent", "unit": "%"}]}
+//	{"type": "sample", "values": {"battery_percent": 87.5}}
+//	{"type": "error", "message": "i2c read failed"}
+//
+// hello must come first. A plugin that stays silent for longer than its
+// timeout, breaks the protocol or exits is killed and restarted with
+// exponential backoff. Stderr is copied to the agent log, and stdin stays
+// open so a plugin can exit when it reads EOF after the agent is gone.
+// Sample values are merged into /power's "custom" object as <plugin>_<name>,
+// so no probe may be named <plugin>_..., and are dropped (with the plugin
+// marked stale) once the last sample is older than the plugin's timeout.
+
+type pluginsConfig struct {
+	Plugins []pluginConfig `json:"plugins"`
+}
+
+type pluginConfig struct {
+	Name       string   `json:"name"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	Env        []string `json:"env,omitempty"`         // extra KEY=value pairs
+	Timeout    string   `json:"timeout,omitempty"`     // max silence between messages, default 30s
+	MaxBackoff string   `json:"max_backoff,omitempty"` // restart backoff cap, default 1m
+
+	timeout    time.Duration
+	maxBackoff time.Duration
+}
+
+type pluginCapability struct {
+	Name string `json:"name"`
+	Unit string `json:"unit,omitempty"`
+}
+
+type pluginMsg struct {
+	Type         string             `json:"type"`
+	Name         string             `json:"name,omitempty"`
+	Version      string             `json:"version,omitempty"`
+	Capabilities []pluginCapability `json:"capabilities,omitempty"`
+	Values       map[string]float64 `json:"values,omitempty"`
+	Message      string             `json:"message,omitempty"`
+}
+
+// PluginStatus is the per-plugin view exposed under /power's "plugins".
+type PluginStatus struct {
+	Running      bool               `json:"running"`
+	Version      string             `json:"version,omitempty"`
+	Capabilities []pluginCapability `json:"capabilities,omitempty"`
+	Restarts     int                `json:"restarts"`
+	LastSampleAt time.Time          `json:"last_sample_at,omitempty"`
+	LastError    string             `json:"last_error,omitempty"`
+	LastErrorAt  time.Time          `json:"last_error_at,omitempty"`
+	Stale        bool               `json:"stale,omitempty"` // values older than the timeout, not served
+
+	values map[string]float64
+	maxAge time.Duration
+}
+
+func loadPlugins(path string) ([]pluginConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read plugins config: %w", err)
+	}
+	var cfg pluginsConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse plugins config %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i := range cfg.Plugins {
+		p := &cfg.Plugins[i]
+		if !probeNameRe.MatchString(p.Name) {
+			return nil, fmt.Errorf("plugin %d: invalid name %q", i, p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("plugin %q: duplicate name", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Command == "" {
+			return nil, fmt.Errorf("plugin %q: command is required", p.Name)
+		}
+		if p.timeout, err = durationOr(p.Timeout, 30*time.Second); err != nil {
+			return nil, fmt.Errorf("plugin %q: timeout: %w", p.Name, err)
+		}
+		if p.maxBackoff, err = durationOr(p.MaxBackoff, time.Minute); err != nil {
+			return nil, fmt.Errorf("plugin %q: max_backoff: %w", p.Name, err)
+		}
+	}
+	return cfg.Plugins, nil
+}
+
+// checkCustomNames rejects configs whose merged custom names could collide:
+// a probe named like a plugin value, or a plugin name that prefixes another.
+func checkCustomNames(probes []probe, plugins []pluginConfig) error {
+	for _, pc := range plugins {
+		prefix := pc.Name + "_"
+		for _, p := range probes {
+			if strings.HasPrefix(p.Name, prefix) {
+				return fmt.Errorf("probe %q: names starting with %q are reserved for plugin %q", p.Name, prefix, pc.Name)
+			}
+		}
+		for _, other := range plugins {
+			if strings.HasPrefix(other.Name, prefix) {
+				return fmt.Errorf("plugin %q: name starts with %q, its values could collide with plugin %q", other.Name, prefix, pc.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func durationOr(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// pluginSet supervises the configured plugins and holds their latest status.
+type pluginSet struct {
+	mu     sync.RWMutex
+	status map[string]*PluginStatus
+	cfgs   []pluginConfig
+}
+
+func newPluginSet(cfgs []pluginConfig) *pluginSet {
+	ps := &pluginSet{status: make(map[string]*PluginStatus, len(cfgs)), cfgs: cfgs}
+	for _, pc := range cfgs {
+		ps.status[pc.Name] = &PluginStatus{maxAge: pc.timeout}
+	}
+	return ps
+}
+
+// Start launches one supervisor goroutine per plugin.
+func (ps *pluginSet) Start() {
+	for _, pc := range ps.cfgs {
+		go ps.supervise(pc)
+	}
+}
+
+func (ps *pluginSet) supervise(pc pluginConfig) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := ps.runOnce(pc)
+		ps.update(pc.Name, func(st *PluginStatus) {
+			st.Running, st.values = false, nil
+			st.Restarts++
+			st.LastError, st.LastErrorAt = err.Error(), time.Now()
+		})
+		log.Printf("plugin %s: %v (restarting in %s)", pc.Name, err, backoff)
+
+		// A plugin that ran healthily for a while starts over with a short backoff.
+		if time.Since(started) > 2*pc.maxBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, pc.maxBackoff)
+	}
+}
+
+// pluginPipeGrace bounds how long a killed plugin's output may stay open.
+const pluginPipeGrace = 2 * time.Second
+
+// runOnce starts the plugin and reads its messages until it exits, times out
+// or violates the protocol. It always returns a non-nil error.
+func (ps *pluginSet) runOnce(pc pluginConfig) error {
+	cmd := exec.Command(pc.Command, pc.Args...)
+	cmd.Env = append(os.Environ(), pc.Env...)
+	// own process group, so that killing it also takes down children that
+	// inherited stdout (e.g. a shell wrapper's)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = pluginPipeGrace
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	dbg("plugin %s: started pid %d", pc.Name, cmd.Process.Pid)
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("plugin %s: %s", pc.Name, sc.Text())
+		}
+	}()
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			lines <- append([]byte(nil), sc.Bytes()...)
+		}
+	}()
+
+	err = ps.read(pc, lines)
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	// Wait closes the pipes, so let the readers reach EOF first; a
+	// descendant that left the group and still holds them gets
+	// pluginPipeGrace before Wait cuts it off.
+	drained := make(chan struct{})
+	go func() {
+		for range lines {
+		}
+		<-stderrDone
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(pluginPipeGrace):
+	}
+	werr := cmd.Wait()
+	switch {
+	case err != nil:
+	case werr != nil:
+		err = fmt.Errorf("exited: %w", werr)
+	default:
+		err = errors.New("exited")
+	}
+	return err
+}
+
+func (ps *pluginSet) read(pc pluginConfig, lines <-chan []byte) error {
+	timer := time.NewTimer(pc.timeout)
+	defer timer.Stop()
+	var caps map[string]bool
+	helloSeen := false
+	for {
+		select {
+		case <-timer.C:
+			return fmt.Errorf("no message for %s", pc.timeout)
+		case line, ok := <-lines:
+			if !ok {
+				return nil // process closed stdout; runOnce reports the exit
+			}
+			timer.Reset(pc.timeout)
+
+			var m pluginMsg
+			if err := json.Unmarshal(line, &m); err != nil {
+				return fmt.Errorf("protocol: bad message %q: %w", line, err)
+			}
+			if !helloSeen && m.Type != "hello" {
+				return fmt.Errorf("protocol: %q before hello", m.Type)
+			}
+			switch m.Type {
+			case "hello":
+				helloSeen = true
+				caps = make(map[string]bool, len(m.Capabilities))
+				for _, c := range m.Capabilities {
+					caps[c.Name] = true
+				}
+				ps.update(pc.Name, func(st *PluginStatus) {
+					st.Running, st.Version, st.Capabilities = true, m.Version, m.Capabilities
+				})
+				log.Printf("plugin %s: hello version=%q capabilities=%d", pc.Name, m.Version, len(m.Capabilities))
+			case "sample":
+				vals := make(map[string]float64, len(m.Values))
+				for k, v := range m.Values {
+					if len(caps) > 0 && !caps[k] {
+						dbg("plugin %s: ignoring undeclared value %q", pc.Name, k)
+						continue
+					}
+					vals[k] = v
+				}
+				ps.update(pc.Name, func(st *PluginStatus) {
+					st.values, st.LastSampleAt = vals, time.Now()
+				})
+			case "error":
+				ps.update(pc.Name, func(st *PluginStatus) {
+					st.LastError, st.LastErrorAt = m.Message, time.Now()
+				})
+			default:
+				return fmt.Errorf("protocol: unknown message type %q", m.Type)
+			}
+		}
+	}
+}
+
+func (ps *pluginSet) update(name string, f func(*PluginStatus)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	f(ps.status[name])
+}
+
+// Merge adds the plugins' latest values to s.Custom and their status to
+// s.Plugins. s.Custom is copied, never modified in place. Values older than
+// the plugin's timeout are left out and the plugin is marked stale.
+func (ps *pluginSet) Merge(s State) State {
+	if ps == nil || len(ps.cfgs) == 0 {
+		return s
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	custom := make(map[string]float64, len(s.Custom))
+	for k, v := range s.Custom {
+		custom[k] = v
+	}
+	s.Plugins = make(map[string]PluginStatus, len(ps.status))
+	for name, st := range ps.status {
+		view := *st
+		if len(st.values) > 0 && time.Since(st.LastSampleAt) > st.maxAge {
+			view.Stale = true
+		} else {
+			for k, v := range st.values {
+				custom[name+"_"+k] = v
+			}
+		}
+		s.Plugins[name] = view
+	}
+	s.Custom = custom
+	return s
+}
+
+// Units maps merged custom field names to the unit a plugin declared.
+func (ps *pluginSet) Units() map[string]string {
+	units := map[string]string{}
+	if ps == nil {
+		return units
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for name, st := range ps.status {
+		for _, c := range st.Capabilities {
+			units[name+"_"+c.Name] = c.Unit
+		}
+	}
+	return units
+}
+
+// Names returns the configured plugin names in a stable order.
+func (ps *pluginSet) Names() []string {
+	if ps == nil {
+		return nil
+	}
+	names := make([]string, 0, len(ps.cfgs))
+	for _, pc := range ps.cfgs {
+		names = append(names, pc.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPlugins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	os.WriteFile(path, []byte(`{"plugins": [{"name": "ups", "command": "/opt/ups.py", "timeout": "5s"}, {"name": "meter", "command": "/opt/m"}]}`), 0o644)
+	cfgs, err := loadPlugins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfgs[0].timeout != 5*time.Second || cfgs[1].timeout != 30*time.Second || cfgs[1].maxBackoff != time.Minute {
+		t.Fatalf("timeouts %v %v backoff %v", cfgs[0].timeout, cfgs[1].timeout, cfgs[1].maxBackoff)
+	}
+
+	for _, tc := range []struct{ cfg, want string }{
+		{`{"plugins": [{"name": "u-p-s", "command": "x"}]}`, "invalid name"},
+		{`{"plugins": [{"name": "ups", "command": "x"}, {"name": "ups", "command": "y"}]}`, "duplicate"},
+		{`{"plugins": [{"name": "ups"}]}`, "command is required"},
+		{`{"plugins": [{"name": "ups", "command": "x", "timeout": "soon"}]}`, "timeout"},
+	} {
+		os.WriteFile(path, []byte(tc.cfg), 0o644)
+		if _, err := loadPlugins(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: err %v, want %q", tc.cfg, err, tc.want)
+		}
+	}
+}
+
+func TestCheckCustomNames(t *testing.T) {
+	plugins := []pluginConfig{{Name: "ups"}, {Name: "meter"}}
+	if err := checkCustomNames([]probe{{Name: "fan_rpm"}, {Name: "upsilon"}}, plugins); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCustomNames([]probe{{Name: "ups_battery_percent"}}, plugins); err == nil {
+		t.Fatal("probe shadowing a plugin value: want an error")
+	}
+	if err := checkCustomNames(nil, append(plugins, pluginConfig{Name: "ups_hat"})); err == nil {
+		t.Fatal("plugin ups_hat next to ups: want an error")
+	}
+}
+
+// feed runs the line-protocol reader over msgs, followed by the plugin
+// closing stdout, and returns the plugin status afterwards and its error.
+func feed(msgs ...string) (PluginStatus, error) {
+	pc := pluginConfig{Name: "ups", timeout: time.Minute}
+	ps := newPluginSet([]pluginConfig{pc})
+	lines := make(chan []byte, len(msgs))
+	for _, m := range msgs {
+		lines <- []byte(m)
+	}
+	close(lines)
+	err := ps.read(pc, lines)
+	return *ps.status["ups"], err
+}
+
+func TestPluginProtocol(t *testing.T) {
+	hello := `{"type": "hello", "version": "1.0", "capabilities": [{"name": "battery_percent", "unit": "%"}]}`
+
+	st, err := feed(
+		hello,
+		`{"type": "sample", "values": {"battery_percent": 87.5, "secret": 1}}`,
+		`{"type": "error", "message": "i2c read failed"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Running || st.Version != "1.0" || st.values["battery_percent"] != 87.5 || len(st.values) != 1 {
+		t.Fatalf("status %+v values %v", st, st.values)
+	}
+	if st.LastError != "i2c read failed" || st.LastSampleAt.IsZero() {
+		t.Fatalf("status %+v", st)
+	}
+
+	for _, tc := range []struct {
+		msgs []string
+		want string
+	}{
+		{[]string{`{"type": "sample", "values": {"x": 1}}`}, "before hello"},
+		{[]string{hello, `not json`}, "bad message"},
+		{[]string{hello, `{"type": "bye"}`}, "unknown message type"},
+	} {
+		if _, err := feed(tc.msgs...); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%v: err %v, want %q", tc.msgs, err, tc.want)
+		}
+	}
+
+	pc := pluginConfig{Name: "ups", timeout: 50 * time.Millisecond}
+	lines := make(chan []byte, 1)
+	lines <- []byte(hello) // then silence, stdout still open
+	if err := newPluginSet([]pluginConfig{pc}).read(pc, lines); err == nil || !strings.Contains(err.Error(), "no message for") {
+		t.Fatalf("silent plugin: err %v", err)
+	}
+}
+
+func TestPluginMerge(t *testing.T) {
+	ps := newPluginSet([]pluginConfig{{Name: "ups", timeout: time.Minute}, {Name: "meter", timeout: time.Minute}})
+	ps.update("ups", func(st *PluginStatus) {
+		st.values, st.LastSampleAt = map[string]float64{"battery_percent": 80}, time.Now()
+	})
+	ps.update("meter", func(st *PluginStatus) {
+		st.values, st.LastSampleAt = map[string]float64{"watts": 4}, time.Now().Add(-2*time.Minute)
+		st.LastError = "usb gone" // still running, but no samples lately
+	})
+
+	in := State{Custom: map[string]float64{"fan_rpm": 4200}}
+	out := ps.Merge(in)
+	if out.Custom["ups_battery_percent"] != 80 || out.Custom["fan_rpm"] != 4200 {
+		t.Fatalf("custom %v", out.Custom)
+	}
+	if _, ok := out.Custom["meter_watts"]; ok || !out.Plugins["meter"].Stale || out.Plugins["ups"].Stale {
+		t.Fatalf("stale values served: custom %v plugins %+v", out.Custom, out.Plugins)
+	}
+	if len(in.Custom) != 1 {
+		t.Fatalf("Merge modified the input: %v", in.Custom)
+	}
+	var nilSet *pluginSet
+	if got := nilSet.Merge(in); len(got.Custom) != 1 || got.Plugins != nil {
+		t.Fatalf("nil set: %+v", got)
+	}
+}
+
+func TestPluginRunOnce(t *testing.T) {
+	script := `echo '{"type": "hello", "version": "2", "capabilities": [{"name": "w", "unit": "W"}]}'
+echo '{"type": "sample", "values": {"w": 3.5}}'
+echo 'warming up' >&2
+exit 3`
+	pc := pluginConfig{Name: "meter", Command: "sh", Args: []string{"-c", script}, timeout: 5 * time.Second}
+	ps := newPluginSet([]pluginConfig{pc})
+	err := ps.runOnce(pc)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("err %v, want the exit status", err)
+	}
+	if st := ps.Merge(State{}); st.Custom["meter_w"] != 3.5 || st.Plugins["meter"].Version != "2" {
+		t.Fatalf("state %+v", st)
+	}
+	if u := ps.Units(); u["meter_w"] != "W" {
+		t.Fatalf("units %v", u)
+	}
+
+	// a plugin that stays silent is killed
+	pc = pluginConfig{Name: "meter", Command: "sleep", Args: []string{"10"}, timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err := ps.runOnce(pc); err == nil || !strings.Contains(err.Error(), "no message") {
+		t.Fatalf("err %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("silent plugin ran for %s", d)
+	}
+
+	// so is a child that inherited its stdout
+	pc = pluginConfig{Name: "meter", Command: "sh", Args: []string{"-c", "sleep 30 & sleep 30"}, timeout: 100 * time.Millisecond}
+	start = time.Now()
+	if err := ps.runOnce(pc); err == nil || !strings.Contains(err.Error(), "no message") {
+		t.Fatalf("err %v, want a timeout", err)
+	}
+	if d := time.Since(start); d >= pluginPipeGrace {
+		t.Fatalf("runOnce took %s, waiting on the orphaned child", d)
+	}
+}
+
+func TestPluginSupervisorRestarts(t *testing.T) {
+	pc := pluginConfig{Name: "gone", Command: filepath.Join(t.TempDir(), "missing"), timeout: time.Second, maxBackoff: 500 * time.Millisecond}
+	ps := newPluginSet([]pluginConfig{pc})
+	ps.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := ps.Merge(State{}).Plugins["gone"]
+		if st.Restarts >= 2 {
+			if st.Running || !strings.Contains(st.LastError, "start:") {
+				t.Fatalf("status %+v", st)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no restarts: %+v", st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeConfig is the on-disk format of --probes-config (typically a mounted
+// ConfigMap):
+//
+//	{"probes": [
+//	  {"name": "arm_freq_config", "command": "vcgencmd", "args": ["get_config", "arm_freq"], "key": "arm_freq"},
+//	  {"name": "fan_rpm", "file": "/sys/class/hwmon/hwmon2/fan1_input", "unit": "rpm"},
+//	  {"name": "ina219_watts", "command": "/opt/ina219.py", "regex": "power=([0-9.]+)mW", "scale": 0.001, "unit": "W"}
+//	]}
+type probeConfig struct {
+	Probes []probe `json:"probes"`
+}
+
+// probe is a user-defined metric: run a command (or read a file), extract a
+// number with a regex or key=value rule, convert it and publish it under
+// /power's "custom" object and /metrics.
+type probe struct {
+	Name    string   `json:"name"`              // output field name
+	Command string   `json:"command,omitempty"` // executable to run, or
+	Args    []string `json:"args,omitempty"`
+	File    string   `json:"file,omitempty"`  // file to read
+	Regex   string   `json:"regex,omitempty"` // first capture group (or whole match) is the value
+	Key     string   `json:"key,omitempty"`   // take the value of "key=value"
+	Scale   *float64 `json:"scale,omitempty"` // value*scale + offset; scale defaults to 1
+	Offset  float64  `json:"offset,omitempty"`
+	Unit    string   `json:"unit,omitempty"`
+	Timeout string   `json:"timeout,omitempty"` // per-probe timeout, defaults to --poll-timeout
+
+	re      *regexp.Regexp
+	scale   float64
+	timeout time.Duration
+}
+
+var (
+	probeNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	leadingNum  = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+)
+
+func loadProbes(path string, defTimeout time.Duration) ([]probe, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read probes config: %w", err)
+	}
+	var cfg probeConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse probes config %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i := range cfg.Probes {
+		p := &cfg.Probes[i]
+		if !probeNameRe.MatchString(p.Name) {
+			return nil, fmt.Errorf("probe %d: invalid name %q", i, p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("probe %q: duplicate name", p.Name)
+		}
+		seen[p.Name] = true
+		if (p.Command == "") == (p.File == "") {
+			return nil, fmt.Errorf("probe %q: set exactly one of command or file", p.Name)
+		}
+		if p.Regex != "" && p.Key != "" {
+			return nil, fmt.Errorf("probe %q: set at most one of regex or key", p.Name)
+		}
+		if p.Regex != "" {
+			if p.re, err = regexp.Compile(p.Regex); err != nil {
+				return nil, fmt.Errorf("probe %q: %w", p.Name, err)
+			}
+		}
+		p.scale = 1
+		if p.Scale != nil {
+			if *p.Scale == 0 {
+				return nil, fmt.Errorf("probe %q: scale 0 would report 0 for every reading", p.Name)
+			}
+			p.scale = *p.Scale
+		}
+		p.timeout = defTimeout
+		if p.Timeout != "" {
+			if p.timeout, err = time.ParseDuration(p.Timeout); err != nil {
+				return nil, fmt.Errorf("probe %q: timeout: %w", p.Name, err)
+			}
+		}
+	}
+	return cfg.Probes, nil
+}
+
+// Collect runs the probe and returns the converted value and the raw output.
+func (p probe) Collect() (float64, string, error) {
+	var out string
+	if p.File != "" {
+		b, err := os.ReadFile(p.File)
+		if err != nil {
+			return 0, "", fmt.Errorf("probe %s: %w", p.Name, err)
+		}
+		out = strings.TrimSpace(string(b))
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		defer cancel()
+		var err error
+		if out, err = run(ctx, p.Command, p.Args...); err != nil {
+			return 0, out, fmt.Errorf("probe %s: %w", p.Name, err)
+		}
+	}
+	v, err := p.extract(out)
+	if err != nil {
+		return 0, out, fmt.Errorf("probe %s: %w", p.Name, err)
+	}
+	return v*p.scale + p.Offset, out, nil
+}
+
+func (p probe) extract(out string) (float64, error) {
+	s := out
+	switch {
+	case p.re != nil:
+		m := p.re.FindStringSubmatch(out)
+		if m == nil {
+			return 0, fmt.Errorf("regex %q did not match %q", p.Regex, out)
+		}
+		s = m[0]
+		if len(m) > 1 {
+			s = m[1]
+		}
+	case p.Key != "":
+		found := false
+		for _, f := range strings.FieldsFunc(out, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ','
+		}) {
+			if v, ok := strings.CutPrefix(f, p.Key+"="); ok {
+				s, found = v, true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("key %q not found in %q", p.Key, out)
+		}
+	}
+	return parseNumber(s)
+}
+
+// parseNumber accepts hex ("0x50005") or a decimal with an optional unit
+// suffix ("53.2'C", "1500MHz").
+func parseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if h, ok := strings.CutPrefix(s, "0x"); ok {
+		v, err := strconv.ParseUint(h, 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse %q: %w", s, err)
+		}
+		return float64(v), nil
+	}
+	num := leadingNum.FindString(s)
+	if num == "" {
+		return 0, fmt.Errorf("no number in %q", s)
+	}
+	return strconv.ParseFloat(num, 64)
+}
+
+// collectProbes runs all probes concurrently, each bounded by its own
+// timeout; a failing probe only drops its own value and is reported in
+// custom_errors.
+func collectProbes(probes []probe) (map[string]float64, map[string]string) {
+	if len(probes) == 0 {
+		return nil, nil
+	}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		vals = make(map[string]float64, len(probes))
+		errs map[string]string
+	)
+	for _, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, raw, err := p.Collect()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if errs == nil {
+					errs = map[string]string{}
+				}
+				errs[p.Name] = err.Error()
+				return
+			}
+			dbg("probe %s: %q -> %g%s", p.Name, raw, v, p.Unit)
+			vals[p.Name] = v
+		}()
+	}
+	wg.Wait()
+	return vals, errs
+}
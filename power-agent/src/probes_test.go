@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		bad  bool
+	}{
+		{"53.2'C", 53.2, false},
+		{" 1500MHz\n", 1500, false},
+		{"0x50005", 0x50005, false},
+		{"-4.5e-1V", -0.45, false},
+		{".5", 0.5, false},
+		{"0xZZ", 0, true},
+		{"temp=53.2", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNumber(tt.in)
+		if (err != nil) != tt.bad || (!tt.bad && got != tt.want) {
+			t.Fatalf("parseNumber(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	cfg := writeProbes(t, `{"probes": [
+		{"name": "arm", "file": "/x", "key": "arm_freq"},
+		{"name": "ina", "file": "/x", "regex": "power=([0-9.]+)mW"},
+		{"name": "whole", "file": "/x", "regex": "[0-9]+rpm"},
+		{"name": "plain", "file": "/x"}
+	]}`)
+	probes, err := loadProbes(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]probe{}
+	for _, p := range probes {
+		byName[p.Name] = p
+	}
+	tests := []struct {
+		probe, out string
+		want       float64
+		bad        bool
+	}{
+		{"arm", "arm_freq=1800", 1800, false},
+		{"arm", "core_freq=500, arm_freq=1500\n", 1500, false},
+		{"arm", "arm_freq_min=600", 0, true},
+		{"ina", "bus=5.1V power=2350.5mW", 2350.5, false},
+		{"ina", "no reading", 0, true},
+		{"whole", "fan 4200rpm", 4200, false},
+		{"plain", "48123", 48123, false},
+	}
+	for _, tt := range tests {
+		got, err := byName[tt.probe].extract(tt.out)
+		if (err != nil) != tt.bad || (!tt.bad && got != tt.want) {
+			t.Fatalf("%s.extract(%q) = %v, %v; want %v", tt.probe, tt.out, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadProbes(t *testing.T) {
+	probes, err := loadProbes(writeProbes(t, `{"probes": [
+		{"name": "a", "file": "/x"},
+		{"name": "b", "command": "true", "scale": 0.001, "offset": 2, "timeout": "2s"},
+		{"name": "c", "command": "true", "scale": -1}
+	]}`), 800*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes[0].scale != 1 || probes[0].timeout != 800*time.Millisecond {
+		t.Fatalf("defaults: scale %v timeout %v", probes[0].scale, probes[0].timeout)
+	}
+	if probes[1].scale != 0.001 || probes[1].timeout != 2*time.Second || probes[2].scale != -1 {
+		t.Fatalf("scale %v/%v timeout %v", probes[1].scale, probes[2].scale, probes[1].timeout)
+	}
+
+	for _, tc := range []struct{ cfg, want string }{
+		{`{"probes": [{"name": "1a", "file": "/x"}]}`, "invalid name"},
+		{`{"probes": [{"name": "a", "file": "/x"}, {"name": "a", "file": "/y"}]}`, "duplicate"},
+		{`{"probes": [{"name": "a"}]}`, "exactly one of command or file"},
+		{`{"probes": [{"name": "a", "file": "/x", "command": "true"}]}`, "exactly one of command or file"},
+		{`{"probes": [{"name": "a", "file": "/x", "regex": "x", "key": "y"}]}`, "at most one of regex or key"},
+		{`{"probes": [{"name": "a", "file": "/x", "regex": "("}]}`, "missing closing"},
+		{`{"probes": [{"name": "a", "file": "/x", "scale": 0}]}`, "scale 0"},
+		{`{"probes": [{"name": "a", "file": "/x", "timeout": "soon"}]}`, "timeout"},
+		{`{"probes": [`, "parse probes config"},
+	} {
+		if _, err := loadProbes(writeProbes(t, tc.cfg), time.Second); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: err %v, want %q", tc.cfg, err, tc.want)
+		}
+	}
+	if _, err := loadProbes(filepath.Join(t.TempDir(), "missing.json"), time.Second); err == nil {
+		t.Fatal("missing file: want an error")
+	}
+}
+
+func TestCollectProbesConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "fan"), []byte("4200\n"), 0o644)
+	probes, err := loadProbes(writeProbes(t, `{"probes": [
+		{"name": "fan", "file": "`+filepath.Join(dir, "fan")+`", "scale": 0.5},
+		{"name": "slow1", "command": "sh", "args": ["-c", "sleep 0.4; echo 1"]},
+		{"name": "slow2", "command": "sh", "args": ["-c", "sleep 0.4; echo 2"]},
+		{"name": "hung", "command": "sleep", "args": ["5"], "timeout": "300ms"},
+		{"name": "gone", "file": "`+filepath.Join(dir, "gone")+`"}
+	]}`), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	vals, errs := collectProbes(probes)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("probes took %s, want them to run side by side", d)
+	}
+	if vals["fan"] != 2100 || vals["slow1"] != 1 || vals["slow2"] != 2 || len(vals) != 3 {
+		t.Fatalf("values %v", vals)
+	}
+	if errs["hung"] == "" || errs["gone"] == "" || len(errs) != 2 {
+		t.Fatalf("errors %v", errs)
+	}
+}
+
+func writeProbes(t *testing.T, cfg string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "probes.json")
+	if err := os.WriteFile(path, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
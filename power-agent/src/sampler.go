@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("on-demand poll rate limited")
+
+// sampler runs vcgencmd rounds for both the background ticker and on-demand
+// /power?fresh=true requests. Concurrent callers share the round that is
+// already in flight, and on-demand rounds are spaced at least minGap apart
+// so a burst of requests cannot hammer the firmware mailbox.
+type sampler struct {
+	c       *cache
+	timeout time.Duration
+	minGap  time.Duration
+	probes  []probe
+	poll    func(time.Duration) (State, error) // nil: pollOnce
+
+	mu       sync.Mutex
+	inflight *round
+	lastRun  time.Time // start of the most recent round
+	probing  bool      // custom probes running
+}
+
+// round is one vcgencmd poll that any number of callers can wait on.
+type round struct {
+	done chan struct{}
+	err  error
+}
+
+// Poll runs a round (or joins the one in flight) and records the result.
+func (s *sampler) Poll(ctx context.Context) error {
+	return s.wait(ctx, s.start(false))
+}
+
+// Refresh makes sure the cached sample is at most maxAge old, polling on
+// demand if needed. It reports whether a round was run or joined.
+func (s *sampler) Refresh(ctx context.Context, maxAge time.Duration) (bool, error) {
+	if h := s.c.Health(); !h.LastOK.IsZero() && time.Since(h.LastOK) <= maxAge {
+		return false, nil
+	}
+	rd := s.start(true)
+	if rd == nil {
+		return false, errRateLimited
+	}
+	return true, s.wait(ctx, rd)
+}
+
+// start returns the in-flight round or begins a new one. With limited set it
+// returns nil instead of starting a round within minGap of the previous one.
+func (s *sampler) start(limited bool) *round {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight != nil {
+		return s.inflight
+	}
+	if limited && time.Since(s.lastRun) < s.minGap {
+		return nil
+	}
+	rd := &round{done: make(chan struct{})}
+	s.inflight, s.lastRun = rd, time.Now()
+
+	go func() {
+		poll := s.poll
+		if poll == nil {
+			poll = pollOnce
+		}
+		st, err := poll(s.timeout)
+		if err != nil {
+			log.Printf("poll error: %v", err)
+		}
+		s.c.Record(st, err)
+		dbg("polled: temp=%.2fC volt=%.3fV arm=%.1fMHz uv=%v thr=%v fc=%v",
+			st.TempC, st.VoltV, st.ClockArmMHz, st.Undervoltage, st.Throttled, st.FreqCapped)
+
+		s.mu.Lock()
+		rd.err = err
+		s.inflight = nil
+		s.mu.Unlock()
+		close(rd.done)
+
+		s.collectProbes()
+	}()
+	return rd
+}
+
+// collectProbes runs the custom probes once the round's callers are
+// answered; a collection still running from an earlier round is not
+// started again.
+func (s *sampler) collectProbes() {
+	if len(s.probes) == 0 {
+		return
+	}
+	s.mu.Lock()
+	if s.probing {
+		s.mu.Unlock()
+		return
+	}
+	s.probing = true
+	s.mu.Unlock()
+
+	vals, errs := collectProbes(s.probes)
+	s.c.RecordProbes(vals, errs)
+
+	s.mu.Lock()
+	s.probing = false
+	s.mu.Unlock()
+}
+
+func (s *sampler) wait(ctx context.Context, rd *round) error {
+	select {
+	case <-rd.done:
+		return rd.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
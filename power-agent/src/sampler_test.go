@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedPoll is a fake pollOnce that counts rounds and blocks each one until
+// release is closed.
+type gatedPoll struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func newGatedPoll() *gatedPoll {
+	return &gatedPoll{started: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (g *gatedPoll) poll(time.Duration) (State, error) {
+	g.calls.Add(1)
+	g.started <- struct{}{}
+	<-g.release
+	return State{Timestamp: time.Now(), TempC: 50}, g.err
+}
+
+func TestSamplerJoinsInflightRound(t *testing.T) {
+	g := newGatedPoll()
+	var c cache
+	s := &sampler{c: &c, minGap: time.Hour, poll: g.poll}
+
+	rd := s.start(false)
+	<-g.started
+	// later callers share the round, on-demand ones despite minGap
+	for _, limited := range []bool{false, true, true} {
+		if got := s.start(limited); got != rd {
+			t.Fatalf("limited=%v: started a new round", limited)
+		}
+	}
+	close(g.release)
+	if err := s.wait(context.Background(), rd); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.calls.Load(); n != 1 {
+		t.Fatalf("%d rounds, want 1", n)
+	}
+	if c.Get().TempC != 50 {
+		t.Fatalf("round not recorded: %+v", c.Get())
+	}
+}
+
+func TestSamplerRateLimit(t *testing.T) {
+	g := newGatedPoll()
+	close(g.release)
+	var c cache
+	s := &sampler{c: &c, minGap: time.Hour, poll: g.poll}
+	if err := s.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a recent enough sample needs no round
+	if polled, err := s.Refresh(context.Background(), time.Minute); polled || err != nil {
+		t.Fatalf("polled %v err %v, want cached", polled, err)
+	}
+	// an older one would, but not within minGap of the last round
+	if polled, err := s.Refresh(context.Background(), 0); polled || !errors.Is(err, errRateLimited) {
+		t.Fatalf("polled %v err %v, want errRateLimited", polled, err)
+	}
+	// the background ticker is not limited
+	if err := s.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.minGap = 0
+	if polled, err := s.Refresh(context.Background(), 0); !polled || err != nil {
+		t.Fatalf("polled %v err %v, want a round", polled, err)
+	}
+	if n := g.calls.Load(); n != 3 {
+		t.Fatalf("%d rounds, want 3", n)
+	}
+}
+
+func TestSamplerCancel(t *testing.T) {
+	g := newGatedPoll()
+	g.err = errors.New("vchi")
+	var c cache
+	s := &sampler{c: &c, poll: g.poll}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Refresh(ctx, 0)
+		done <- err
+	}()
+	<-g.started
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err %v, want context.Canceled", err)
+	}
+
+	// the round itself finishes and is recorded for everyone else
+	close(g.release)
+	if err := s.Poll(context.Background()); err == nil || err.Error() != "vchi" {
+		t.Fatalf("err %v, want vchi", err)
+	}
+	if h := c.Health(); h.Failures < 1 || h.Heartbeat.IsZero() {
+		t.Fatalf("health %+v, want the failed round recorded", h)
+	}
+}
+
+func TestSamplerProbesDoNotDelayRound(t *testing.T) {
+	g := newGatedPoll()
+	close(g.release)
+	var c cache
+	slow := probe{Name: "slow", Command: "sh", Args: []string{"-c", "sleep 0.3; echo 7"}, scale: 1, timeout: 2 * time.Second}
+	s := &sampler{c: &c, poll: g.poll, probes: []probe{slow}}
+
+	start := time.Now()
+	if err := s.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("round took %s, waiting on the probe", d)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Get().Custom["slow"] != 7 {
+		if time.Now().After(deadline) {
+			t.Fatalf("probe value never recorded: %+v", c.Get())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// a later good round keeps the probe values
+	if err := s.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Get().Custom["slow"] != 7 {
+		t.Fatalf("round dropped the probe values: %+v", c.Get())
+	}
+}
@@ -0,0 +1,458 @@
+// Package admission is battery-aware admission control for request-serving
+// functions. Instead of the binary should_run of a policy, the allowed
+// request rate and concurrency scale continuously with the power reading:
+//
+//	factor = curve(battery_percent), raised to ChargingFactor while charging
+//	         and to SolarFactor while solar is available
+//
+// The curve is piecewise linear; the default gives 25% of the configured
+// rate at 40% battery and 10% at 15%. Below PriorityOnlyBelow (and neither
+// charging nor on solar) only priority classes are admitted.
+//
+// Requests are sorted into classes by a header (default X-Priority); every
+// class has its own token bucket whose rate and burst are scaled by the
+// factor, optionally one per client (ClientHeader). Rejected requests get
+// 429 with Retry-After.
+//
+// Both headers are taken from the request as is, so any caller can claim
+// the priority class or another client's bucket. Only rely on them behind a
+// gateway that sets or strips them, or name a header that only trusted
+// callers can set (ADMISSION_CLASS_HEADER, ADMISSION_CLIENT_HEADER).
+//
+//	ctl := admission.New(cfg, powermw.FromClient(client, PowerStatus.reading))
+//	mux.Handle("/", ctl.Middleware(h))
+package admission
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powermw"
+)
+
+// Point is one point of the battery curve.
+type Point struct {
+	Percent float64 // battery percent
+	Factor  float64 // share of the configured capacity, 0..1
+}
+
+// Class is a traffic class with its own budget at full power.
+type Class struct {
+	Name     string
+	Rate     float64 // requests per second
+	Burst    float64 // bucket size
+	Priority bool    // still admitted below PriorityOnlyBelow
+}
+
+// Config describes capacity at full power and how it shrinks.
+type Config struct {
+	Classes           []Class // must contain a class named DefaultClass
+	MaxConcurrent     int     // in-flight requests at full power, 0 = unlimited
+	Curve             []Point // sorted by Percent
+	ChargingFactor    float64
+	SolarFactor       float64
+	PriorityOnlyBelow float64 // battery percent
+	UnknownFactor     float64 // factor while the reading is unknown
+	ClassHeader       string  // header whose value names the class (client-controlled, see the package doc)
+	ClientHeader      string  // if set, one bucket per class and client
+}
+
+// DefaultClass gets requests without (or with an unknown) class header.
+const DefaultClass = "default"
+
+// DefaultCurve: 0% at empty, 10% at 15%, 25% at 40%, 60% at 60%, full at 100%.
+var DefaultCurve = []Point{{0, 0}, {15, 0.1}, {40, 0.25}, {60, 0.6}, {100, 1}}
+
+// Rejection reasons.
+const (
+	ReasonRate        = "rate"
+	ReasonConcurrency = "concurrency"
+	ReasonPriority    = "priority_only"
+)
+
+// Factor returns the share of capacity allowed for reading r.
+func (c *Config) Factor(r policy.Reading) float64 {
+	f := interpolate(c.Curve, r.BatteryPercent)
+	if r.IsCharging {
+		f = max(f, c.ChargingFactor)
+	}
+	if r.SolarAvailable {
+		f = max(f, c.SolarFactor)
+	}
+	return min(max(f, 0), 1)
+}
+
+// priorityOnly reports whether only priority classes may pass.
+func (c *Config) priorityOnly(r policy.Reading) bool {
+	return r.BatteryPercent < c.PriorityOnlyBelow && !r.IsCharging && !r.SolarAvailable
+}
+
+func interpolate(curve []Point, x float64) float64 {
+	if len(curve) == 0 {
+		return 1
+	}
+	if x <= curve[0].Percent {
+		return curve[0].Factor
+	}
+	for i := 1; i < len(curve); i++ {
+		a, b := curve[i-1], curve[i]
+		if x <= b.Percent {
+			return a.Factor + (b.Factor-a.Factor)*(x-a.Percent)/(b.Percent-a.Percent)
+		}
+	}
+	return curve[len(curve)-1].Factor
+}
+
+// Validate checks the config and fills in defaults. Class names are
+// lowercased, as class headers are matched case-insensitively.
+func (c *Config) Validate() error {
+	if c.Curve == nil {
+		c.Curve = DefaultCurve
+	}
+	if c.ClassHeader == "" {
+		c.ClassHeader = "X-Priority"
+	}
+	for i, p := range c.Curve {
+		if p.Factor < 0 || p.Factor > 1 {
+			return fmt.Errorf("curve point %g%%: factor %g not in 0..1", p.Percent, p.Factor)
+		}
+		if i > 0 && p.Percent <= c.Curve[i-1].Percent {
+			return fmt.Errorf("curve points must be sorted by percent")
+		}
+	}
+	seen := map[string]bool{}
+	for i := range c.Classes {
+		cl := &c.Classes[i]
+		cl.Name = strings.ToLower(cl.Name)
+		if cl.Rate < 0 || cl.Burst < 0 {
+			return fmt.Errorf("class %s: negative rate or burst", cl.Name)
+		}
+		if seen[cl.Name] {
+			return fmt.Errorf("class %s defined twice", cl.Name)
+		}
+		seen[cl.Name] = true
+	}
+	if !seen[DefaultClass] {
+		return fmt.Errorf("no %q class", DefaultClass)
+	}
+	return nil
+}
+
+// FromEnv reads ADMISSION_*; it returns nil unless ADMISSION_MODE=on.
+//
+//	ADMISSION_MODE                 off (default) | on
+//	ADMISSION_RATE                 requests/s at full power (default 10)
+//	ADMISSION_BURST                bucket size at full power (default = rate)
+//	ADMISSION_CLASSES              "name:rate:burst[:priority],..." (default
+//	                               "priority:<rate>:<burst>:priority,default:<rate>:<burst>")
+//	ADMISSION_MAX_CONCURRENT       in-flight requests at full power (default 0 = unlimited)
+//	ADMISSION_CURVE                "percent:factor,..." (default "0:0,15:0.1,40:0.25,60:0.6,100:1")
+//	ADMISSION_CHARGING_FACTOR      factor while charging (default 1)
+//	ADMISSION_SOLAR_FACTOR         factor while solar is available (default 0.75)
+//	ADMISSION_PRIORITY_ONLY_BELOW  battery percent (default 15)
+//	ADMISSION_UNKNOWN_FACTOR       factor without a reading (default 1, fail-open)
+//	ADMISSION_CLASS_HEADER         header naming the class (default X-Priority; set by
+//	                               clients unless a gateway overwrites it, see above)
+//	ADMISSION_CLIENT_HEADER        per-client buckets keyed by this header, e.g. X-Client-ID
+func FromEnv(getenv func(string) string) (*Config, error) {
+	switch strings.ToLower(getenv("ADMISSION_MODE")) {
+	case "on", "true", "1":
+	default:
+		return nil, nil
+	}
+	c := &Config{
+		ChargingFactor:    1,
+		SolarFactor:       0.75,
+		PriorityOnlyBelow: 15,
+		UnknownFactor:     1,
+		ClassHeader:       getenv("ADMISSION_CLASS_HEADER"),
+		ClientHeader:      getenv("ADMISSION_CLIENT_HEADER"),
+	}
+	num := func(key string, def float64) (float64, error) {
+		v := getenv(key)
+		if v == "" {
+			return def, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("%s: want a non-negative number, got %q", key, v)
+		}
+		return f, nil
+	}
+	rate, err := num("ADMISSION_RATE", 10)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := num("ADMISSION_BURST", rate)
+	if err != nil {
+		return nil, err
+	}
+	if v := getenv("ADMISSION_MAX_CONCURRENT"); v != "" {
+		if c.MaxConcurrent, err = strconv.Atoi(v); err != nil || c.MaxConcurrent < 0 {
+			return nil, fmt.Errorf("ADMISSION_MAX_CONCURRENT: want a non-negative integer, got %q", v)
+		}
+	}
+	for key, dst := range map[string]*float64{
+		"ADMISSION_CHARGING_FACTOR":     &c.ChargingFactor,
+		"ADMISSION_SOLAR_FACTOR":        &c.SolarFactor,
+		"ADMISSION_PRIORITY_ONLY_BELOW": &c.PriorityOnlyBelow,
+		"ADMISSION_UNKNOWN_FACTOR":      &c.UnknownFactor,
+	} {
+		if *dst, err = num(key, *dst); err != nil {
+			return nil, err
+		}
+	}
+
+	classes := getenv("ADMISSION_CLASSES")
+	if classes == "" {
+		classes = fmt.Sprintf("priority:%g:%g:priority,default:%g:%g", rate, burst, rate, burst)
+	}
+	if c.Classes, err = parseClasses(classes); err != nil {
+		return nil, fmt.Errorf("ADMISSION_CLASSES: %w", err)
+	}
+	if v := getenv("ADMISSION_CURVE"); v != "" {
+		if c.Curve, err = parseCurve(v); err != nil {
+			return nil, fmt.Errorf("ADMISSION_CURVE: %w", err)
+		}
+	}
+	return c, c.Validate()
+}
+
+func parseClasses(s string) ([]Class, error) {
+	var out []Class
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		f := strings.Split(item, ":")
+		if len(f) < 3 || len(f) > 4 || (len(f) == 4 && f[3] != "priority") {
+			return nil, fmt.Errorf("%q: want name:rate:burst[:priority]", item)
+		}
+		rate, err1 := strconv.ParseFloat(f[1], 64)
+		burst, err2 := strconv.ParseFloat(f[2], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%q: bad rate or burst", item)
+		}
+		out = append(out, Class{Name: f[0], Rate: rate, Burst: burst, Priority: len(f) == 4})
+	}
+	return out, nil
+}
+
+func parseCurve(s string) ([]Point, error) {
+	var out []Point
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		pct, fac, ok := strings.Cut(item, ":")
+		p, err1 := strconv.ParseFloat(pct, 64)
+		f, err2 := strconv.ParseFloat(fac, 64)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%q: want percent:factor", item)
+		}
+		out = append(out, Point{p, f})
+	}
+	return out, nil
+}
+
+// Controller admits or rejects requests.
+type Controller struct {
+	cfg     Config
+	source  powermw.Source
+	classes map[string]Class
+	now     func() time.Time
+
+	mu       sync.Mutex
+	buckets  map[bucketKey]*bucket
+	inflight int
+	admitted map[string]uint64    // by class
+	rejected map[[2]string]uint64 // by class, reason
+	lastGC   time.Time
+}
+
+type bucketKey struct{ class, client string }
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a controller for a validated config.
+func New(cfg Config, source powermw.Source) *Controller {
+	c := &Controller{
+		cfg:      cfg,
+		source:   source,
+		classes:  map[string]Class{},
+		now:      time.Now,
+		buckets:  map[bucketKey]*bucket{},
+		admitted: map[string]uint64{},
+		rejected: map[[2]string]uint64{},
+	}
+	for _, cl := range cfg.Classes {
+		c.classes[cl.Name] = cl // lowercased by Validate
+	}
+	return c
+}
+
+// Decision is the outcome for one request.
+type Decision struct {
+	Admit      bool
+	Class      string
+	Factor     float64
+	Reason     string // why it was rejected
+	RetryAfter int    // seconds
+}
+
+// Middleware rejects requests over the current budget with 429.
+func (c *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := c.Admit(r)
+		w.Header().Set("X-Admission-Class", d.Class)
+		w.Header().Set("X-Admission-Factor", strconv.FormatFloat(d.Factor, 'f', 2, 64))
+		if !d.Admit {
+			w.Header().Set("Retry-After", strconv.Itoa(d.RetryAfter))
+			http.Error(w, "over the power budget ("+d.Reason+"), retry later", http.StatusTooManyRequests)
+			return
+		}
+		defer c.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Admit decides on r. An admitted request holds a concurrency slot until
+// Done is called; Middleware does that.
+func (c *Controller) Admit(r *http.Request) Decision {
+	info := c.source()
+	f := c.cfg.UnknownFactor
+	priorityOnly := false
+	if info.Unknown == "" {
+		f = c.cfg.Factor(info.Reading)
+		priorityOnly = c.cfg.priorityOnly(info.Reading)
+	}
+	cl, ok := c.classes[strings.ToLower(r.Header.Get(c.cfg.ClassHeader))]
+	if !ok {
+		cl = c.classes[DefaultClass]
+	}
+	d := Decision{Class: cl.Name, Factor: f}
+	client := ""
+	if c.cfg.ClientHeader != "" {
+		client = r.Header.Get(c.cfg.ClientHeader)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.gc(now)
+	switch {
+	case priorityOnly && !cl.Priority:
+		d.Reason, d.RetryAfter = ReasonPriority, 60
+	case c.cfg.MaxConcurrent > 0 && c.inflight >= c.concurrencyLimit(f):
+		d.Reason, d.RetryAfter = ReasonConcurrency, 1
+	default:
+		wait, ok := c.take(bucketKey{cl.Name, client}, cl.Rate*f, max(cl.Burst*f, 1), now)
+		if !ok {
+			d.Reason, d.RetryAfter = ReasonRate, int(math.Ceil(min(wait, 3600)))
+		}
+	}
+	if d.Reason != "" {
+		c.rejected[[2]string{cl.Name, d.Reason}]++
+		return d
+	}
+	d.Admit = true
+	c.inflight++
+	c.admitted[cl.Name]++
+	return d
+}
+
+// Done releases the concurrency slot of an admitted request.
+func (c *Controller) Done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight--
+}
+
+// concurrencyLimit must be called with c.mu held.
+func (c *Controller) concurrencyLimit(f float64) int {
+	return max(int(math.Ceil(float64(c.cfg.MaxConcurrent)*f)), 1)
+}
+
+// take must be called with c.mu held. It refills the bucket at rate up to
+// burst and takes a token, or returns the seconds until one is available.
+func (c *Controller) take(k bucketKey, rate, burst float64, now time.Time) (float64, bool) {
+	b := c.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		c.buckets[k] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, burst)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if rate <= 0 {
+		return 60, false
+	}
+	return (1 - b.tokens) / rate, false
+}
+
+// gc drops idle per-client buckets; must be called with c.mu held.
+func (c *Controller) gc(now time.Time) {
+	if c.cfg.ClientHeader == "" || now.Sub(c.lastGC) < time.Minute {
+		return
+	}
+	c.lastGC = now
+	for k, b := range c.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(c.buckets, k)
+		}
+	}
+}
+
+// WriteMetrics writes the admission counters in the Prometheus text format
+// (see powermetrics.Config.Collectors).
+func (c *Controller) WriteMetrics(w io.Writer) {
+	info := c.source()
+	f := c.cfg.UnknownFactor
+	priorityOnly := false
+	if info.Unknown == "" {
+		f, priorityOnly = c.cfg.Factor(info.Reading), c.cfg.priorityOnly(info.Reading)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP power_admission_factor Share of the configured capacity currently allowed.\n# TYPE power_admission_factor gauge\npower_admission_factor %g\n", f)
+	fmt.Fprintf(w, "# HELP power_admission_priority_only 1 while only priority classes are admitted.\n# TYPE power_admission_priority_only gauge\npower_admission_priority_only %d\n", b2i(priorityOnly))
+	fmt.Fprintf(w, "# HELP power_admission_inflight Admitted requests in flight.\n# TYPE power_admission_inflight gauge\npower_admission_inflight %d\n", c.inflight)
+
+	names := make([]string, 0, len(c.classes))
+	for name := range c.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "# HELP power_admission_admitted_total Admitted requests by class.\n# TYPE power_admission_admitted_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "power_admission_admitted_total{class=%q} %d\n", name, c.admitted[name])
+	}
+	fmt.Fprint(w, "# HELP power_admission_rejected_total Rejected requests by class and reason.\n# TYPE power_admission_rejected_total counter\n")
+	for _, name := range names {
+		for _, reason := range []string{ReasonRate, ReasonConcurrency, ReasonPriority} {
+			fmt.Fprintf(w, "power_admission_rejected_total{class=%q,reason=%q} %d\n", name, reason, c.rejected[[2]string{name, reason}])
+		}
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
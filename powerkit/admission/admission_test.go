@@ -0,0 +1,251 @@
+package admission
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powermw"
+)
+
+func TestFactor(t *testing.T) {
+	c := Config{ChargingFactor: 1, SolarFactor: 0.75}
+	if err := c.Validate(); err == nil {
+		t.Fatal("config without a default class validated")
+	}
+	c.Classes = []Class{{Name: DefaultClass, Rate: 1, Burst: 1}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		r    policy.Reading
+		want float64
+	}{
+		{policy.Reading{BatteryPercent: 100}, 1},
+		{policy.Reading{BatteryPercent: 80}, 0.8},
+		{policy.Reading{BatteryPercent: 40}, 0.25},
+		{policy.Reading{BatteryPercent: 27.5}, 0.175},
+		{policy.Reading{BatteryPercent: 0}, 0},
+		{policy.Reading{BatteryPercent: 10, IsCharging: true}, 1},
+		{policy.Reading{BatteryPercent: 10, SolarAvailable: true}, 0.75},
+		{policy.Reading{BatteryPercent: 90, SolarAvailable: true}, 0.9},
+	} {
+		if got := c.Factor(tt.r); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Factor(%+v) = %g, want %g", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+	if c, err := FromEnv(getenv); c != nil || err != nil {
+		t.Fatalf("off: %v %v", c, err)
+	}
+	env["ADMISSION_MODE"] = "on"
+	env["ADMISSION_RATE"] = "20"
+	c, err := FromEnv(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Classes) != 2 || !c.Classes[0].Priority || c.Classes[1].Rate != 20 || c.Classes[1].Burst != 20 {
+		t.Fatalf("default classes = %+v", c.Classes)
+	}
+	env["ADMISSION_MAX_CONCURRENT"] = "3"
+	if c, err = FromEnv(getenv); err != nil || c.MaxConcurrent != 3 {
+		t.Fatalf("max concurrent: %+v %v", c, err)
+	}
+	env["ADMISSION_CLASSES"] = "gold:5:5:priority,default:2:4,batch:1:1"
+	env["ADMISSION_CURVE"] = "0:0,50:0.5,100:1"
+	if c, err = FromEnv(getenv); err != nil || len(c.Classes) != 3 || len(c.Curve) != 3 {
+		t.Fatalf("%+v %v", c, err)
+	}
+	for k, v := range map[string]string{
+		"ADMISSION_CLASSES":        "gold:5:5:priority",
+		"ADMISSION_CURVE":          "50:0.5,10:1",
+		"ADMISSION_RATE":           "fast",
+		"ADMISSION_MAX_CONCURRENT": "2.5",
+	} {
+		old := env[k]
+		env[k] = v
+		if _, err := FromEnv(getenv); err == nil {
+			t.Errorf("%s=%s accepted", k, v)
+		}
+		env[k] = old
+	}
+}
+
+// fixedSource is a Source with a settable reading.
+type fixedSource struct{ info powermw.Info }
+
+func (s *fixedSource) get() powermw.Info { return s.info }
+
+func TestAdmission(t *testing.T) {
+	cfg := Config{
+		Classes: []Class{
+			{Name: "priority", Rate: 10, Burst: 10, Priority: true},
+			{Name: DefaultClass, Rate: 10, Burst: 10},
+		},
+		ChargingFactor:    1,
+		SolarFactor:       0.75,
+		PriorityOnlyBelow: 15,
+		UnknownFactor:     1,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	src := &fixedSource{}
+	ctl := New(cfg, src.get)
+	now := time.Unix(1000, 0)
+	ctl.now = func() time.Time { return now }
+
+	h := ctl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(class string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if class != "" {
+			req.Header.Set("X-Priority", class)
+		}
+		h.ServeHTTP(w, req)
+		return w
+	}
+	burst := func(class string) (admitted int) {
+		for i := 0; i < 20; i++ {
+			if send(class).Code == http.StatusOK {
+				admitted++
+			}
+		}
+		return admitted
+	}
+
+	// charging: full budget
+	src.info = powermw.Info{Reading: policy.Reading{BatteryPercent: 30, IsCharging: true}}
+	if n := burst(""); n != 10 {
+		t.Fatalf("charging admitted %d, want the full burst of 10", n)
+	}
+	w := send("")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("over budget: %d Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// 40% on battery: a quarter of the rate and burst
+	now = now.Add(time.Minute)
+	src.info.Reading = policy.Reading{BatteryPercent: 40}
+	if n := burst("unknown-class"); n != 2 {
+		t.Fatalf("at 40%% admitted %d, want 2 (burst 10 x 0.25)", n)
+	}
+	now = now.Add(time.Second) // refills 2.5 tokens, capped at the burst
+	if n := burst(""); n != 2 {
+		t.Fatalf("after 1s at 40%% admitted %d, want 2", n)
+	}
+	if w := send(""); w.Header().Get("X-Admission-Factor") != "0.25" {
+		t.Fatalf("X-Admission-Factor = %q", w.Header().Get("X-Admission-Factor"))
+	}
+
+	// below 15%: priority only
+	now = now.Add(time.Minute)
+	src.info.Reading = policy.Reading{BatteryPercent: 10}
+	if w := send(""); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("default class at 10%%: %d", w.Code)
+	}
+	if w := send("priority"); w.Code != http.StatusOK || w.Header().Get("X-Admission-Class") != "priority" {
+		t.Fatalf("priority class at 10%%: %d", w.Code)
+	}
+
+	// unknown reading: UnknownFactor (fail-open)
+	now = now.Add(time.Minute)
+	src.info = powermw.Info{Unknown: "no reading"}
+	if n := burst(""); n != 10 {
+		t.Fatalf("unknown admitted %d, want 10", n)
+	}
+
+	var b strings.Builder
+	ctl.WriteMetrics(&b)
+	for _, want := range []string{
+		`power_admission_admitted_total{class="default"} 24`,
+		`power_admission_admitted_total{class="priority"} 1`,
+		`power_admission_rejected_total{class="default",reason="priority_only"} 1`,
+		`power_admission_factor 1`,
+		`power_admission_inflight 0`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestConcurrencyAndClients(t *testing.T) {
+	cfg := Config{
+		Classes:       []Class{{Name: DefaultClass, Rate: 100, Burst: 2}},
+		MaxConcurrent: 4,
+		ClientHeader:  "X-Client-ID",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	src := &fixedSource{info: powermw.Info{Reading: policy.Reading{BatteryPercent: 40}}} // factor 0.25
+	ctl := New(cfg, src.get)
+	now := time.Unix(1000, 0)
+	ctl.now = func() time.Time { return now }
+
+	req := func(client string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Client-ID", client)
+		return r
+	}
+	// 4 x 0.25 -> one request in flight
+	if d := ctl.Admit(req("a")); !d.Admit {
+		t.Fatalf("client a: %+v", d)
+	}
+	if d := ctl.Admit(req("b")); d.Admit || d.Reason != ReasonConcurrency {
+		t.Fatalf("client b while a is in flight: %+v, want concurrency rejection", d)
+	}
+	ctl.Done()
+	// each client has its own bucket (burst 2 x 0.25 -> 1)
+	if d := ctl.Admit(req("a")); d.Admit || d.Reason != ReasonRate {
+		t.Fatalf("client a again: %+v, want rate rejection", d)
+	}
+	if d := ctl.Admit(req("b")); !d.Admit {
+		t.Fatalf("client b: %+v", d)
+	}
+	ctl.Done()
+}
+
+func TestClassNamesCaseInsensitive(t *testing.T) {
+	classes, err := parseClasses("Gold:10:10:priority,DEFAULT:10:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Classes: classes, ChargingFactor: 1}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctl := New(cfg, (&fixedSource{info: powermw.Info{Reading: policy.Reading{IsCharging: true}}}).get)
+	for _, class := range []string{"gold", "GOLD", ""} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Priority", class)
+		if d := ctl.Admit(r); !d.Admit {
+			t.Fatalf("class %q: %+v", class, d)
+		}
+		ctl.Done()
+	}
+	var b strings.Builder
+	ctl.WriteMetrics(&b)
+	for _, want := range []string{
+		`power_admission_admitted_total{class="gold"} 2`,
+		`power_admission_admitted_total{class="default"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in\n%s", want, b.String())
+		}
+	}
+
+	dup := Config{Classes: []Class{{Name: "Gold"}, {Name: "gold"}, {Name: DefaultClass}}}
+	if err := dup.Validate(); err == nil || !strings.Contains(err.Error(), "twice") {
+		t.Fatalf("Gold and gold: err %v, want defined twice", err)
+	}
+}
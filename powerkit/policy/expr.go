@@ -0,0 +1,159 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// CEL expressions: with POWER_POLICY_EXPR (or "expr" in the policy file) the
+// node is in the policy's non-ok state whenever the Common Expression
+// Language expression is true, e.g.
+//
+//	temp_c > 65.0 && clock_arm_mhz < 1200.0 || battery_percent < 20.0 && !is_charging
+//
+// Variables are the signal names of Reading.Values. Numbers are doubles;
+// comparisons with int literals work too. The expression is parsed and
+// type-checked by Validate, so a typo fails at startup rather than per
+// request. Evaluation stops at exprCostLimit.
+
+var celEnv = mustEnv()
+
+const (
+	exprCostLimit = 10000   // CEL cost units, far above any sane policy
+	exprMaxLen    = 4 << 10 // bytes of expression source, and of a POST body
+)
+
+func mustEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.ParserExpressionSizeLimit(exprMaxLen),
+		cel.CrossTypeNumericComparisons(true),
+		cel.Variable("temp_c", cel.DoubleType),
+		cel.Variable("volt_v", cel.DoubleType),
+		cel.Variable("clock_arm_mhz", cel.DoubleType),
+		cel.Variable("undervoltage", cel.BoolType),
+		cel.Variable("freq_capped", cel.BoolType),
+		cel.Variable("throttled", cel.BoolType),
+		cel.Variable("battery_percent", cel.DoubleType),
+		cel.Variable("is_charging", cel.BoolType),
+		cel.Variable("solar_available", cel.BoolType),
+		cel.Variable("time_of_day", cel.StringType),
+		cel.Variable("night", cel.BoolType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// Compile parses and type-checks a boolean expression over the signals.
+func Compile(expr string) (cel.Program, error) {
+	ast, iss := celEnv.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("policy: expr %q: %w", expr, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("policy: expr %q: must be bool, is %s", expr, ast.OutputType())
+	}
+	prg, err := celEnv.Program(ast, cel.CostLimit(exprCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("policy: expr %q: %w", expr, err)
+	}
+	return prg, nil
+}
+
+// evalExpr runs a compiled expression against a reading.
+func evalExpr(prg cel.Program, r Reading) (bool, error) {
+	out, _, err := prg.Eval(r.Values())
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expr result is %T, not bool", out.Value())
+	}
+	return b, nil
+}
+
+// EvalDebugFromEnv reports whether POLICY_EVAL_DEBUG lets /policy/evaluate
+// run ad-hoc expressions: "1", "true" or "on".
+func EvalDebugFromEnv(getenv func(string) string) bool {
+	switch strings.ToLower(getenv("POLICY_EVAL_DEBUG")) {
+	case "1", "true", "on":
+		return true
+	}
+	return false
+}
+
+// EvaluateHandler serves /policy/evaluate: the decision of p for the current
+// reading. current returns the reading, or why there is none to trust (see
+// powermw.Info.Unknown); then the answer is the unknown decision instead of
+// an evaluation of zero values.
+//
+// With debug (see EvalDebugFromEnv) it also tests expressions sent by the
+// client:
+//
+//	GET  /policy/evaluate?expr=temp_c+>+65.0
+//	POST /policy/evaluate  {"expr": "battery_percent < 20.0 && !is_charging"}
+func EvaluateHandler(p *Policy, current func() (Reading, string), debug bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expr := r.URL.Query().Get("expr")
+		if r.Method == http.MethodPost {
+			var body struct {
+				Expr string `json:"expr"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, exprMaxLen)).Decode(&body); err != nil {
+				http.Error(w, "bad body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			expr = body.Expr
+		}
+		if expr != "" && !debug {
+			http.Error(w, "expressions are disabled (POLICY_EVAL_DEBUG)", http.StatusForbidden)
+			return
+		}
+
+		rd, unknown := current()
+		out := map[string]any{}
+		if unknown == "" {
+			out["reading"] = rd.Values()
+		}
+		if expr == "" {
+			out["policy"] = p
+			if unknown != "" {
+				out["decision"] = p.Unknown(unknown)
+			} else {
+				out["decision"] = p.Evaluate(rd)
+			}
+			writeJSON(w, http.StatusOK, out)
+			return
+		}
+
+		prg, err := Compile(expr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"expr": expr, "error": err.Error()})
+			return
+		}
+		out["expr"] = expr
+		if unknown != "" {
+			out["state"], out["error"] = Unknown, unknown
+		} else if res, err := evalExpr(prg, rd); err != nil {
+			out["error"] = err.Error()
+		} else {
+			out["result"] = res
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+}
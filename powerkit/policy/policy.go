@@ -0,0 +1,381 @@
+// Package policy decides whether a node's power situation is ok or degraded.
+//
+// A Policy is a list of rules over the signals in a Reading (thermal values
+// from power-agent's /power, battery values from battery-sim's /status),
+// combined with any/all/weighted. Policies are loaded from the environment
+// or a JSON file (typically a mounted ConfigMap) so thresholds can change
+// without a rebuild:
+//
+//	POWER_POLICY_FILE       JSON file with a Policy; wins over the variables below
+//	POWER_POLICY_RULES      comma-separated rules, e.g. "undervoltage,throttled,temp_c>70*2,!is_charging"
+//	POWER_POLICY_COMBINE    any | all | weighted
+//	POWER_POLICY_THRESHOLD  weighted: total weight at which the node counts as degraded
+//	POWER_POLICY_STATE      name reported for the non-ok state, e.g. "degraded" or "low"
+//	POWER_POLICY_EXPR       CEL expression used instead of the rules (see expr.go)
+//	POWER_POLICY_ON_UNKNOWN open (default) | closed: whether an unknown state
+//	                        (no trustworthy reading) counts as degraded
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Reading holds the signals a policy can look at.
+type Reading struct {
+	TempC        float64
+	VoltV        float64
+	ClockArmMHz  float64
+	Undervoltage bool
+	FreqCapped   bool
+	Throttled    bool
+
+	BatteryPercent float64
+	IsCharging     bool
+	SolarAvailable bool
+	TimeOfDay      string // "day" | "night"
+}
+
+// Values returns the reading keyed by signal name (the JSON field names of
+// the power APIs, plus "night").
+func (r Reading) Values() map[string]any {
+	return map[string]any{
+		"temp_c":          r.TempC,
+		"volt_v":          r.VoltV,
+		"clock_arm_mhz":   r.ClockArmMHz,
+		"undervoltage":    r.Undervoltage,
+		"freq_capped":     r.FreqCapped,
+		"throttled":       r.Throttled,
+		"battery_percent": r.BatteryPercent,
+		"is_charging":     r.IsCharging,
+		"solar_available": r.SolarAvailable,
+		"time_of_day":     r.TimeOfDay,
+		"night":           r.TimeOfDay == "night",
+	}
+}
+
+// Rule matches one signal. Numeric signals need Op and Value; boolean
+// signals match when true (or false with Not).
+type Rule struct {
+	Signal string  `json:"signal"`
+	Op     string  `json:"op,omitempty"` // > >= < <= == !=
+	Value  float64 `json:"value,omitempty"`
+	Not    bool    `json:"not,omitempty"`
+	Weight float64 `json:"weight,omitempty"` // combine=weighted only, default 1
+}
+
+func (r Rule) String() string {
+	s := r.Signal
+	switch {
+	case r.Op != "":
+		s += r.Op + strconv.FormatFloat(r.Value, 'g', -1, 64)
+	case r.Not:
+		s = "!" + s
+	}
+	if r.Weight != 0 && r.Weight != 1 {
+		s += "*" + strconv.FormatFloat(r.Weight, 'g', -1, 64)
+	}
+	return s
+}
+
+// Policy is a set of rules and how to combine them, or a CEL expression.
+type Policy struct {
+	State     string  `json:"state,omitempty"`     // non-ok state name, default "degraded"
+	Combine   string  `json:"combine,omitempty"`   // any (default) | all | weighted
+	Threshold float64 `json:"threshold,omitempty"` // weighted: degraded when matched weight >= threshold
+	Rules     []Rule  `json:"rules,omitempty"`
+	Expr      string  `json:"expr,omitempty"`       // replaces Rules when set
+	OnUnknown string  `json:"on_unknown,omitempty"` // open (default) | closed
+
+	prg cel.Program
+}
+
+// Decision is the outcome of evaluating a Policy.
+type Decision struct {
+	State    string   `json:"state"` // "ok", "unknown" or the policy's state name
+	Degraded bool     `json:"degraded"`
+	Reasons  []string `json:"reasons,omitempty"`
+	Score    float64  `json:"score,omitempty"` // matched weight
+}
+
+const (
+	// OK is the name of the healthy state.
+	OK = "ok"
+	// Unknown is the state when there is no trustworthy reading, e.g. the
+	// power API is down or only has a stale sample.
+	Unknown = "unknown"
+)
+
+// OK reports whether the decision allows normal operation.
+func (d Decision) OK() bool { return d.State == OK }
+
+// Thermal is the default policy of the thermal-aware functions.
+var Thermal = Policy{
+	State:   "degraded",
+	Combine: "any",
+	Rules: []Rule{
+		{Signal: "undervoltage"},
+		{Signal: "freq_capped"},
+		{Signal: "throttled"},
+		{Signal: "temp_c", Op: ">", Value: 70},
+	},
+}
+
+// Battery is the default policy of battery-aware services: low when the
+// battery is below 30% and neither charging nor on solar.
+var Battery = Policy{
+	State:   "low",
+	Combine: "all",
+	Rules: []Rule{
+		{Signal: "battery_percent", Op: "<", Value: 30},
+		{Signal: "is_charging", Not: true},
+		{Signal: "solar_available", Not: true},
+	},
+}
+
+var numericSignals = map[string]bool{
+	"temp_c": true, "volt_v": true, "clock_arm_mhz": true, "battery_percent": true,
+}
+
+var boolSignals = map[string]bool{
+	"undervoltage": true, "freq_capped": true, "throttled": true,
+	"is_charging": true, "solar_available": true, "night": true,
+}
+
+var ops = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Load returns the policy configured in the environment, or def when
+// nothing is configured. Variables that are set override def's fields.
+func Load(def Policy) (*Policy, error) {
+	p := def
+	p.Rules = append([]Rule(nil), def.Rules...)
+
+	if path := os.Getenv("POWER_POLICY_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+		p = Policy{State: def.State}
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("policy: parse %s: %w", path, err)
+		}
+	} else {
+		if v := os.Getenv("POWER_POLICY_RULES"); v != "" {
+			rules, err := ParseRules(v)
+			if err != nil {
+				return nil, err
+			}
+			p.Rules = rules
+		}
+		if v := os.Getenv("POWER_POLICY_COMBINE"); v != "" {
+			p.Combine = v
+		}
+		if v := os.Getenv("POWER_POLICY_THRESHOLD"); v != "" {
+			t, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("policy: POWER_POLICY_THRESHOLD: %w", err)
+			}
+			p.Threshold = t
+		}
+		if v := os.Getenv("POWER_POLICY_STATE"); v != "" {
+			p.State = v
+		}
+		if v := os.Getenv("POWER_POLICY_EXPR"); v != "" {
+			p.Expr = v
+		}
+	}
+	if v := os.Getenv("POWER_POLICY_ON_UNKNOWN"); v != "" {
+		p.OnUnknown = v
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ParseRules parses the compact rule syntax: comma-separated terms of the
+// form "flag", "!flag" or "signal<op>number", each optionally followed by
+// "*weight".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r Rule
+		if i := strings.LastIndex(term, "*"); i >= 0 {
+			w, err := strconv.ParseFloat(strings.TrimSpace(term[i+1:]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("policy: rule %q: bad weight: %w", term, err)
+			}
+			r.Weight, term = w, strings.TrimSpace(term[:i])
+		}
+		if i := strings.IndexAny(term, "<>=!"); i > 0 {
+			op := strings.TrimRight(term[i:], "0123456789.-+eE ")
+			v, err := strconv.ParseFloat(strings.TrimSpace(term[i+len(op):]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("policy: rule %q: bad value: %w", term, err)
+			}
+			r.Signal, r.Op, r.Value = strings.TrimSpace(term[:i]), strings.TrimSpace(op), v
+		} else if name, ok := strings.CutPrefix(term, "!"); ok {
+			r.Signal, r.Not = strings.TrimSpace(name), true
+		} else {
+			r.Signal = term
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Validate checks signal names, operators and the combinator, or compiles
+// the expression.
+func (p *Policy) Validate() error {
+	if p.State == "" {
+		p.State = "degraded"
+	}
+	if p.State == OK || p.State == Unknown {
+		return fmt.Errorf("policy: state must not be %q", p.State)
+	}
+	switch p.OnUnknown {
+	case "":
+		p.OnUnknown = "open"
+	case "open", "closed":
+	default:
+		return fmt.Errorf("policy: on_unknown must be open or closed, got %q", p.OnUnknown)
+	}
+	if p.Expr != "" {
+		prg, err := Compile(p.Expr)
+		if err != nil {
+			return err
+		}
+		p.prg = prg
+		return nil
+	}
+	switch p.Combine {
+	case "":
+		p.Combine = "any"
+	case "any", "all":
+	case "weighted":
+		if p.Threshold <= 0 {
+			return fmt.Errorf("policy: combine=weighted needs a positive threshold")
+		}
+	default:
+		return fmt.Errorf("policy: unknown combinator %q (want any, all or weighted)", p.Combine)
+	}
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("policy: no rules")
+	}
+	for _, r := range p.Rules {
+		switch {
+		case numericSignals[r.Signal]:
+			if ops[r.Op] == nil {
+				return fmt.Errorf("policy: rule %q: numeric signal needs one of > >= < <= == !=", r)
+			}
+		case boolSignals[r.Signal]:
+			if r.Op != "" {
+				return fmt.Errorf("policy: rule %q: boolean signal takes no operator", r)
+			}
+		default:
+			return fmt.Errorf("policy: rule %q: unknown signal %q (known: %s)", r, r.Signal, knownSignals())
+		}
+	}
+	return nil
+}
+
+func knownSignals() string {
+	var names []string
+	for n := range numericSignals {
+		names = append(names, n)
+	}
+	for n := range boolSignals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Evaluate applies the policy to a reading. An expression that fails at
+// runtime counts as a match, with the error as the reason.
+func (p *Policy) Evaluate(r Reading) Decision {
+	if p.prg != nil {
+		bad, err := evalExpr(p.prg, r)
+		switch {
+		case err != nil:
+			return Decision{State: p.State, Degraded: true, Reasons: []string{"expr error: " + err.Error()}}
+		case bad:
+			return Decision{State: p.State, Degraded: true, Reasons: []string{"expr: " + p.Expr}}
+		}
+		return Decision{State: OK}
+	}
+	vals := r.Values()
+	var reasons []string
+	var score float64
+	matched := 0
+	for _, rule := range p.Rules {
+		if !rule.match(vals) {
+			continue
+		}
+		matched++
+		w := rule.Weight
+		if w == 0 {
+			w = 1
+		}
+		score += w
+		reasons = append(reasons, rule.String())
+	}
+
+	var bad bool
+	switch p.Combine {
+	case "all":
+		bad = matched == len(p.Rules)
+	case "weighted":
+		bad = score >= p.Threshold
+	default:
+		bad = matched > 0
+	}
+	if !bad {
+		return Decision{State: OK, Score: score}
+	}
+	return Decision{State: p.State, Degraded: true, Reasons: reasons, Score: score}
+}
+
+// Unknown returns the decision for a missing or untrustworthy reading. It
+// counts as degraded only with on_unknown=closed.
+func (p *Policy) Unknown(reason string) Decision {
+	return Decision{State: Unknown, Degraded: p.OnUnknown == "closed", Reasons: []string{reason}}
+}
+
+func (r Rule) match(vals map[string]any) bool {
+	switch v := vals[r.Signal].(type) {
+	case float64:
+		return ops[r.Op](v, r.Value)
+	case bool:
+		return v != r.Not
+	}
+	return false
+}
+
+// Limit returns the value of the first comparison rule on signal, e.g. the
+// temperature limit of a thermal policy.
+func (p *Policy) Limit(signal string) (float64, bool) {
+	for _, r := range p.Rules {
+		if r.Signal == signal && r.Op != "" {
+			return r.Value, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,178 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	got, err := ParseRules("undervoltage, !is_charging, temp_c >= 70*2, battery_percent<30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Signal: "undervoltage"},
+		{Signal: "is_charging", Not: true},
+		{Signal: "temp_c", Op: ">=", Value: 70, Weight: 2},
+		{Signal: "battery_percent", Op: "<", Value: 30},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseRules = %+v, want %+v", got, want)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	weighted := Policy{Combine: "weighted", Threshold: 2, Rules: []Rule{
+		{Signal: "temp_c", Op: ">", Value: 65},
+		{Signal: "clock_arm_mhz", Op: "<", Value: 1200},
+		{Signal: "throttled", Weight: 2},
+	}}
+	tests := []struct {
+		name   string
+		policy Policy
+		in     Reading
+		want   string
+	}{
+		{"thermal cool", Thermal, Reading{TempC: 50}, OK},
+		{"thermal hot", Thermal, Reading{TempC: 75}, "degraded"},
+		{"thermal flag", Thermal, Reading{TempC: 40, Undervoltage: true}, "degraded"},
+		{"battery low", Battery, Reading{BatteryPercent: 20}, "low"},
+		{"battery charging", Battery, Reading{BatteryPercent: 20, IsCharging: true}, OK},
+		{"weighted below", weighted, Reading{TempC: 66, ClockArmMHz: 1500}, OK},
+		{"weighted reached", weighted, Reading{TempC: 66, ClockArmMHz: 1000}, "degraded"},
+		{"weighted heavy rule", weighted, Reading{ClockArmMHz: 1500, Throttled: true}, "degraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.policy
+			if err := p.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Evaluate(tt.in); got.State != tt.want {
+				t.Fatalf("Evaluate = %+v, want state %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("POWER_POLICY_RULES", "temp_c>60,throttled")
+	t.Setenv("POWER_POLICY_COMBINE", "all")
+	p, err := Load(Thermal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := p.Evaluate(Reading{TempC: 65}); !d.OK() {
+		t.Fatalf("all-combinator matched a single rule: %+v", d)
+	}
+	if d := p.Evaluate(Reading{TempC: 65, Throttled: true}); d.State != "degraded" {
+		t.Fatalf("Evaluate = %+v, want degraded", d)
+	}
+
+	t.Setenv("POWER_POLICY_RULES", "fan_rpm>100")
+	if _, err := Load(Thermal); err == nil {
+		t.Fatal("expected error for unknown signal")
+	}
+}
+
+func TestExpr(t *testing.T) {
+	p := Policy{Expr: "temp_c > 65 && clock_arm_mhz < 1200 || battery_percent < 20 && !is_charging"}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in   Reading
+		want string
+	}{
+		{Reading{TempC: 70, ClockArmMHz: 1000, BatteryPercent: 80}, "degraded"},
+		{Reading{TempC: 70, ClockArmMHz: 1500, BatteryPercent: 80}, OK},
+		{Reading{TempC: 40, ClockArmMHz: 1500, BatteryPercent: 10}, "degraded"},
+		{Reading{TempC: 40, ClockArmMHz: 1500, BatteryPercent: 10, IsCharging: true}, OK},
+	}
+	for _, tt := range tests {
+		if got := p.Evaluate(tt.in); got.State != tt.want {
+			t.Errorf("Evaluate(%+v) = %+v, want state %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"temp_c >", "fan_rpm > 1", "temp_c + 1"} {
+		if _, err := Compile(bad); err == nil {
+			t.Errorf("Compile(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	p := Thermal
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d := p.Unknown("agent down"); d.State != Unknown || d.Degraded {
+		t.Fatalf("fail-open Unknown = %+v", d)
+	}
+	p.OnUnknown = "closed"
+	if d := p.Unknown("agent down"); !d.Degraded {
+		t.Fatalf("fail-closed Unknown = %+v", d)
+	}
+}
+
+func TestEvaluateHandler(t *testing.T) {
+	p := Thermal
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hot := func() (Reading, string) { return Reading{TempC: 80}, "" }
+	down := func() (Reading, string) { return Reading{}, "no power reading: connection refused" }
+	call := func(h http.HandlerFunc, method, target, body string) (int, map[string]any) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	if _, out := call(EvaluateHandler(&p, hot, false), "GET", "/policy/evaluate", ""); out["decision"].(map[string]any)["state"] != "degraded" {
+		t.Fatalf("hot: %v", out)
+	}
+	// no reading: unknown with the reason, not an evaluation of zeros
+	code, out := call(EvaluateHandler(&p, down, true), "GET", "/policy/evaluate", "")
+	d, _ := out["decision"].(map[string]any)
+	if code != http.StatusOK || d["state"] != Unknown || out["reading"] != nil ||
+		!strings.Contains(fmt.Sprint(d["reasons"]), "connection refused") {
+		t.Fatalf("down: %d %v", code, out)
+	}
+	if _, out := call(EvaluateHandler(&p, down, true), "GET", "/policy/evaluate?expr=temp_c+<+50.0", ""); out["state"] != Unknown || out["result"] != nil {
+		t.Fatalf("down expr: %v", out)
+	}
+
+	// ad-hoc expressions only with debug
+	if code, _ := call(EvaluateHandler(&p, hot, false), "GET", "/policy/evaluate?expr=temp_c+>+65.0", ""); code != http.StatusForbidden {
+		t.Fatalf("expr without debug: %d", code)
+	}
+	debug := EvaluateHandler(&p, hot, true)
+	if _, out := call(debug, "POST", "/policy/evaluate", `{"expr": "temp_c > 65.0"}`); out["result"] != true {
+		t.Fatalf("expr: %v", out)
+	}
+	if code, _ := call(debug, "POST", "/policy/evaluate", `{"expr": "`+strings.Repeat(" ", 8<<10)+`true"}`); code != http.StatusBadRequest {
+		t.Fatalf("oversized body: %d", code)
+	}
+	ten := "[0, 1, 2, 3, 4, 5, 6, 7, 8, 9]"
+	costly := ten + ".all(a, " + ten + ".all(b, " + ten + ".all(c, " + ten + ".all(d, a + b + c + d >= 0))))"
+	if _, out := call(debug, "POST", "/policy/evaluate", `{"expr": "`+costly+`"}`); !strings.Contains(fmt.Sprint(out["error"]), "cost") {
+		t.Fatalf("costly expr: %v", out)
+	}
+}
+
+func TestEvalDebugFromEnv(t *testing.T) {
+	for v, want := range map[string]bool{"1": true, "on": true, "TRUE": true, "": false, "0": false} {
+		if got := EvalDebugFromEnv(func(string) string { return v }); got != want {
+			t.Errorf("POLICY_EVAL_DEBUG=%q: %v", v, got)
+		}
+	}
+}
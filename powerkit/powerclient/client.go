@@ -0,0 +1,270 @@
+// Package powerclient is a cached client for the node power APIs
+// (power-agent's /power, battery-sim's /status).
+//
+// Get never waits on the network: it returns the last good value at once
+// and, when that value is older than the TTL, starts a background refresh.
+// Concurrent callers share a single in-flight fetch. Fetch errors are kept
+// next to the data instead of replacing it, so a failed refresh does not
+// turn into an all-zero reading that looks healthy.
+//
+// A circuit breaker stops fetching after repeated failures (default 3) for a
+// cooldown (default 30s), then lets a single trial fetch through; a dead
+// power API therefore costs one timeout per cooldown instead of one per TTL.
+package powerclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoURL is reported when the client has no endpoint configured.
+var ErrNoURL = errors.New("power API URL not set")
+
+// ErrNoData is reported until the first fetch completed.
+var ErrNoData = errors.New("no power reading yet")
+
+// ErrCircuitOpen is returned by Refresh while the breaker is open.
+var ErrCircuitOpen = errors.New("power API circuit open")
+
+// Client fetches and caches a JSON document of type T.
+type Client[T any] struct {
+	url  string
+	http *http.Client
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	val        T
+	fetchedAt  time.Time // last good fetch
+	err        error     // last fetch error, nil after a good fetch
+	errAt      time.Time
+	refreshing bool
+
+	// circuit breaker
+	maxFailures int
+	cooldown    time.Duration
+	failures    int       // consecutive failed fetches
+	openUntil   time.Time // no fetches before this while failures >= maxFailures
+
+	hits, misses uint64 // Get calls served fresh / not fresh, Peek excluded
+	onFetch      func(time.Duration, error)
+}
+
+// Stats counts how Get calls were served, for cache hit ratio metrics.
+type Stats struct {
+	Hits   uint64 // the cached value was within the TTL
+	Misses uint64 // it was old or missing
+	Open   bool   // circuit breaker open
+}
+
+// Snapshot is what Get returns: the cached value plus its freshness.
+type Snapshot[T any] struct {
+	Value     T
+	FetchedAt time.Time     // zero until the first good fetch
+	Age       time.Duration // time since FetchedAt
+	Fresh     bool          // Age is within the TTL
+	Err       error         // last fetch error, if the latest fetch failed
+	ErrAt     time.Time
+	Open      bool // circuit breaker open: not fetching for now
+}
+
+// HasValue reports whether Value comes from a successful fetch.
+func (s Snapshot[T]) HasValue() bool { return !s.FetchedAt.IsZero() }
+
+// Usable reports whether Value can be trusted for a decision: there was a
+// good fetch and it is at most maxAge old. Otherwise it says why not.
+func (s Snapshot[T]) Usable(maxAge time.Duration) (bool, string) {
+	switch {
+	case !s.HasValue() && s.Err != nil:
+		return false, "no power reading: " + s.Err.Error()
+	case !s.HasValue():
+		return false, "no power reading"
+	case maxAge > 0 && s.Age > maxAge:
+		why := fmt.Sprintf("power reading is %s old", s.Age.Round(time.Second))
+		if s.Err != nil {
+			why += ": " + s.Err.Error()
+		}
+		return false, why
+	}
+	return true, ""
+}
+
+// New returns a client for url with the given per-request timeout and TTL.
+func New[T any](url string, timeout, ttl time.Duration) *Client[T] {
+	return &Client[T]{
+		url:         url,
+		http:        &http.Client{Timeout: timeout},
+		ttl:         ttl,
+		maxFailures: 3,
+		cooldown:    30 * time.Second,
+	}
+}
+
+// WithBreaker sets the circuit breaker: open after maxFailures consecutive
+// failures, for cooldown. maxFailures <= 0 disables it.
+func (c *Client[T]) WithBreaker(maxFailures int, cooldown time.Duration) *Client[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxFailures, c.cooldown = maxFailures, cooldown
+	return c
+}
+
+// OnFetch registers fn to be called after every fetch with its duration
+// and error, e.g. to record latency metrics.
+func (c *Client[T]) OnFetch(fn func(time.Duration, error)) *Client[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onFetch = fn
+	return c
+}
+
+// Stats returns the Get counters.
+func (c *Client[T]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Hits: c.hits, Misses: c.misses, Open: c.open()}
+}
+
+// URL returns the endpoint the client polls.
+func (c *Client[T]) URL() string { return c.url }
+
+// TTL returns the age after which Get triggers a background refresh.
+func (c *Client[T]) TTL() time.Duration { return c.ttl }
+
+// Get returns the cached snapshot and refreshes it in the background when
+// it is stale. It never blocks on the network.
+func (c *Client[T]) Get() Snapshot[T] { return c.get(true) }
+
+// Peek is Get without counting the lookup in Stats, for readers that are
+// not serving a request, such as metrics scrapes; otherwise the hit ratio
+// would follow the scrape interval.
+func (c *Client[T]) Peek() Snapshot[T] { return c.get(false) }
+
+func (c *Client[T]) get(count bool) Snapshot[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.snapshot()
+	switch {
+	case !count:
+	case s.Fresh:
+		c.hits++
+	default:
+		c.misses++
+	}
+	// a failed fetch is retried after the TTL too, not on every call
+	recentErr := c.err != nil && time.Since(c.errAt) < c.ttl
+	if !s.Fresh && !recentErr && c.url != "" && !c.refreshing && c.allow() {
+		c.startRefresh()
+	}
+	return s
+}
+
+// Refresh fetches synchronously, e.g. to warm the cache at startup or from
+// a polling loop. If a background refresh is already running it fetches
+// anyway. While the breaker is open it returns ErrCircuitOpen at once.
+func (c *Client[T]) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	ok := c.allow()
+	c.mu.Unlock()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	v, err := c.fetch(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(v, err)
+	return err
+}
+
+// allow must be called with c.mu held. After the cooldown it admits one
+// trial fetch and re-arms the cooldown for everybody else.
+func (c *Client[T]) allow() bool {
+	if c.maxFailures <= 0 || c.failures < c.maxFailures {
+		return true
+	}
+	if time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.openUntil = time.Now().Add(c.cooldown)
+	return true
+}
+
+func (c *Client[T]) open() bool {
+	return c.maxFailures > 0 && c.failures >= c.maxFailures && time.Now().Before(c.openUntil)
+}
+
+// snapshot must be called with c.mu held.
+func (c *Client[T]) snapshot() Snapshot[T] {
+	s := Snapshot[T]{Value: c.val, FetchedAt: c.fetchedAt, Err: c.err, ErrAt: c.errAt, Open: c.open()}
+	switch {
+	case c.url == "":
+		s.Err = ErrNoURL
+	case c.fetchedAt.IsZero() && c.err == nil:
+		s.Err = ErrNoData
+	}
+	if !c.fetchedAt.IsZero() {
+		s.Age = time.Since(c.fetchedAt)
+		s.Fresh = s.Age < c.ttl
+	}
+	return s
+}
+
+// startRefresh must be called with c.mu held.
+func (c *Client[T]) startRefresh() {
+	c.refreshing = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.http.Timeout+time.Second)
+		defer cancel()
+		v, err := c.fetch(ctx)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.record(v, err)
+		c.refreshing = false
+	}()
+}
+
+// record must be called with c.mu held.
+func (c *Client[T]) record(v T, err error) {
+	if err != nil {
+		c.err, c.errAt = err, time.Now()
+		c.failures++
+		if c.maxFailures > 0 && c.failures == c.maxFailures {
+			c.openUntil = time.Now().Add(c.cooldown)
+		}
+		return
+	}
+	c.val, c.fetchedAt, c.err = v, time.Now(), nil
+	c.failures = 0
+}
+
+func (c *Client[T]) fetch(ctx context.Context) (v T, err error) {
+	c.mu.Lock()
+	hook := c.onFetch
+	c.mu.Unlock()
+	if hook != nil {
+		defer func(start time.Time) { hook(time.Since(start), err) }(time.Now())
+	}
+	if c.url == "" {
+		return v, ErrNoURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return v, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("GET %s: %s", c.url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return v, fmt.Errorf("decode %s: %w", c.url, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,129 @@
+package powerclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type reading struct {
+	TempC float64 `json:"temp_c"`
+}
+
+func TestGetNeverBlocks(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) > 1 {
+			<-release // every refresh after the first hangs
+		}
+		_, _ = w.Write([]byte(`{"temp_c": 55.5}`))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := New[reading](srv.URL, time.Second, time.Millisecond)
+	if s := c.Get(); s.HasValue() || s.Err != ErrNoData {
+		t.Fatalf("cold Get = %+v, want ErrNoData", s)
+	}
+	for !c.Get().HasValue() { // the cold Get started the first fetch
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * time.Millisecond) // let the value go stale
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		s := c.Get()
+		if !s.HasValue() || s.Value.TempC != 55.5 || s.Fresh {
+			t.Fatalf("Get = %+v, want stale 55.5", s)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Get blocked for %s", d)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := hits.Load(); n != 2 { // the first fetch plus one shared background refresh
+		t.Fatalf("server hit %d times, want 2", n)
+	}
+}
+
+func TestErrorKeepsValue(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"temp_c": 71}`))
+	}))
+	defer srv.Close()
+
+	c := New[reading](srv.URL, time.Second, time.Minute)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	s := c.Get()
+	if s.Value.TempC != 71 || s.Err == nil {
+		t.Fatalf("Get = %+v, want last good value and the error", s)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := New[reading](srv.URL, time.Second, time.Millisecond).WithBreaker(2, 50*time.Millisecond)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := c.Refresh(ctx); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("refresh %d: err = %v, want fetch error", i, err)
+		}
+	}
+	if err := c.Refresh(ctx); err != ErrCircuitOpen {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if s := c.Get(); !s.Open {
+		t.Fatalf("Get = %+v, want open circuit", s)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := c.Refresh(ctx); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("trial: err = %v, want fetch error", err)
+	}
+	if err := c.Refresh(ctx); err != ErrCircuitOpen {
+		t.Fatalf("after failed trial: err = %v, want ErrCircuitOpen", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("server hit %d times, want 3", n)
+	}
+}
+
+func TestStatsSkipPeek(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"temp_c": 50}`))
+	}))
+	defer srv.Close()
+
+	c := New[reading](srv.URL, time.Second, time.Minute)
+	if s := c.Peek(); s.HasValue() {
+		t.Fatalf("cold Peek = %+v", s)
+	}
+	for !c.Peek().HasValue() { // Peek refreshes like Get
+		time.Sleep(time.Millisecond)
+	}
+	c.Get()
+	c.Get()
+	if st := c.Stats(); st.Hits != 2 || st.Misses != 0 {
+		t.Fatalf("stats %+v, want 2 hits and no Peek counted", st)
+	}
+}
@@ -0,0 +1,282 @@
+// Package powermetrics exposes Prometheus metrics for power-aware
+// services, so user-facing behavior can be correlated with node state:
+//
+//	power_requests_total{state,route,code}           requests by power decision
+//	power_request_duration_seconds{state}            latency histogram
+//	power_api_fetch_duration_seconds                 power API fetch latency
+//	power_api_fetch_errors_total                     failed power API fetches
+//	power_api_cache_{hits,misses}_total, _hit_ratio  cached client Get calls (not Peek)
+//	power_api_circuit_open                           1 while the breaker is open
+//	power_reading{signal}                            last observed reading
+//	power_reading_age_seconds, power_degraded        ... and what it means
+//
+// plus whatever Config.Collectors add.
+//
+// The state and route labels come from the X-Power-State and X-Power-Route
+// response headers set by powermw and by power-aware proxies, so Instrument
+// goes outside of them. Like power-agent's /metrics the text format is
+// written by hand.
+//
+//	m := powermetrics.New(powermetrics.Config{Policy: pol, Source: powermw.PeekClient(client, reading), Stats: client.Stats})
+//	client.OnFetch(m.ObserveFetch)
+//	mux.Handle("/", m.Instrument(powermw.New(cfg)(h)))
+//	mux.Handle("/metrics", m.Handler())
+package powermetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermw"
+)
+
+// Config says where the gauges come from; every field is optional.
+type Config struct {
+	Policy *policy.Policy
+	Source powermw.Source           // read at scrape time for the power_reading* gauges, see powermw.PeekClient
+	Stats  func() powerclient.Stats // cache counters of the power client
+	// Signals are the reading values exported as power_reading{signal}
+	// (see policy.Reading.Values), default temp_c.
+	Signals []string
+	// Collectors append further metrics in the text format, e.g.
+	// admission.Controller.WriteMetrics.
+	Collectors []func(io.Writer)
+}
+
+var (
+	requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	fetchBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+)
+
+// Metrics collects request and power API metrics.
+type Metrics struct {
+	cfg Config
+
+	mu          sync.Mutex
+	requests    map[requestKey]uint64
+	durations   map[string]*histogram // by state
+	fetches     *histogram
+	fetchErrors uint64
+}
+
+type requestKey struct {
+	state, route string
+	code         int
+}
+
+// New returns an empty set of metrics.
+func New(cfg Config) *Metrics {
+	if len(cfg.Signals) == 0 {
+		cfg.Signals = []string{"temp_c"}
+	}
+	return &Metrics{
+		cfg:       cfg,
+		requests:  map[requestKey]uint64{},
+		durations: map[string]*histogram{},
+		fetches:   newHistogram(fetchBuckets),
+	}
+}
+
+// ObserveFetch records one power API fetch; pass it to the client's OnFetch.
+func (m *Metrics) ObserveFetch(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches.observe(d.Seconds())
+	if err != nil {
+		m.fetchErrors++
+	}
+}
+
+// Instrument counts and times the requests served by next.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		state := w.Header().Get("X-Power-State")
+		if state == "" {
+			state = "none"
+		}
+		route := w.Header().Get("X-Power-Route")
+		if route == "" {
+			route = "handler"
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests[requestKey{state, route, sw.code}]++
+		h := m.durations[state]
+		if h == nil {
+			h = newHistogram(requestBuckets)
+			m.durations[state] = h
+		}
+		h.observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		m.writeCollected(&b)
+		m.writePowerAPI(&b)
+		m.writeReading(&b)
+		for _, c := range m.cfg.Collectors {
+			c(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+	}
+}
+
+func (m *Metrics) writeCollected(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, c := keys[i], keys[j]
+		if a.state != c.state {
+			return a.state < c.state
+		}
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		return a.code < c.code
+	})
+	header(b, "power_requests_total", "Requests served, by power decision, degraded route and status code.", "counter")
+	for _, k := range keys {
+		fmt.Fprintf(b, "power_requests_total{state=%q,route=%q,code=\"%d\"} %d\n", k.state, k.route, k.code, m.requests[k])
+	}
+
+	states := make([]string, 0, len(m.durations))
+	for s := range m.durations {
+		states = append(states, s)
+	}
+	sort.Strings(states)
+	header(b, "power_request_duration_seconds", "Request latency by power decision.", "histogram")
+	for _, s := range states {
+		m.durations[s].write(b, "power_request_duration_seconds", fmt.Sprintf("state=%q", s))
+	}
+
+	header(b, "power_api_fetch_duration_seconds", "Power API fetch latency, including failed fetches.", "histogram")
+	m.fetches.write(b, "power_api_fetch_duration_seconds", "")
+	sample(b, "power_api_fetch_errors_total", "Failed power API fetches.", "counter", float64(m.fetchErrors))
+}
+
+func (m *Metrics) writePowerAPI(b *strings.Builder) {
+	if m.cfg.Stats == nil {
+		return
+	}
+	st := m.cfg.Stats()
+	sample(b, "power_api_cache_hits_total", "Power reading lookups served within the TTL.", "counter", float64(st.Hits))
+	sample(b, "power_api_cache_misses_total", "Power reading lookups that found an old or no reading.", "counter", float64(st.Misses))
+	if n := st.Hits + st.Misses; n > 0 {
+		sample(b, "power_api_cache_hit_ratio", "Share of lookups served within the TTL.", "gauge", float64(st.Hits)/float64(n))
+	}
+	sample(b, "power_api_circuit_open", "1 while the power API circuit breaker is open.", "gauge", b2f(st.Open))
+}
+
+func (m *Metrics) writeReading(b *strings.Builder) {
+	if m.cfg.Source == nil {
+		return
+	}
+	info := m.cfg.Source()
+	if info.Unknown == "" {
+		vals := info.Reading.Values()
+		header(b, "power_reading", "Last observed power reading.", "gauge")
+		for _, s := range m.cfg.Signals {
+			switch v := vals[s].(type) {
+			case float64:
+				fmt.Fprintf(b, "power_reading{signal=%q} %g\n", s, v)
+			case bool:
+				fmt.Fprintf(b, "power_reading{signal=%q} %g\n", s, b2f(v))
+			}
+		}
+	}
+	sample(b, "power_reading_age_seconds", "Age of the cached power reading.", "gauge", info.Age.Seconds())
+	sample(b, "power_reading_unknown", "1 if there is no trustworthy power reading.", "gauge", b2f(info.Unknown != ""))
+	if m.cfg.Policy != nil {
+		sample(b, "power_degraded", "1 if the policy currently counts the node as degraded.", "gauge",
+			b2f(powermw.Decide(m.cfg.Policy, info).Degraded))
+	}
+}
+
+func header(b *strings.Builder, name, help, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(b *strings.Builder, name, help, typ string, v float64) {
+	header(b, name, help, typ)
+	fmt.Fprintf(b, "%s %g\n", name, v)
+}
+
+// histogram is a fixed-bucket Prometheus histogram; callers hold Metrics.mu.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, n)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n%s_count%s %d\n", name, labels, h.sum, name, labels, n)
+}
+
+// statusWriter remembers the status code written by the handler.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach Flush etc. (used by
+// httputil.ReverseProxy).
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package powermetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+	"powerkit/powermw"
+	"powerkit/powertest"
+)
+
+type agent = powertest.Agent
+
+func reading(a agent) policy.Reading {
+	return policy.Reading{TempC: a.TempC, Throttled: a.Throttled, FreqCapped: a.FreqCapped}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := powertest.New(t, powertest.JSON(powertest.Throttled()), powertest.Malformed())
+	c := powerclient.New[agent](srv.URL, time.Second, time.Minute)
+	p := policy.Thermal
+	src := powermw.FromClient(c, reading)
+	m := New(Config{Policy: &p, Source: powermw.PeekClient(c, reading), Stats: c.Stats, Signals: []string{"temp_c", "throttled"}})
+	c.OnFetch(m.ObserveFetch)
+
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Refresh(context.Background()) // malformed: counted as an error, reading kept
+
+	h := m.Instrument(powermw.New(powermw.Config{Policy: &p, Source: src, Shed: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, path := range []string{"/a", "/b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// scrapes don't count as cache lookups, only the two requests do
+	var out string
+	for range 3 {
+		w := httptest.NewRecorder()
+		m.Handler()(w, httptest.NewRequest("GET", "/metrics", nil))
+		out = w.Body.String()
+	}
+	for _, want := range []string{
+		`power_requests_total{state="degraded",route="shed",code="503"} 2`,
+		`power_request_duration_seconds_count{state="degraded"} 2`,
+		`power_request_duration_seconds_bucket{state="degraded",le="+Inf"} 2`,
+		`power_api_fetch_duration_seconds_count 2`,
+		`power_api_fetch_errors_total 1`,
+		`power_api_cache_hits_total 2`,
+		`power_api_cache_misses_total 0`,
+		`power_api_cache_hit_ratio 1`,
+		`power_api_circuit_open 0`,
+		`power_reading{signal="temp_c"} 85`,
+		`power_reading{signal="throttled"} 1`,
+		`power_reading_unknown 0`,
+		`power_degraded 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1, 1.5, 3} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.write(&b, "x", "")
+	want := "x_bucket{le=\"1\"} 2\nx_bucket{le=\"2\"} 3\nx_bucket{le=\"+Inf\"} 4\nx_sum 6\nx_count 4\n"
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
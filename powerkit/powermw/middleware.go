@@ -0,0 +1,187 @@
+// Package powermw is power-aware HTTP middleware for Go services.
+//
+// Wrapping a mux with New attaches the current power reading and policy
+// decision to every request's context, sets X-Power-State and
+// X-Node-Degraded on the response, and, when configured, sheds or reroutes
+// requests while the node is degraded:
+//
+//	src := powermw.FromClient(client, Power.reading)
+//	h := powermw.New(powermw.Config{Policy: pol, Source: src, Shed: true})(mux)
+//
+// Handlers read the result with powermw.FromContext.
+package powermw
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"powerkit/policy"
+	"powerkit/powerclient"
+)
+
+// Info is what the middleware attaches to the request context.
+type Info struct {
+	Power    any // the raw reading as served by the power API
+	Reading  policy.Reading
+	Decision policy.Decision
+	Age      time.Duration // age of the reading
+	Fresh    bool
+	Err      error  // last fetch error, if any
+	Unknown  string // why Reading can't be trusted; empty when it can
+}
+
+// Degraded reports whether the node counts as degraded. An unknown state
+// counts only with a fail-closed policy.
+func (i Info) Degraded() bool { return i.Decision.Degraded }
+
+// Source returns the current reading; Decision is filled in by the middleware.
+type Source func() Info
+
+// FromClient adapts a cached power client to a Source. A reading older
+// than three TTLs, or none at all, makes the state unknown.
+func FromClient[T any](c *powerclient.Client[T], reading func(T) policy.Reading) Source {
+	return fromSnapshot(c.Get, c.TTL(), reading)
+}
+
+// PeekClient is FromClient for metrics scrapes: it reads with Peek, so
+// scrapes don't count as cache lookups.
+func PeekClient[T any](c *powerclient.Client[T], reading func(T) policy.Reading) Source {
+	return fromSnapshot(c.Peek, c.TTL(), reading)
+}
+
+func fromSnapshot[T any](get func() powerclient.Snapshot[T], ttl time.Duration, reading func(T) policy.Reading) Source {
+	return func() Info {
+		s := get()
+		_, why := s.Usable(3 * ttl)
+		return Info{Power: s.Value, Reading: reading(s.Value), Age: s.Age, Fresh: s.Fresh, Err: s.Err, Unknown: why}
+	}
+}
+
+// Decide evaluates p against info's reading, or returns the unknown
+// decision when the reading can't be trusted.
+func Decide(p *policy.Policy, info Info) policy.Decision {
+	if info.Unknown != "" {
+		return p.Unknown(info.Unknown)
+	}
+	return p.Evaluate(info.Reading)
+}
+
+// Config controls what happens to requests while the node is degraded.
+type Config struct {
+	Policy *policy.Policy
+	Source Source
+
+	// Shed answers degraded requests with 503 and Retry-After.
+	Shed bool
+	// RetryAfter returns the Retry-After seconds for shed requests
+	// (default 30).
+	RetryAfter func(Info) int
+	// Reroute, if set, serves degraded requests instead of the wrapped
+	// handler, e.g. a reverse proxy to a cloud instance. It wins over Shed.
+	Reroute http.Handler
+	// Allow marks priority requests that always reach the wrapped handler.
+	Allow func(*http.Request) bool
+}
+
+type ctxKey struct{}
+
+// FromContext returns the power info attached by the middleware.
+func FromContext(ctx context.Context) (Info, bool) {
+	i, ok := ctx.Value(ctxKey{}).(Info)
+	return i, ok
+}
+
+// New returns the middleware.
+func New(cfg Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := cfg.Source()
+			info.Decision = Decide(cfg.Policy, info)
+			w.Header().Set("X-Power-State", info.Decision.State)
+			w.Header().Set("X-Node-Degraded", strconv.FormatBool(info.Degraded()))
+			r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, info))
+
+			if !info.Degraded() || (cfg.Allow != nil && cfg.Allow(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch {
+			case cfg.Reroute != nil:
+				w.Header().Set("X-Power-Route", "reroute")
+				cfg.Reroute.ServeHTTP(w, r)
+			case cfg.Shed:
+				cfg.ShedResponse(w, info)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// ShedResponse answers with 503 and Retry-After the way the middleware
+// sheds, for Reroute handlers that shed some requests themselves.
+func (cfg Config) ShedResponse(w http.ResponseWriter, info Info) {
+	retry := 30
+	if cfg.RetryAfter != nil {
+		retry = cfg.RetryAfter(info)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.Header().Set("X-Power-Route", "shed")
+	http.Error(w, "node "+info.Decision.State+", retry on another replica", http.StatusServiceUnavailable)
+}
+
+// ShedFromEnv reports whether SHED_MODE turns shedding on: "on", "true",
+// "1" or "shed", in any case.
+func ShedFromEnv(getenv func(string) string) bool {
+	switch strings.ToLower(strings.TrimSpace(getenv("SHED_MODE"))) {
+	case "on", "true", "1", "shed":
+		return true
+	}
+	return false
+}
+
+// AllowFromEnv builds an Allow func from SHED_ALLOW_PATHS (comma-separated
+// path prefixes, matched by whole segments: /priority covers /priority/x
+// but not /priority-x) and SHED_ALLOW_HEADERS (comma-separated "Header" or
+// "Header=value"). It returns nil when neither is set.
+func AllowFromEnv(getenv func(string) string) func(*http.Request) bool {
+	var paths []string
+	var headers [][2]string
+	for _, p := range strings.Split(getenv("SHED_ALLOW_PATHS"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	for _, h := range strings.Split(getenv("SHED_ALLOW_HEADERS"), ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(h, "=")
+		headers = append(headers, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	if len(paths) == 0 && len(headers) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		for _, p := range paths {
+			if underPath(r.URL.Path, p) {
+				return true
+			}
+		}
+		for _, h := range headers {
+			v := r.Header.Get(h[0])
+			if v != "" && (h[1] == "" || strings.EqualFold(v, h[1])) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// underPath reports whether path is prefix or lies below it.
+func underPath(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
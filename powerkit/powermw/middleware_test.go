@@ -0,0 +1,77 @@
+package powermw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"powerkit/policy"
+)
+
+func TestMiddleware(t *testing.T) {
+	hot := func() Info { return Info{Reading: policy.Reading{TempC: 80}} }
+	cool := func() Info { return Info{Reading: policy.Reading{TempC: 40}} }
+	down := func() Info { return Info{Unknown: "no power reading"} }
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); !ok {
+			t.Error("no power info in context")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+	t.Setenv("SHED_ALLOW_PATHS", "/priority")
+	allow := AllowFromEnv(os.Getenv)
+	pol := policy.Thermal
+	closed := policy.Thermal
+	closed.OnUnknown = "closed"
+	for _, p := range []*policy.Policy{&pol, &closed} {
+		if err := p.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		path     string
+		want     int
+		degraded string
+	}{
+		{"cool passes", Config{Source: cool, Shed: true}, "/", http.StatusTeapot, "false"},
+		{"hot annotates only", Config{Source: hot}, "/", http.StatusTeapot, "true"},
+		{"hot sheds", Config{Source: hot, Shed: true, Allow: allow}, "/", http.StatusServiceUnavailable, "true"},
+		{"priority passes", Config{Source: hot, Shed: true, Allow: allow}, "/priority/x", http.StatusTeapot, "true"},
+		{"priority path itself passes", Config{Source: hot, Shed: true, Allow: allow}, "/priority", http.StatusTeapot, "true"},
+		{"lookalike path sheds", Config{Source: hot, Shed: true, Allow: allow}, "/priority-x", http.StatusServiceUnavailable, "true"},
+		{"hot reroutes", Config{Source: hot, Shed: true, Reroute: http.NotFoundHandler()}, "/", http.StatusNotFound, "true"},
+		{"unknown fails open", Config{Source: down, Shed: true}, "/", http.StatusTeapot, "false"},
+		{"unknown fails closed", Config{Policy: &closed, Source: down, Shed: true}, "/", http.StatusServiceUnavailable, "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cfg.Policy == nil {
+				tt.cfg.Policy = &pol
+			}
+			w := httptest.NewRecorder()
+			New(tt.cfg)(next).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("X-Node-Degraded"); got != tt.degraded {
+				t.Fatalf("X-Node-Degraded = %q, want %q", got, tt.degraded)
+			}
+		})
+	}
+}
+
+func TestShedFromEnv(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"on": true, "ON": true, "true": true, "1": true, "Shed": true,
+		"": false, "off": false, "0": false, "reroute": false,
+	} {
+		getenv := func(string) string { return mode }
+		if got := ShedFromEnv(getenv); got != want {
+			t.Fatalf("SHED_MODE=%q: %v, want %v", mode, got, want)
+		}
+	}
+}
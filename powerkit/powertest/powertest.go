@@ -0,0 +1,197 @@
+// Package powertest provides an in-process fake of the node power APIs
+// (power-agent's /power, battery-sim's /status) for tests.
+//
+// A Server plays a script of responses, one per request: readings, slow
+// answers, malformed JSON, error statuses or a dropped connection. Each step
+// serves Times requests (default 1) and the last step repeats, so a test can
+// walk a node from cool through throttled back to recovered:
+//
+//	srv := powertest.New(t,
+//		powertest.JSON(powertest.Cool()),
+//		powertest.JSON(powertest.Throttled()),
+//		powertest.Down(),
+//		powertest.JSON(powertest.Cool()),
+//	)
+//	client := powerclient.New[Power](srv.URL, time.Second, time.Minute)
+package powertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Agent is the power-agent /power payload.
+type Agent struct {
+	Timestamp    time.Time `json:"timestamp"`
+	TempC        float64   `json:"temp_c"`
+	VoltV        float64   `json:"volt_v"`
+	ClockArmMHz  float64   `json:"clock_arm_mhz"`
+	Undervoltage bool      `json:"undervoltage"`
+	FreqCapped   bool      `json:"freq_capped"`
+	Throttled    bool      `json:"throttled"`
+	Stale        bool      `json:"stale"`
+}
+
+// Cool is a healthy Pi at full clock.
+func Cool() Agent {
+	return Agent{Timestamp: time.Now(), TempC: 48, VoltV: 0.86, ClockArmMHz: 1800}
+}
+
+// Hot is above the thermal limit of policy.Thermal but not yet throttled.
+func Hot() Agent {
+	return Agent{Timestamp: time.Now(), TempC: 82, VoltV: 0.86, ClockArmMHz: 1800}
+}
+
+// Throttled is a Pi that the firmware has already capped.
+func Throttled() Agent {
+	return Agent{Timestamp: time.Now(), TempC: 85, VoltV: 0.86, ClockArmMHz: 1000, FreqCapped: true, Throttled: true}
+}
+
+// Undervolted is a Pi on a weak power supply.
+func Undervolted() Agent {
+	return Agent{Timestamp: time.Now(), TempC: 50, VoltV: 0.8, ClockArmMHz: 1800, Undervoltage: true}
+}
+
+// Battery is the battery-sim /status payload.
+type Battery struct {
+	NodeName       string `json:"node_name"`
+	BatteryPercent int    `json:"battery_percent"`
+	IsCharging     bool   `json:"is_charging"`
+	TimeOfDay      string `json:"time_of_day"`
+	SolarAvailable bool   `json:"solar_available"`
+	LastUpdated    string `json:"last_updated"`
+}
+
+// Day is a node charging from solar.
+func Day(percent int) Battery {
+	return Battery{NodeName: "sim", BatteryPercent: percent, IsCharging: true, TimeOfDay: "day",
+		SolarAvailable: true, LastUpdated: time.Now().UTC().Format(time.RFC3339)}
+}
+
+// Night is a node running from its battery.
+func Night(percent int) Battery {
+	return Battery{NodeName: "sim", BatteryPercent: percent, TimeOfDay: "night",
+		LastUpdated: time.Now().UTC().Format(time.RFC3339)}
+}
+
+// Response is one step of a script.
+type Response struct {
+	Status int           // HTTP status, default 200
+	Body   any           // encoded as JSON
+	Raw    string        // sent verbatim instead of Body
+	Delay  time.Duration // wait before answering (cut short if the client gives up)
+	Down   bool          // drop the connection without answering
+	Times  int           // requests served by this step, default 1
+}
+
+// JSON answers with v.
+func JSON(v any) Response { return Response{Body: v} }
+
+// Slow answers with v after d.
+func Slow(d time.Duration, v any) Response { return Response{Body: v, Delay: d} }
+
+// Malformed answers 200 with a body that is not valid JSON.
+func Malformed() Response { return Response{Raw: `{"temp_c": 48.5, "volt_v":`} }
+
+// Status answers with an error status.
+func Status(code int) Response {
+	return Response{Status: code, Raw: http.StatusText(code)}
+}
+
+// Down drops the connection, as if the agent crashed mid-request.
+func Down() Response { return Response{Down: true} }
+
+// Repeat serves r for n requests.
+func (r Response) Repeat(n int) Response {
+	r.Times = n
+	return r
+}
+
+// Server is a scripted fake power API.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	script []Response
+	served int // requests served by script[0]
+	hits   int
+}
+
+// New starts a server playing script; it is closed when the test ends.
+func New(t testing.TB, script ...Response) *Server {
+	t.Helper()
+	s := &Server{script: script}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	// a fresh connection per request: Go's client transparently retries a
+	// GET whose reused connection was dropped, which would eat a step
+	s.Config.SetKeepAlivesEnabled(false)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Set replaces the script; the next request gets its first step.
+func (s *Server) Set(script ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script, s.served = script, 0
+}
+
+// Hits returns the number of requests served so far.
+func (s *Server) Hits() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits
+}
+
+// next returns the current step and advances the script.
+func (s *Server) next() (Response, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits++
+	if len(s.script) == 0 {
+		return Response{}, false
+	}
+	r := s.script[0]
+	s.served++
+	if len(s.script) > 1 && s.served >= max(r.Times, 1) {
+		s.script, s.served = s.script[1:], 0
+	}
+	return r, true
+}
+
+func (s *Server) serve(w http.ResponseWriter, req *http.Request) {
+	r, ok := s.next()
+	if !ok {
+		http.Error(w, "no script", http.StatusNotImplemented)
+		return
+	}
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if r.Down {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	if r.Raw != "" {
+		w.WriteHeader(r.Status)
+		_, _ = w.Write([]byte(r.Raw))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.Status)
+	_ = json.NewEncoder(w).Encode(r.Body)
+}
@@ -0,0 +1,66 @@
+package powertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"powerkit/powerclient"
+)
+
+func TestScript(t *testing.T) {
+	srv := New(t,
+		JSON(Cool()).Repeat(2),
+		Malformed(),
+		Status(500),
+		Down(),
+		Slow(time.Second, Hot()),
+		JSON(Throttled()),
+	)
+	c := powerclient.New[Agent](srv.URL, 200*time.Millisecond, time.Minute).WithBreaker(0, 0)
+
+	steps := []struct {
+		name  string
+		fails bool
+		temp  float64 // last good reading afterwards
+	}{
+		{"cool", false, 48},
+		{"cool again", false, 48},
+		{"malformed", true, 48},
+		{"status", true, 48},
+		{"down", true, 48},
+		{"slow", true, 48},
+		{"throttled", false, 85},
+		{"last step repeats", false, 85},
+	}
+	for _, st := range steps {
+		err := c.Refresh(context.Background())
+		if (err != nil) != st.fails {
+			t.Fatalf("%s: err = %v, want failure %v", st.name, err, st.fails)
+		}
+		if got := c.Get().Value.TempC; got != st.temp {
+			t.Fatalf("%s: temp %v, want %v", st.name, got, st.temp)
+		}
+	}
+	if srv.Hits() != len(steps) {
+		t.Fatalf("hits = %d, want %d", srv.Hits(), len(steps))
+	}
+
+	srv.Set(JSON(Night(20)))
+	b := powerclient.New[Battery](srv.URL, time.Second, time.Minute)
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Get().Value; got.BatteryPercent != 20 || got.TimeOfDay != "night" {
+		t.Fatalf("battery = %+v", got)
+	}
+}
+
+func TestEmptyScript(t *testing.T) {
+	srv := New(t)
+	c := powerclient.New[Agent](srv.URL, time.Second, time.Minute)
+	if err := c.Refresh(context.Background()); err == nil || errors.Is(err, powerclient.ErrNoData) {
+		t.Fatalf("err = %v, want status error", err)
+	}
+}
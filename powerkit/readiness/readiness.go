@@ -0,0 +1,117 @@
+// Package readiness turns policy decisions into a Kubernetes readiness probe,
+// so Services and Knative stop routing to replicas on struggling nodes.
+//
+// It is opt-in via the environment:
+//
+//	READYZ_POWER_AWARE    on to fail /readyz while the node is degraded (default off)
+//	READYZ_UNREADY_AFTER  consecutive non-ok probes before turning unready (default 3)
+//	READYZ_READY_AFTER    consecutive ok probes before turning ready again (default 2)
+//	READYZ_MAX_UNREADY    report ready anyway after being unready this long (default 10m),
+//	                      so a fleet-wide heat wave cannot take every replica out
+package readiness
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerkit/policy"
+)
+
+// Gate applies hysteresis to a stream of decisions.
+type Gate struct {
+	UnreadyAfter int
+	ReadyAfter   int
+	MaxUnready   time.Duration
+
+	mu           sync.Mutex
+	unready      bool
+	bad, good    int
+	unreadySince time.Time
+	overridden   bool // MaxUnready hit; ready until the node recovers
+}
+
+// FromEnv returns the configured gate, or nil when power-aware readiness is
+// off.
+func FromEnv() (*Gate, error) {
+	switch strings.ToLower(os.Getenv("READYZ_POWER_AWARE")) {
+	case "on", "true", "1":
+	default:
+		return nil, nil
+	}
+	g := &Gate{UnreadyAfter: 3, ReadyAfter: 2, MaxUnready: 10 * time.Minute}
+	for _, v := range []struct {
+		env string
+		dst *int
+	}{{"READYZ_UNREADY_AFTER", &g.UnreadyAfter}, {"READYZ_READY_AFTER", &g.ReadyAfter}} {
+		if s := os.Getenv(v.env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("readiness: %s must be a positive integer, got %q", v.env, s)
+			}
+			*v.dst = n
+		}
+	}
+	if s := os.Getenv("READYZ_MAX_UNREADY"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("readiness: READYZ_MAX_UNREADY: %w", err)
+		}
+		g.MaxUnready = d
+	}
+	return g, nil
+}
+
+// Observe feeds one decision into the gate and reports whether the replica
+// should be ready, with a short explanation.
+func (g *Gate) Observe(d policy.Decision, now time.Time) (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !d.Degraded {
+		g.bad, g.overridden = 0, false
+		g.good++
+		if g.unready && g.good >= g.ReadyAfter {
+			g.unready = false
+		}
+	} else {
+		g.good = 0
+		g.bad++
+		if !g.unready && !g.overridden && g.bad >= g.UnreadyAfter {
+			g.unready, g.unreadySince = true, now
+		}
+	}
+
+	if g.unready && g.MaxUnready > 0 && now.Sub(g.unreadySince) >= g.MaxUnready {
+		g.unready, g.overridden = false, true
+	}
+	switch {
+	case g.unready:
+		return false, fmt.Sprintf("node %s since %s: %s", d.State, g.unreadySince.Format(time.RFC3339), strings.Join(d.Reasons, ", "))
+	case g.overridden:
+		return true, fmt.Sprintf("node %s but unready longer than %s; serving anyway", d.State, g.MaxUnready)
+	}
+	return true, "ok"
+}
+
+// Handler serves /readyz, evaluating the current decision on every probe.
+// A nil gate always reports ready.
+func (g *Gate) Handler(current func() policy.Decision) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if g == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		ready, why := g.Observe(current(), time.Now())
+		if !ready {
+			http.Error(w, why, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(why))
+	}
+}
@@ -0,0 +1,40 @@
+package readiness
+
+import (
+	"testing"
+	"time"
+
+	"powerkit/policy"
+)
+
+func TestGateHysteresis(t *testing.T) {
+	g := &Gate{UnreadyAfter: 2, ReadyAfter: 2, MaxUnready: time.Minute}
+	ok := policy.Decision{State: policy.OK}
+	hot := policy.Decision{State: "degraded", Degraded: true, Reasons: []string{"temp_c>70"}}
+	t0 := time.Now()
+
+	steps := []struct {
+		d     policy.Decision
+		at    time.Duration
+		ready bool
+	}{
+		{hot, 0, true},              // one bad probe is not enough
+		{ok, 5 * time.Second, true}, // and is forgotten
+		{hot, 10 * time.Second, true},
+		{hot, 15 * time.Second, false}, // two in a row: unready
+		{ok, 20 * time.Second, false},  // one ok probe does not flip back
+		{hot, 25 * time.Second, false},
+		{hot, 80 * time.Second, true}, // MaxUnready exceeded: ready anyway
+		{hot, 85 * time.Second, true}, // and stays so while still degraded
+		{ok, 90 * time.Second, true},  // recovery re-arms the gate
+		{hot, 95 * time.Second, true},
+		{hot, 100 * time.Second, false},
+		{ok, 105 * time.Second, false},
+		{ok, 110 * time.Second, true}, // two ok probes: ready
+	}
+	for i, s := range steps {
+		if ready, why := g.Observe(s.d, t0.Add(s.at)); ready != s.ready {
+			t.Fatalf("step %d: ready=%v (%s), want %v", i, ready, why, s.ready)
+		}
+	}
+}